@@ -0,0 +1,176 @@
+package modpox
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/wozz/modpox/upstream"
+	"golang.org/x/mod/module"
+)
+
+// maxAdminBodySize limits the size of admin request bodies, like go.sum
+// files posted to the allowlist
+const maxAdminBodySize = 10 << 20
+
+// requireAdmin only passes requests with the admin token as a bearer token
+// on to h, with their body limited to maxAdminBodySize. Admin endpoints are
+// disabled if no token is configured.
+func requireAdmin(srv *Server, h func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if srv.adminToken == "" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(srv.adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="modpox admin"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxAdminBodySize)
+		h(w, r)
+	}
+}
+
+// newStatusHandler serves the retractions and deprecation of a module at
+// /admin/status/<module path>
+func newStatusHandler(srv *Server) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		modPath := strings.TrimPrefix(r.URL.Path, "/admin/status/")
+		for _, su := range srv.status {
+			status, err := su.Status(modPath)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				log.Printf("module status error: %s %v", modPath, err)
+				return
+			}
+			if status == nil {
+				continue
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(status); err != nil {
+				log.Printf("json encode error: %v", err)
+			}
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "no status available for module %s\n", modPath)
+	}
+}
+
+// newMetricsHandler serves upstream metrics in the prometheus text format at
+// /admin/metrics
+func newMetricsHandler(srv *Server) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		var metrics []upstream.Metric
+		for _, mu := range srv.metrics {
+			metrics = append(metrics, mu.Metrics()...)
+		}
+		// samples of the same metric must be grouped together
+		sort.SliceStable(metrics, func(i, j int) bool {
+			return metrics[i].Name < metrics[j].Name
+		})
+		for i, m := range metrics {
+			if i == 0 || metrics[i-1].Name != m.Name {
+				metricType := "gauge"
+				if strings.HasSuffix(m.Name, "_total") {
+					metricType = "counter"
+				}
+				fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.Name, m.Help, m.Name, metricType)
+			}
+			fmt.Fprintf(w, "%s%s %g\n", m.Name, formatLabels(m.Labels), m.Value)
+		}
+	}
+}
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%s=%q", k, labels[k])
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// newAccessRequestHandler lists the versions denied by an allowlist-only
+// policy at /admin/policy/requests, approves them with POST and rejects them
+// with DELETE /admin/policy/requests/<module>@<version>. Posting a go.sum
+// file to /admin/policy/allowlist approves all versions in it.
+func newAccessRequestHandler(srv *Server) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if srv.allowlist == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.URL.Path == "/admin/policy/allowlist" {
+			if r.Method != http.MethodPost {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			n, err := srv.allowlist.ImportGoSum(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "%v\n", err)
+				return
+			}
+			fmt.Fprintf(w, "approved %d module versions\n", n)
+			return
+		}
+		mod := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/policy/requests"), "/")
+		if mod == "" {
+			if r.Method != http.MethodGet {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(srv.allowlist.Requests()); err != nil {
+				log.Printf("json encode error: %v", err)
+			}
+			return
+		}
+		i := strings.LastIndex(mod, "@")
+		if i < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "invalid module@version: %s\n", mod)
+			return
+		}
+		m := module.Version{Path: mod[:i], Version: mod[i+1:]}
+		switch r.Method {
+		case http.MethodPost:
+			if err := srv.allowlist.Approve(m); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "%v\n", err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodDelete:
+			ok, err := srv.allowlist.Reject(m)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				log.Printf("access request error: %v", err)
+				return
+			}
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
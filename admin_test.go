@@ -0,0 +1,143 @@
+package modpox
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/wozz/modpox/policy"
+	"github.com/wozz/modpox/upstream"
+	"golang.org/x/mod/module"
+)
+
+type statusUpstream map[string]*upstream.ModuleStatus
+
+func (su statusUpstream) Get(key string) ([]byte, int, error) {
+	return nil, http.StatusNotFound, nil
+}
+
+func (su statusUpstream) Status(modPath string) (*upstream.ModuleStatus, error) {
+	return su[modPath], nil
+}
+
+// adminRequest makes a request to an admin handler with the given token
+func adminRequest(h func(http.ResponseWriter, *http.Request), method, path, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+func TestRequireAdmin(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}
+	if w := adminRequest(requireAdmin(&Server{}, ok), http.MethodGet, "/admin/status/m", "token"); w.Code != http.StatusNotFound {
+		t.Errorf("admin endpoints should be disabled without a token, got %d", w.Code)
+	}
+	srv := &Server{adminToken: "secret"}
+	for token, want := range map[string]int{
+		"":        http.StatusUnauthorized,
+		"wrong":   http.StatusUnauthorized,
+		"secre":   http.StatusUnauthorized,
+		"secret":  http.StatusNoContent,
+		"secret2": http.StatusUnauthorized,
+	} {
+		if w := adminRequest(requireAdmin(srv, ok), http.MethodGet, "/admin/status/m", token); w.Code != want {
+			t.Errorf("token %q: got status %d, want %d", token, w.Code, want)
+		}
+	}
+	r := httptest.NewRequest(http.MethodGet, "/admin/status/m", nil)
+	r.SetBasicAuth("secret", "secret")
+	w := httptest.NewRecorder()
+	requireAdmin(srv, ok)(w, r)
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("basic auth should be refused, got %d", w.Code)
+	}
+}
+
+func TestStatusHandler(t *testing.T) {
+	status := &upstream.ModuleStatus{
+		Module:     "gitlab.example.com/group/project",
+		Latest:     "v1.1.0",
+		Deprecated: "use gitlab.example.com/group/other",
+		Retractions: []upstream.Retraction{
+			{Low: "v1.0.1", High: "v1.0.1", Rationale: "broken"},
+			{Low: "v1.2.0", High: "v1.3.0"},
+		},
+	}
+	srv := &Server{
+		adminToken: "secret",
+		status:     []upstream.StatusUpstream{statusUpstream{}, statusUpstream{status.Module: status}},
+	}
+	h := requireAdmin(srv, newStatusHandler(srv))
+
+	if w := adminRequest(h, http.MethodGet, "/admin/status/"+status.Module, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected unauthenticated request to be refused, got %d", w.Code)
+	}
+	w := adminRequest(h, http.MethodGet, "/admin/status/"+status.Module, "secret")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("unexpected response: %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	var got upstream.ModuleStatus
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&got, status) {
+		t.Errorf("got status %+v, want %+v", got, status)
+	}
+	// empty rationales are omitted
+	var raw map[string]interface{}
+	w = adminRequest(h, http.MethodGet, "/admin/status/"+status.Module, "secret")
+	json.NewDecoder(w.Body).Decode(&raw)
+	if second := raw["Retractions"].([]interface{})[1].(map[string]interface{}); second["Rationale"] != nil {
+		t.Errorf("expected empty rationale to be omitted: %v", second)
+	}
+
+	if w := adminRequest(h, http.MethodGet, "/admin/status/example.com/unknown", "secret"); w.Code != http.StatusNotFound {
+		t.Errorf("expected not found for unknown module, got %d", w.Code)
+	}
+}
+
+func TestAccessRequestHandler(t *testing.T) {
+	allowlist, err := policy.OpenAllowlist("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{adminToken: "secret", allowlist: allowlist}
+	h := requireAdmin(srv, newAccessRequestHandler(srv))
+
+	for _, req := range []struct{ method, path string }{
+		{http.MethodGet, "/admin/policy/requests"},
+		{http.MethodPost, "/admin/policy/requests/example.com/a@v1.0.0"},
+		{http.MethodDelete, "/admin/policy/requests/example.com/a@v1.0.0"},
+		{http.MethodPost, "/admin/policy/allowlist"},
+	} {
+		if w := adminRequest(h, req.method, req.path, ""); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s %s: expected unauthenticated request to be refused, got %d", req.method, req.path, w.Code)
+		}
+	}
+	m := module.Version{Path: "example.com/a", Version: "v1.0.0"}
+	if allowlist.Allowed(m) {
+		t.Fatalf("version approved without authentication")
+	}
+	if w := adminRequest(h, http.MethodPost, "/admin/policy/requests/example.com/a@v1.0.0", "secret"); w.Code != http.StatusNoContent || !allowlist.Allowed(m) {
+		t.Errorf("approval failed: %d", w.Code)
+	}
+
+	// go.sum files larger than maxAdminBodySize are refused
+	line := "example.com/b v1.0.0 h1:AAAA=\n"
+	r := httptest.NewRequest(http.MethodPost, "/admin/policy/allowlist", strings.NewReader(strings.Repeat(line, maxAdminBodySize/len(line)+1)))
+	r.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	h(w, r)
+	if w.Code != http.StatusBadRequest || allowlist.Allowed(module.Version{Path: "example.com/b", Version: "v1.0.0"}) {
+		t.Errorf("oversized go.sum imported: %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,311 @@
+package modpox
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wozz/modpox/upstream"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/sumdb"
+)
+
+const quarantineFile = "quarantine.json"
+
+// auditor periodically compares the hashes of cached .mod and .zip files
+// with the same files from each proxy and the checksum database, and
+// quarantines versions with inconsistent hashes. Private modules, matching
+// the noSumDB patterns or fetched with end user credentials, are not
+// requested from the proxies. It also refuses requests for quarantined
+// versions.
+type auditor struct {
+	cache *cache
+	// sources are the proxies compared against, by endpoint
+	sources map[string]upstream.Upstream
+	// noSumDB are the GONOSUMDB style patterns of private modules
+	noSumDB string
+	// client looks up hashes in the checksum database dbName, if set
+	client   *sumDBClient
+	dbName   string
+	upstream upstream.Upstream
+	// file the quarantine is stored in, if set
+	file string
+
+	mu sync.Mutex
+	// checked is the hash of each cached file that was found consistent
+	checked map[string]string
+	// quarantine maps quarantined module@version to the reason
+	quarantine map[string]string
+	alerts     int
+}
+
+func newAuditor(c *cache, sources map[string]upstream.Upstream, db *SumDB, noSumDB []string, u upstream.Upstream) *auditor {
+	a := &auditor{
+		cache:      c,
+		sources:    sources,
+		noSumDB:    strings.Join(noSumDB, ","),
+		upstream:   u,
+		checked:    make(map[string]string),
+		quarantine: make(map[string]string),
+	}
+	if db != nil && db.Key != "" {
+		a.dbName = db.Name
+		a.client = newSumDBClient(db, noSumDB, u)
+	}
+	return a
+}
+
+// load reads the quarantine stored in dir, which is created if it doesn't
+// exist, and stores changes to it there
+func (a *auditor) load(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("%w: could not create audit dir", err)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.file = filepath.Join(dir, quarantineFile)
+	b, err := os.ReadFile(a.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%w: could not read quarantine", err)
+	}
+	if err := json.Unmarshal(b, &a.quarantine); err != nil {
+		return fmt.Errorf("%w: could not parse quarantine", err)
+	}
+	return nil
+}
+
+// save stores the quarantine, a.mu must be held
+func (a *auditor) save() error {
+	if a.file == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(a.quarantine, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(a.file), ".tmp-")
+	if err != nil {
+		return fmt.Errorf("%w: could not save quarantine", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("%w: could not save quarantine", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("%w: could not save quarantine", err)
+	}
+	return os.Rename(tmp.Name(), a.file)
+}
+
+// Get refuses requests for quarantined versions
+func (a *auditor) Get(key string) ([]byte, int, error) {
+	return a.get(key, nil)
+}
+
+// GetAs implements upstream.AuthUpstream
+func (a *auditor) GetAs(key string, creds *upstream.Credentials) ([]byte, int, error) {
+	return a.get(key, creds)
+}
+
+func (a *auditor) get(key string, creds *upstream.Credentials) ([]byte, int, error) {
+	if m, _, ok := parseDownloadKey(key); ok {
+		a.mu.Lock()
+		reason, quarantined := a.quarantine[m.String()]
+		a.mu.Unlock()
+		if quarantined {
+			return []byte(fmt.Sprintf("%s is quarantined: %s\n", m, reason)), http.StatusForbidden, nil
+		}
+	}
+	return upstream.GetAs(a.upstream, key, creds)
+}
+
+// run audits the cache at interval until the process exits
+func (a *auditor) run(interval time.Duration) {
+	t := time.NewTicker(interval)
+	for range t.C {
+		a.audit()
+	}
+}
+
+// audit checks all cached .mod and .zip files that changed since they were
+// last found consistent
+func (a *auditor) audit() {
+	type entry struct {
+		key    string
+		value  []byte
+		scoped bool
+	}
+	var entries []entry
+	a.cache.mu.RLock()
+	for key, v := range a.cache.c {
+		// files fetched with end user credentials are audited as well
+		unscoped := unscopedKey(key)
+		if _, ext, ok := parseDownloadKey(unscoped); ok && ext != ".info" && v.status == http.StatusOK && !v.expired() {
+			entries = append(entries, entry{unscoped, v.value, unscoped != key})
+		}
+	}
+	a.cache.mu.RUnlock()
+	for _, e := range entries {
+		a.check(e.key, e.value, e.scoped)
+	}
+}
+
+// check compares the hash of a cached file with the proxies, unless it is
+// private, and the checksum database
+func (a *auditor) check(key string, cached []byte, scoped bool) {
+	m, ext, _ := parseDownloadKey(key)
+	hash, err := hashDownload(ext, cached)
+	if err != nil {
+		a.alert(m, key, fmt.Sprintf("cached file can't be hashed: %v", err))
+		return
+	}
+	a.mu.Lock()
+	_, quarantined := a.quarantine[m.String()]
+	done := a.checked[key] == hash
+	a.mu.Unlock()
+	if quarantined || done {
+		return
+	}
+
+	hashes := map[string]string{"cache": hash}
+	sources := a.sources
+	if scoped || (a.noSumDB != "" && module.MatchPrefixPatterns(a.noSumDB, m.Path)) {
+		sources = nil
+	}
+	for name, src := range sources {
+		b, status, err := src.Get(key)
+		if err != nil || status != http.StatusOK {
+			// proxies don't need to have every module
+			continue
+		}
+		if hashes[name], err = hashDownload(ext, b); err != nil {
+			hashes[name] = err.Error()
+		}
+	}
+	if a.client != nil {
+		version := m.Version
+		if ext == ".mod" {
+			version += "/go.mod"
+		}
+		lines, err := a.client.Lookup(m.Path, version)
+		switch {
+		case errors.Is(err, sumdb.ErrSecurity):
+			a.alert(m, key, err.Error())
+			return
+		case err == nil:
+			for _, line := range lines {
+				if strings.HasPrefix(line, m.Path+" "+version+" ") {
+					hashes[a.dbName] = line[strings.LastIndex(line, " ")+1:]
+				}
+			}
+		case !errors.Is(err, sumdb.ErrGONOSUMDB):
+			log.Printf("audit: sumdb lookup failed: %s %v", key, err)
+		}
+	}
+
+	for source, h := range hashes {
+		if h != hash {
+			names := make([]string, 0, len(hashes))
+			for name := range hashes {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			parts := make([]string, len(names))
+			for i, name := range names {
+				parts[i] = fmt.Sprintf("%s=%s", name, hashes[name])
+			}
+			a.alert(m, key, fmt.Sprintf("hash from %s differs: %s", source, strings.Join(parts, " ")))
+			return
+		}
+	}
+	a.mu.Lock()
+	a.checked[key] = hash
+	a.mu.Unlock()
+}
+
+// alert quarantines a version and removes its files from the cache
+func (a *auditor) alert(m module.Version, key, reason string) {
+	log.Printf("audit: ALERT quarantining %s: %s: %s", m, key, reason)
+	a.mu.Lock()
+	a.alerts++
+	a.quarantine[m.String()] = fmt.Sprintf("%s: %s", key, reason)
+	if err := a.save(); err != nil {
+		log.Printf("audit: %v", err)
+	}
+	a.mu.Unlock()
+	escPath, _ := module.EscapePath(m.Path)
+	escVersion, _ := module.EscapeVersion(m.Version)
+	for _, ext := range []string{".info", ".mod", ".zip", ".license"} {
+		a.cache.invalidate(fmt.Sprintf("/%s/@v/%s%s", escPath, escVersion, ext))
+	}
+}
+
+// release removes a version from quarantine
+func (a *auditor) release(mod string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.quarantine[mod]; !ok {
+		return false
+	}
+	delete(a.quarantine, mod)
+	if err := a.save(); err != nil {
+		log.Printf("audit: %v", err)
+	}
+	log.Printf("audit: released %s from quarantine", mod)
+	return true
+}
+
+// Metrics implements upstream.MetricsUpstream
+func (a *auditor) Metrics() []upstream.Metric {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return []upstream.Metric{
+		{Name: "modpox_audit_alerts_total", Help: "Inconsistent hashes found by the auditor.", Value: float64(a.alerts)},
+		{Name: "modpox_audit_quarantined", Help: "Module versions in quarantine.", Value: float64(len(a.quarantine))},
+	}
+}
+
+// newQuarantineHandler lists quarantined versions at /admin/quarantine and
+// releases them with DELETE /admin/quarantine/<module>@<version>
+func newQuarantineHandler(srv *Server) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if srv.auditor == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		mod := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/quarantine"), "/")
+		switch {
+		case r.Method == http.MethodGet && mod == "":
+			srv.auditor.mu.Lock()
+			quarantine := make(map[string]string, len(srv.auditor.quarantine))
+			for k, v := range srv.auditor.quarantine {
+				quarantine[k] = v
+			}
+			srv.auditor.mu.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(quarantine); err != nil {
+				log.Printf("json encode error: %v", err)
+			}
+		case r.Method == http.MethodDelete && mod != "":
+			if !srv.auditor.release(mod) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
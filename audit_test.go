@@ -0,0 +1,126 @@
+package modpox
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/wozz/modpox/upstream"
+)
+
+func TestAuditor(t *testing.T) {
+	modA := []byte("module example.com/a\n")
+	modB := []byte("module example.com/b\n")
+	zipA := testZip(t, "example.com/a@v1.0.0/", map[string]string{"go.mod": string(modA)})
+	zipB := testZip(t, "example.com/b@v1.0.0/", map[string]string{"go.mod": string(modB)})
+	tampered := testZip(t, "example.com/b@v1.0.0/", map[string]string{"go.mod": string(modB), "evil.go": "package b\n"})
+	db := testSumDB(t, "sum.example.com",
+		map[string][]byte{"example.com/a@v1.0.0": modA, "example.com/b@v1.0.0": modB},
+		map[string][]byte{"example.com/a@v1.0.0": zipA, "example.com/b@v1.0.0": zipB},
+	)
+	proxyA := mapUpstream{
+		"/example.com/a/@v/v1.0.0.mod": modA,
+		"/example.com/a/@v/v1.0.0.zip": zipA,
+		"/example.com/b/@v/v1.0.0.zip": zipB,
+	}
+	// the second proxy only has a, with different content
+	proxyB := mapUpstream{
+		"/example.com/a/@v/v1.0.0.zip": testZip(t, "example.com/a@v1.0.0/", map[string]string{"go.mod": string(modA), "a.go": "package a\n"}),
+	}
+	c := &cache{c: make(map[string]*value)}
+	a := newAuditor(c, map[string]upstream.Upstream{"proxy-a": proxyA, "proxy-b": proxyB}, db, nil,
+		newSumDBUpstream([]*SumDB{db}, proxyA))
+	dir := t.TempDir()
+	if err := a.load(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// a is served consistently by proxy-a and the sumdb but not by proxy-b,
+	// b's cached zip only disagrees with the sumdb
+	c.set("/example.com/a/@v/v1.0.0.mod", modA, http.StatusOK)
+	c.set("/example.com/a/@v/v1.0.0.zip", zipA, http.StatusOK)
+	c.set("/example.com/b/@v/v1.0.0.zip", tampered, http.StatusOK)
+	a.audit()
+
+	for _, mod := range []string{"example.com/a@v1.0.0", "example.com/b@v1.0.0"} {
+		if _, ok := a.quarantine[mod]; !ok {
+			t.Errorf("%s not quarantined: %v", mod, a.quarantine)
+		}
+	}
+	if !strings.Contains(a.quarantine["example.com/a@v1.0.0"], "proxy-b=") || !strings.Contains(a.quarantine["example.com/b@v1.0.0"], "sum.example.com=") {
+		t.Errorf("unexpected reasons: %v", a.quarantine)
+	}
+	if b, _ := c.get("/example.com/a/@v/v1.0.0.zip"); b != nil {
+		t.Errorf("quarantined version still cached")
+	}
+	b, status, err := a.Get("/example.com/a/@v/v1.0.0.info")
+	if err != nil || status != http.StatusForbidden || !strings.Contains(string(b), "quarantined") {
+		t.Errorf("quarantined version served: %d %q %v", status, b, err)
+	}
+
+	if !a.release("example.com/b@v1.0.0") || a.release("example.com/b@v1.0.0") {
+		t.Errorf("release failed")
+	}
+	// the quarantine is restored from disk
+	restored := newAuditor(c, nil, nil, nil, proxyA)
+	if err := restored.load(dir); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"example.com/a@v1.0.0": a.quarantine["example.com/a@v1.0.0"]}; !reflect.DeepEqual(restored.quarantine, want) {
+		t.Errorf("quarantine not restored: %v", restored.quarantine)
+	}
+	if _, status, _ := a.Get("/example.com/b/@v/v1.0.0.zip"); status != http.StatusOK {
+		t.Errorf("released version not served: %d", status)
+	}
+	c.set("/example.com/b/@v/v1.0.0.zip", zipB, http.StatusOK)
+	a.audit()
+	if _, ok := a.quarantine["example.com/b@v1.0.0"]; ok || a.checked["/example.com/b/@v/v1.0.0.zip"] == "" {
+		t.Errorf("consistent version not marked checked: %v", a.quarantine)
+	}
+	if a.alerts != 2 {
+		t.Errorf("unexpected alert count %d", a.alerts)
+	}
+}
+
+func TestAuditorPrivate(t *testing.T) {
+	proxy := &countingUpstream{upstream: mapUpstream{}, requests: make(map[string]int)}
+	c := &cache{c: make(map[string]*value)}
+	a := newAuditor(c, map[string]upstream.Upstream{"proxy": proxy}, nil, []string{"example.com/private"}, mapUpstream{})
+
+	// private modules and files fetched with end user credentials are not
+	// requested from public proxies
+	c.set("/example.com/private/a/@v/v1.0.0.mod", []byte("module example.com/private/a\n"), http.StatusOK)
+	c.set("scope:/example.com/team/b/@v/v1.0.0.mod", []byte("module example.com/team/b\n"), http.StatusOK)
+	c.set("/example.com/public/@v/v1.0.0.mod", []byte("module example.com/public\n"), http.StatusOK)
+	a.audit()
+
+	if want := map[string]int{"/example.com/public/@v/v1.0.0.mod": 1}; !reflect.DeepEqual(proxy.requests, want) {
+		t.Errorf("got requests %v, want %v", proxy.requests, want)
+	}
+	if len(a.quarantine) != 0 || len(a.checked) != 3 {
+		t.Errorf("unexpected audit result: %v %v", a.quarantine, a.checked)
+	}
+}
+
+func TestQuarantineHandler(t *testing.T) {
+	a := newAuditor(&cache{c: make(map[string]*value)}, nil, nil, nil, mapUpstream{})
+	a.quarantine["example.com/a@v1.0.0"] = "mismatch"
+	srv := &Server{adminToken: "secret", auditor: a}
+	h := requireAdmin(srv, newQuarantineHandler(srv))
+
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		if w := adminRequest(h, method, "/admin/quarantine/example.com/a@v1.0.0", ""); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected unauthenticated request to be refused, got %d", method, w.Code)
+		}
+	}
+	if _, ok := a.quarantine["example.com/a@v1.0.0"]; !ok {
+		t.Fatalf("version released without authentication")
+	}
+	if w := adminRequest(h, http.MethodGet, "/admin/quarantine", "secret"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "mismatch") {
+		t.Errorf("unexpected quarantine list: %d %s", w.Code, w.Body)
+	}
+	if w := adminRequest(h, http.MethodDelete, "/admin/quarantine/example.com/a@v1.0.0", "secret"); w.Code != http.StatusNoContent {
+		t.Errorf("release failed: %d", w.Code)
+	}
+}
@@ -1,18 +1,27 @@
 package modpox
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/wozz/modpox/upstream"
 )
 
-// Backend is an upstream that can also store data as an intermediate cache
+// Backend is an upstream that can also store data as an intermediate cache.
+// Get returns an error for keys that are not stored, List returns the
+// stored keys starting with a prefix.
 type Backend interface {
 	upstream.Upstream
 
 	Put(string, []byte, int) error
+	Delete(string) error
+	List(string) ([]string, error)
 }
 
 type noopBackend struct {
@@ -27,6 +36,14 @@ func (nb *noopBackend) Put(key string, val []byte, status int) error {
 	return nil
 }
 
+func (nb *noopBackend) Delete(key string) error {
+	return nil
+}
+
+func (nb *noopBackend) List(prefix string) ([]string, error) {
+	return nil, nil
+}
+
 type backendCacheUpstream struct {
 	upstream upstream.Upstream
 	backend  Backend
@@ -62,3 +79,113 @@ func (bcu *backendCacheUpstream) Put(key string, val []byte, status int) error {
 	}
 	return nil
 }
+
+func (bcu *backendCacheUpstream) Delete(key string) error {
+	bcu.cache.invalidate(key)
+	return bcu.backend.Delete(key)
+}
+
+func (bcu *backendCacheUpstream) List(prefix string) ([]string, error) {
+	return bcu.backend.List(prefix)
+}
+
+// dirBackend stores responses as files in a directory
+type dirBackend struct {
+	dir string
+}
+
+// NewDirBackend creates a Backend storing responses as files in dir. Only
+// responses with status OK are stored.
+func NewDirBackend(dir string) Backend {
+	return &dirBackend{dir: dir}
+}
+
+// path returns the file key is stored in
+func (db *dirBackend) path(key string) (string, error) {
+	for _, elem := range strings.Split(key, "/") {
+		if elem == "." || elem == ".." {
+			return "", fmt.Errorf("invalid backend key: %s", key)
+		}
+	}
+	return filepath.Join(db.dir, filepath.FromSlash(key)), nil
+}
+
+func (db *dirBackend) Get(key string) ([]byte, int, error) {
+	file, err := db.path(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, 0, err
+	}
+	return b, http.StatusOK, nil
+}
+
+func (db *dirBackend) Put(key string, val []byte, status int) error {
+	if status != http.StatusOK {
+		return fmt.Errorf("not storing status %d: %s", status, key)
+	}
+	file, err := db.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return err
+	}
+	// readers never see partially written files
+	f, err := os.CreateTemp(filepath.Dir(file), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(val)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), file)
+}
+
+func (db *dirBackend) Delete(key string) error {
+	file, err := db.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(file); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (db *dirBackend) List(prefix string) ([]string, error) {
+	if _, err := db.path(prefix); err != nil {
+		return nil, err
+	}
+	// only the directory the prefix is in needs to be walked
+	root := filepath.Join(db.dir, filepath.FromSlash(prefix[:strings.LastIndex(prefix, "/")+1]))
+	var keys []string
+	err := filepath.WalkDir(root, func(file string, d fs.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) && file == root {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		// files being written by Put are not stored yet
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".tmp-") {
+			return nil
+		}
+		rel, err := filepath.Rel(db.dir, file)
+		if err != nil {
+			return err
+		}
+		if key := "/" + filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys, err
+}
@@ -0,0 +1,45 @@
+package modpox
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestDirBackend(t *testing.T) {
+	b := NewDirBackend(t.TempDir())
+	key := "/sumdb/sum.golang.org/lookup/example.com/a@v1.0.0"
+	if _, _, err := b.Get(key); err == nil {
+		t.Errorf("expected error for missing key")
+	}
+	if err := b.Put(key, []byte("record"), http.StatusOK); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if val, status, err := b.Get(key); err != nil || status != http.StatusOK || string(val) != "record" {
+		t.Errorf("unexpected value: %q %d %v", val, status, err)
+	}
+	if err := b.Put("/sumdb/sum.golang.org/latest", nil, http.StatusNotFound); err == nil {
+		t.Errorf("expected error storing error response")
+	}
+	if err := b.Put("/sumdb/../../escape", []byte("x"), http.StatusOK); err == nil {
+		t.Errorf("expected error for key outside of the directory")
+	}
+	if err := b.Put("/example.com/a/@v/v1.0.0.license", []byte("[]"), http.StatusOK); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if keys, err := b.List("/sumdb/"); err != nil || !reflect.DeepEqual(keys, []string{key}) {
+		t.Errorf("unexpected keys: %q %v", keys, err)
+	}
+	if keys, err := b.List("/example.com/b"); err != nil || len(keys) != 0 {
+		t.Errorf("unexpected keys for missing prefix: %q %v", keys, err)
+	}
+	if err := b.Delete(key); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, _, err := b.Get(key); err == nil {
+		t.Errorf("expected error for deleted key")
+	}
+	if err := b.Delete(key); err != nil {
+		t.Errorf("deleting a missing key: %v", err)
+	}
+}
@@ -0,0 +1,297 @@
+// Package bitbucket implements an upstream for private repositories on
+// Bitbucket Server and Data Center using the 1.0 REST api
+package bitbucket
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/wozz/modpox/forge"
+	"github.com/wozz/modpox/upstream"
+	"golang.org/x/mod/module"
+)
+
+// perPage is the page size for list requests
+const perPage = 100
+
+// Config is used to configure the bitbucket upstream
+type Config struct {
+	Upstream upstream.Upstream
+	// Host is the host of the Bitbucket Server instance
+	Host string
+	// Token is an HTTP access token or personal access token with
+	// repository read permission
+	Token string
+	// Transport is used for api requests, defaults to http.DefaultTransport
+	Transport http.RoundTripper
+	// ModulePrefix is the module path prefix served from this instance,
+	// defaults to Host. Modules are served as <prefix>/<project key>/<repo>.
+	ModulePrefix string
+}
+
+type privateBitbucketUpstream struct {
+	host     string
+	prefix   string
+	token    string
+	client   *http.Client
+	upstream upstream.Upstream
+}
+
+// NewBitbucketUpstream creates a new upstream for a private Bitbucket Server
+// instance
+func NewBitbucketUpstream(config *Config) upstream.Upstream {
+	prefix := config.ModulePrefix
+	if prefix == "" {
+		prefix = config.Host
+	}
+	return &privateBitbucketUpstream{
+		host:   config.Host,
+		prefix: prefix,
+		token:  config.Token,
+		client: &http.Client{
+			Timeout: time.Minute,
+			Transport: &forge.Transport{
+				Hosts: map[string]bool{config.Host: true},
+				Base:  config.Transport,
+			},
+		},
+		upstream: config.Upstream,
+	}
+}
+
+func (p *privateBitbucketUpstream) Get(key string) ([]byte, int, error) {
+	if strings.HasPrefix(key, fmt.Sprintf("/%s/", p.prefix)) {
+		log.Printf("query private bitbucket for %s", key)
+		b, status, err := p.handle(key)
+		var apiErr *forge.APIError
+		if errors.As(err, &apiErr) {
+			log.Printf("bitbucket api error: %s %v", key, err)
+			return apiErr.ClientError()
+		}
+		return b, status, err
+	}
+	return p.upstream.Get(key)
+}
+
+func (p *privateBitbucketUpstream) handle(key string) ([]byte, int, error) {
+	modPath, err := forge.ParseModulePath(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	repo, err := p.repo(modPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	return forge.Serve(repo, key)
+}
+
+// Status implements upstream.StatusUpstream
+func (p *privateBitbucketUpstream) Status(modulePath string) (*upstream.ModuleStatus, error) {
+	if !strings.HasPrefix(modulePath, p.prefix+"/") {
+		return nil, nil
+	}
+	repo, err := p.repo(modulePath)
+	if err != nil {
+		return nil, err
+	}
+	return forge.Status(repo, modulePath)
+}
+
+// repo returns the repository serving modPath. Modules are served from the
+// root of a project/repo repository, optionally with a major version suffix.
+func (p *privateBitbucketUpstream) repo(modPath string) (*bitbucketRepo, error) {
+	pathPrefix, _, ok := module.SplitPathVersion(modPath)
+	if !ok || !strings.HasPrefix(pathPrefix, p.prefix+"/") {
+		return nil, &forge.APIError{Forge: "bitbucket", Status: http.StatusNotFound, Message: fmt.Sprintf("path not served by this upstream: %s", modPath)}
+	}
+	parts := strings.Split(strings.TrimPrefix(pathPrefix, p.prefix+"/"), "/")
+	if len(parts) != 2 {
+		return nil, &forge.APIError{Forge: "bitbucket", Status: http.StatusNotFound, Message: fmt.Sprintf("no bitbucket repository found for %s", modPath)}
+	}
+	return &bitbucketRepo{p: p, project: parts[0], slug: parts[1]}, nil
+}
+
+type commitInfo struct {
+	Id string `json:"id"`
+	// CommitterTimestamp is in milliseconds since the epoch
+	CommitterTimestamp int64 `json:"committerTimestamp"`
+}
+
+func (c commitInfo) commit() forge.Commit {
+	return forge.Commit{Id: c.Id, Time: time.UnixMilli(c.CommitterTimestamp).UTC()}
+}
+
+// page is a page of a paged api response
+type page struct {
+	Values        json.RawMessage `json:"values"`
+	IsLastPage    bool            `json:"isLastPage"`
+	NextPageStart int             `json:"nextPageStart"`
+}
+
+// bitbucketRepo implements forge.Repo with the bitbucket repository api
+type bitbucketRepo struct {
+	p       *privateBitbucketUpstream
+	project string
+	slug    string
+}
+
+func (r *bitbucketRepo) apiReq(format string, args ...interface{}) ([]byte, error) {
+	return r.p.apiReq(fmt.Sprintf("projects/%s/repos/%s/", url.PathEscape(r.project), url.PathEscape(r.slug)) + fmt.Sprintf(format, args...))
+}
+
+func (r *bitbucketRepo) Tags() ([]forge.Tag, error) {
+	var tags []forge.Tag
+	for start := 0; ; {
+		tagData, err := r.apiReq("tags?start=%d&limit=%d", start, perPage)
+		if err != nil {
+			return nil, fmt.Errorf("%w: could not make api req", err)
+		}
+		var pg page
+		if err := json.Unmarshal(tagData, &pg); err != nil {
+			return nil, fmt.Errorf("%w: could not parse json response", err)
+		}
+		tList := []struct {
+			DisplayId    string `json:"displayId"`
+			LatestCommit string `json:"latestCommit"`
+		}{}
+		if err := json.Unmarshal(pg.Values, &tList); err != nil {
+			return nil, fmt.Errorf("%w: could not parse json response", err)
+		}
+		for _, t := range tList {
+			tags = append(tags, forge.Tag{Name: t.DisplayId, Commit: forge.Commit{Id: t.LatestCommit}})
+		}
+		if pg.IsLastPage || pg.NextPageStart <= start {
+			return tags, nil
+		}
+		start = pg.NextPageStart
+	}
+}
+
+// commits lists commits reachable from until but not from since
+func (r *bitbucketRepo) commits(since, until string, limit int) ([]commitInfo, error) {
+	queryParams := &url.Values{
+		"limit": []string{fmt.Sprint(limit)},
+	}
+	if since != "" {
+		queryParams.Set("since", since)
+	}
+	if until != "" {
+		queryParams.Set("until", until)
+	}
+	commitData, err := r.apiReq("commits?%s", queryParams.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not make api req", err)
+	}
+	var pg page
+	if err := json.Unmarshal(commitData, &pg); err != nil {
+		return nil, fmt.Errorf("%w: could not parse json response", err)
+	}
+	var cList []commitInfo
+	if err := json.Unmarshal(pg.Values, &cList); err != nil {
+		return nil, fmt.Errorf("%w: could not parse json response", err)
+	}
+	return cList, nil
+}
+
+func (r *bitbucketRepo) Head() (forge.Commit, error) {
+	cList, err := r.commits("", "", 1)
+	if err != nil {
+		return forge.Commit{}, err
+	}
+	if len(cList) == 0 {
+		return forge.Commit{}, fmt.Errorf("%w: no commits", forge.ErrNotFound)
+	}
+	return cList[0].commit(), nil
+}
+
+func (r *bitbucketRepo) Commit(ref string) (forge.Commit, error) {
+	commitData, err := r.apiReq("commits/%s", url.PathEscape(ref))
+	if err != nil {
+		return forge.Commit{}, fmt.Errorf("%w: could not make api request for commits", err)
+	}
+	var c commitInfo
+	if err := json.Unmarshal(commitData, &c); err != nil {
+		return forge.Commit{}, fmt.Errorf("%w: could not parse json response", err)
+	}
+	return c.commit(), nil
+}
+
+// IsAncestor lists commits in reverse: ancestor is reachable from commit if
+// it has no commits that commit doesn't also have
+func (r *bitbucketRepo) IsAncestor(ancestor, commit string) (bool, error) {
+	cList, err := r.commits(commit, ancestor, 1)
+	if err != nil {
+		return false, err
+	}
+	return len(cList) == 0, nil
+}
+
+func (r *bitbucketRepo) File(ref, filename string) ([]byte, error) {
+	parts := strings.Split(filename, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	queryParams := &url.Values{
+		"at": []string{ref},
+	}
+	content, err := r.apiReq("raw/%s?%s", strings.Join(parts, "/"), queryParams.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not make api req for raw file", err)
+	}
+	return content, nil
+}
+
+func (r *bitbucketRepo) Archive(ref string) ([]byte, error) {
+	queryParams := &url.Values{
+		"at":     []string{ref},
+		"format": []string{"zip"},
+		// bitbucket archives have no top level directory by default
+		"prefix": []string{r.slug + "/"},
+	}
+	rawZip, err := r.apiReq("archive?%s", queryParams.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not make api req", err)
+	}
+	return rawZip, nil
+}
+
+func (p *privateBitbucketUpstream) apiReq(path string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("https://%s/rest/api/1.0/%s", p.host, path), nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not make request", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not perform request", err)
+	}
+	defer resp.Body.Close()
+	var b bytes.Buffer
+	if _, err := io.Copy(&b, resp.Body); err != nil {
+		return nil, fmt.Errorf("%w: could not copy response", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg := struct {
+			Errors []struct {
+				Message string `json:"message"`
+			} `json:"errors"`
+		}{}
+		message := b.String()
+		if json.Unmarshal(b.Bytes(), &msg) == nil && len(msg.Errors) > 0 {
+			message = msg.Errors[0].Message
+		}
+		return nil, &forge.APIError{Forge: "bitbucket", Status: resp.StatusCode, Message: message}
+	}
+	return b.Bytes(), nil
+}
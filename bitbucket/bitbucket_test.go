@@ -0,0 +1,49 @@
+package bitbucket
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/wozz/modpox/bitbucket/bitbuckettest"
+	"github.com/wozz/modpox/forge/forgetest"
+)
+
+func TestBitbucketUpstream(t *testing.T) {
+	fake := bitbuckettest.NewServer()
+	defer fake.Close()
+	fake.Token = "token"
+	// force pagination of tag lists
+	fake.MaxPerPage = 1
+
+	repo := forgetest.NewRepo(t)
+	repo.Commit(map[string]string{"go.mod": "module bitbucket.example.com/proj/project\n"})
+	repo.Tag("v1.0.0")
+	repo.Commit(map[string]string{"a.go": "package project\n"})
+	repo.Tag("v1.1.0")
+	fake.AddRepo("proj", "project", repo.Dir)
+
+	p := NewBitbucketUpstream(&Config{
+		Host:         fake.Host(),
+		ModulePrefix: "bitbucket.example.com",
+		Token:        "token",
+		Transport:    fake.Client().Transport,
+	})
+	const mod = "/bitbucket.example.com/proj/project"
+
+	t.Run("api paths", func(t *testing.T) {
+		forgetest.Check(t, p, []forgetest.Request{
+			{Key: mod + "/@v/list", Status: http.StatusOK, Body: "v1.0.0\nv1.1.0\n"},
+			{Key: mod + "/@v/v1.0.0.mod", Status: http.StatusOK, Body: "module bitbucket.example.com/proj/project\n"},
+			{Key: mod + "/@v/v1.1.0.zip", Status: http.StatusOK},
+			{Key: "/bitbucket.example.com/proj/missing/@v/list", Status: http.StatusNotFound},
+			{Key: "/bitbucket.example.com/proj/@v/list", Status: http.StatusNotFound},
+		})
+	})
+	t.Run("error mapping", func(t *testing.T) {
+		fake.Token = "rotated"
+		defer func() { fake.Token = "token" }()
+		forgetest.Check(t, p, []forgetest.Request{
+			{Key: mod + "/@v/v1.0.0.info", Status: http.StatusBadGateway},
+		})
+	})
+}
@@ -0,0 +1,203 @@
+// Package bitbuckettest provides an in-memory fake of the Bitbucket Server
+// 1.0 REST api backed by local git repositories, for testing the bitbucket
+// upstream without a real Bitbucket Server instance.
+package bitbuckettest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/wozz/modpox/forge/forgetest"
+)
+
+// Server is a fake Bitbucket Server api. Repositories are served from local
+// git repositories added with AddRepo.
+type Server struct {
+	*httptest.Server
+
+	// Token is the bearer token required for api requests, if set
+	Token string
+	// MaxPerPage caps the page size of paged responses, defaults to 100
+	MaxPerPage int
+
+	mu    sync.Mutex
+	repos map[string]string
+}
+
+// NewServer starts a fake bitbucket api over TLS. Use Client().Transport to
+// make requests that trust its certificate.
+func NewServer() *Server {
+	s := &Server{repos: make(map[string]string)}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Host returns the host:port of the server
+func (s *Server) Host() string {
+	u, _ := url.Parse(s.URL)
+	return u.Host
+}
+
+// AddRepo serves the git repository in dir as the repository slug in the
+// project with the given key
+func (s *Server) AddRepo(projectKey, slug, dir string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.repos[projectKey+"/"+slug] = dir
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]interface{}{
+		"errors": []map[string]string{{"message": message}},
+	})
+}
+
+type commitJSON struct {
+	Id                 string `json:"id"`
+	DisplayId          string `json:"displayId"`
+	CommitterTimestamp int64  `json:"committerTimestamp"`
+}
+
+func toJSON(c forgetest.Commit) commitJSON {
+	return commitJSON{Id: c.Sha, DisplayId: c.Sha[:11], CommitterTimestamp: c.Time.UnixNano() / 1e6}
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	if s.Token != "" && r.Header.Get("Authorization") != "Bearer "+s.Token {
+		writeError(w, http.StatusUnauthorized, "Authentication failed. Please check your credentials and try again.")
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/rest/api/1.0/"), "/")
+	if len(parts) < 5 || parts[0] != "projects" || parts[2] != "repos" {
+		writeError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	project, _ := url.PathUnescape(parts[1])
+	slug, _ := url.PathUnescape(parts[3])
+	s.mu.Lock()
+	dir, ok := s.repos[project+"/"+slug]
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "Repository "+project+"/"+slug+" does not exist.")
+		return
+	}
+	rest := make([]string, 0, len(parts)-5)
+	for _, part := range parts[5:] {
+		unescaped, _ := url.PathUnescape(part)
+		rest = append(rest, unescaped)
+	}
+	query := r.URL.Query()
+	switch parts[4] {
+	case "tags":
+		type tagJSON struct {
+			Id           string `json:"id"`
+			DisplayId    string `json:"displayId"`
+			LatestCommit string `json:"latestCommit"`
+		}
+		var tags []interface{}
+		for _, name := range forgetest.Tags(dir) {
+			if c, ok := forgetest.Resolve(dir, "refs/tags/"+name); ok {
+				tags = append(tags, tagJSON{Id: "refs/tags/" + name, DisplayId: name, LatestCommit: c.Sha})
+			}
+		}
+		s.page(w, r, tags)
+	case "commits":
+		if len(rest) > 0 {
+			c, ok := forgetest.Resolve(dir, strings.Join(rest, "/"))
+			if !ok {
+				writeError(w, http.StatusNotFound, "Commit '"+strings.Join(rest, "/")+"' does not exist in repository '"+slug+"'.")
+				return
+			}
+			writeJSON(w, http.StatusOK, toJSON(c))
+			return
+		}
+		until := query.Get("until")
+		if until == "" {
+			until = "HEAD"
+		}
+		var commits []interface{}
+		if _, ok := forgetest.Resolve(dir, until); ok {
+			for _, c := range forgetest.RevList(dir, query.Get("since"), until) {
+				commits = append(commits, toJSON(c))
+			}
+		}
+		s.page(w, r, commits)
+	case "raw":
+		ref := query.Get("at")
+		if ref == "" {
+			ref = "HEAD"
+		}
+		c, ok := forgetest.Resolve(dir, ref)
+		if !ok {
+			writeError(w, http.StatusNotFound, "Commit '"+ref+"' does not exist")
+			return
+		}
+		content, ok := forgetest.Show(dir, c.Sha, strings.Join(rest, "/"))
+		if !ok {
+			writeError(w, http.StatusNotFound, "The path \""+strings.Join(rest, "/")+"\" does not exist at revision \""+ref+"\"")
+			return
+		}
+		w.Write(content)
+	case "archive":
+		ref := query.Get("at")
+		if ref == "" {
+			ref = "HEAD"
+		}
+		c, ok := forgetest.Resolve(dir, ref)
+		if !ok || query.Get("format") != "zip" {
+			writeError(w, http.StatusNotFound, "Commit '"+ref+"' does not exist")
+			return
+		}
+		out, err := forgetest.Archive(dir, c.Sha, query.Get("prefix"))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/zip")
+		w.Write(out)
+	default:
+		writeError(w, http.StatusNotFound, "Not Found")
+	}
+}
+
+// page writes a paged response using the start and limit query parameters
+func (s *Server) page(w http.ResponseWriter, r *http.Request, values []interface{}) {
+	start, _ := strconv.Atoi(r.URL.Query().Get("start"))
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit <= 0 || limit > 100 {
+		limit = 100
+	}
+	if s.MaxPerPage > 0 && limit > s.MaxPerPage {
+		limit = s.MaxPerPage
+	}
+	if start > len(values) {
+		start = len(values)
+	}
+	end := start + limit
+	isLastPage := end >= len(values)
+	if isLastPage {
+		end = len(values)
+	}
+	resp := map[string]interface{}{
+		"values":     append([]interface{}{}, values[start:end]...),
+		"start":      start,
+		"size":       end - start,
+		"limit":      limit,
+		"isLastPage": isLastPage,
+	}
+	if !isLastPage {
+		resp["nextPageStart"] = end
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -2,14 +2,22 @@ package modpox
 
 import (
 	"fmt"
+	"net/http"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/wozz/modpox/upstream"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
 )
 
-const defaultTTL = time.Hour * 24
+const (
+	defaultTTL = time.Hour * 24
+	// queryTTL is the ttl of .info responses for branch, tag prefix and
+	// commit queries, which resolve to a new version when the ref moves
+	queryTTL = time.Minute * 5
+)
 
 type value struct {
 	expireTime time.Time
@@ -40,13 +48,26 @@ func newCache() *cache {
 
 func (c *cache) set(key string, val []byte, status int) {
 	ttl := defaultTTL
-	if strings.HasSuffix(key, "/@latest") ||
+	if strings.HasPrefix(key, "/sumdb/") {
+		ttl = sumDBTTL(key, status)
+	} else if strings.HasSuffix(key, "/@latest") ||
 		strings.HasSuffix(key, "/@v/list") {
 		ttl = time.Hour
+	} else if isVersionQuery(key) {
+		ttl = queryTTL
 	}
 	c.setWithTTL(key, val, status, ttl)
 }
 
+// isVersionQuery reports whether key is the .info of a version query
+// rather than of a canonical version. Keys cached with end user credentials
+// are prefixed with their scope.
+func isVersionQuery(key string) bool {
+	m, ext, ok := parseDownloadKey(unscopedKey(key))
+	return ok && ext == ".info" &&
+		(!semver.IsValid(m.Version) || module.CanonicalVersion(m.Version) != m.Version)
+}
+
 func (c *cache) setWithTTL(key string, val []byte, status int, ttl time.Duration) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -57,6 +78,10 @@ func (c *cache) setWithTTL(key string, val []byte, status int, ttl time.Duration
 	}
 }
 
+func (v *value) expired() bool {
+	return time.Now().After(v.expireTime)
+}
+
 func (c *cache) get(key string) ([]byte, int) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
@@ -64,18 +89,43 @@ func (c *cache) get(key string) ([]byte, int) {
 	if !ok {
 		return nil, 0
 	}
-	if time.Now().After(val.expireTime) {
+	if val.expired() {
 		return nil, 0
 	}
 	return val.value, val.status
 }
 
+// invalidate removes key from the cache, including copies cached for
+// requests made with end user credentials
+func (c *cache) invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k := range c.c {
+		if k == key || strings.HasSuffix(k, ":"+key) {
+			delete(c.c, k)
+		}
+	}
+}
+
+// invalidateQueries removes the cached .info of version queries of the
+// module with the escaped path, whose refs may have moved
+func (c *cache) invalidateQueries(escPath string) {
+	prefix := "/" + escPath + "/@v/"
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k := range c.c {
+		if strings.HasPrefix(unscopedKey(k), prefix) && isVersionQuery(k) {
+			delete(c.c, k)
+		}
+	}
+}
+
 func (c *cache) clean() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	keyToDel := []string{}
 	for k, v := range c.c {
-		if time.Now().After(v.expireTime) {
+		if v.expired() {
 			keyToDel = append(keyToDel, k)
 		}
 	}
@@ -87,12 +137,21 @@ func (c *cache) clean() {
 type cachingUpstream struct {
 	cache    *cache
 	upstream upstream.Upstream
+	// skip optionally excludes keys from the cache, like downloads that
+	// are cached further up the chain once they are verified
+	skip func(string) bool
 }
 
 func (cu *cachingUpstream) Get(key string) ([]byte, int, error) {
+	if cu.skip != nil && cu.skip(key) {
+		return cu.upstream.Get(key)
+	}
 	if b, i := cu.cache.get(key); b != nil && i != 0 {
 		return b, i, nil
 	}
+	if b, ok := partialTile(key, cu.cache.get); ok {
+		return b, http.StatusOK, nil
+	}
 	b, i, err := cu.upstream.Get(key)
 	if err != nil {
 		return nil, 0, fmt.Errorf("%w: cachingUpstream error", err)
@@ -0,0 +1,65 @@
+package modpox
+
+import "testing"
+
+func TestIsVersionQuery(t *testing.T) {
+	tests := map[string]bool{
+		"/example.com/m/@v/v1.2.3.info":                             false,
+		"/example.com/m/@v/v2.0.0+incompatible.info":                false,
+		"/example.com/m/@v/v0.0.0-20200101000000-abcdef123456.info": false,
+		"/example.com/m/@v/main.info":                               true,
+		"/example.com/m/@v/v1.2.info":                               true,
+		"/example.com/m/@v/abcdef1.info":                            true,
+		"0123abcd:/example.com/m/@v/main.info":                      true,
+		"/example.com/m/@v/v1.2.3.mod":                              false,
+		"/example.com/m/@v/list":                                    false,
+	}
+	for key, want := range tests {
+		if got := isVersionQuery(key); got != want {
+			t.Errorf("%s: got %v, want %v", key, got, want)
+		}
+	}
+}
+
+func TestInvalidateQueries(t *testing.T) {
+	c := &cache{c: make(map[string]*value)}
+	keys := []string{
+		"/example.com/m/@v/main.info",
+		"0123abcd:/example.com/m/@v/main.info",
+		"/example.com/m/@v/v1.0.0.info",
+		"/example.com/m/v2/@v/main.info",
+		"/example.com/other/@v/main.info",
+	}
+	for _, key := range keys {
+		c.set(key, []byte("{}"), 200)
+	}
+	c.invalidateQueries("example.com/m")
+	for i, key := range keys {
+		_, status := c.get(key)
+		if want := i >= 2; (status != 0) != want {
+			t.Errorf("%s: cached %v, want %v", key, status != 0, want)
+		}
+	}
+}
+
+func TestCachingUpstreamSkip(t *testing.T) {
+	c := &cache{c: make(map[string]*value)}
+	cu := &cachingUpstream{
+		cache: c,
+		upstream: mapUpstream{
+			"/example.com/m/@v/v1.0.0.info": []byte("{}"),
+			"/example.com/m/@v/v1.0.0.mod":  []byte("module example.com/m\n"),
+			"/example.com/m/@v/v1.0.0.zip":  []byte("zip"),
+		},
+		skip: isDownloadKey,
+	}
+	for _, key := range []string{"/example.com/m/@v/v1.0.0.info", "/example.com/m/@v/v1.0.0.mod", "/example.com/m/@v/v1.0.0.zip"} {
+		if _, status, err := cu.Get(key); err != nil || status != 200 {
+			t.Fatalf("%s: unexpected response: %d %v", key, status, err)
+		}
+		_, status := c.get(key)
+		if want := !isDownloadKey(key); (status != 0) != want {
+			t.Errorf("%s: cached %v, want %v", key, status != 0, want)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+// Command modpox-sumdb-sync downloads the checksum database state needed to
+// verify a set of modules, for serving it offline with SumDB.OfflineDir.
+//
+// Usage:
+//
+//	modpox-sumdb-sync -dir dir [-sumdb sum.golang.org] [-gosum go.sum] [module@version...]
+package main
+
+import (
+	"bufio"
+	"flag"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/wozz/modpox"
+	"golang.org/x/mod/module"
+)
+
+func main() {
+	dir := flag.String("dir", "", "directory the synced state is stored in")
+	gosumdb := flag.String("sumdb", "sum.golang.org", "checksum database in the GOSUMDB form")
+	gosum := flag.String("gosum", "", "comma separated go.sum files listing modules to sync")
+	flag.Parse()
+	if *dir == "" {
+		log.Fatal("-dir is required")
+	}
+	db, err := modpox.ParseSumDB(*gosumdb)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	seen := make(map[module.Version]bool)
+	var mods []module.Version
+	add := func(path, version string) {
+		m := module.Version{Path: path, Version: strings.TrimSuffix(version, "/go.mod")}
+		if err := module.Check(m.Path, m.Version); err != nil {
+			log.Fatal(err)
+		}
+		if !seen[m] {
+			seen[m] = true
+			mods = append(mods, m)
+		}
+	}
+	for _, arg := range flag.Args() {
+		parts := strings.SplitN(arg, "@", 2)
+		if len(parts) != 2 {
+			log.Fatalf("invalid module@version: %s", arg)
+		}
+		add(parts[0], parts[1])
+	}
+	if *gosum != "" {
+		for _, name := range strings.Split(*gosum, ",") {
+			f, err := os.Open(name)
+			if err != nil {
+				log.Fatal(err)
+			}
+			s := bufio.NewScanner(f)
+			for s.Scan() {
+				fields := strings.Fields(s.Text())
+				if len(fields) != 3 {
+					continue
+				}
+				add(fields[0], fields[1])
+			}
+			f.Close()
+			if err := s.Err(); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	if err := modpox.SyncSumDB(db, *dir, mods); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("synced %d modules from %s into %s", len(mods), db.Name, *dir)
+}
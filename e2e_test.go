@@ -0,0 +1,412 @@
+package modpox
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/wozz/modpox/bitbucket"
+	"github.com/wozz/modpox/bitbucket/bitbuckettest"
+	"github.com/wozz/modpox/forge/forgetest"
+	"github.com/wozz/modpox/git"
+	"github.com/wozz/modpox/gitea"
+	"github.com/wozz/modpox/gitea/giteatest"
+	"github.com/wozz/modpox/github"
+	"github.com/wozz/modpox/github/githubtest"
+	"github.com/wozz/modpox/gitlab"
+	"github.com/wozz/modpox/gitlab/gitlabtest"
+	"github.com/wozz/modpox/local"
+	"github.com/wozz/modpox/policy"
+	"golang.org/x/mod/sumdb/note"
+)
+
+// TestGoCommandGitLab runs the go command against a server backed by a fake
+// gitlab instance
+func TestGoCommandGitLab(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping go command test in short mode")
+	}
+	fake := gitlabtest.NewServer()
+	defer fake.Close()
+	fake.Token = "token"
+
+	repo, head := fixtureRepo(t, "gitlab.example.com/group/sub/lib")
+	fake.AddProject("group/sub/lib", repo.Dir)
+
+	s := NewServerWithConfig(&Config{
+		GitLab: []*gitlab.Config{{
+			Host:         fake.Host(),
+			ModulePrefix: "gitlab.example.com",
+			Token:        "token",
+			Transport:    fake.Client().Transport,
+		}},
+	})
+	testGoCommand(t, s, "gitlab.example.com/group/sub/lib", head)
+}
+
+// TestGoCommandGitHub runs the go command against a server backed by a fake
+// github instance
+func TestGoCommandGitHub(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping go command test in short mode")
+	}
+	fake := githubtest.NewServer()
+	defer fake.Close()
+	fake.Token = "token"
+
+	repo, head := fixtureRepo(t, "github.example.com/org/lib")
+	fake.AddRepo("org/lib", repo.Dir)
+
+	s := NewServerWithConfig(&Config{
+		GitHub: []*github.Config{{
+			Host:         fake.Host(),
+			ModulePrefix: "github.example.com",
+			Token:        "token",
+			Transport:    fake.Client().Transport,
+		}},
+	})
+	testGoCommand(t, s, "github.example.com/org/lib", head)
+}
+
+// TestGoCommandGitea runs the go command against a server backed by a fake
+// gitea instance
+func TestGoCommandGitea(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping go command test in short mode")
+	}
+	fake := giteatest.NewServer()
+	defer fake.Close()
+	fake.Token = "token"
+
+	repo, head := fixtureRepo(t, "gitea.example.com/org/lib")
+	fake.AddRepo("org/lib", repo.Dir)
+
+	s := NewServerWithConfig(&Config{
+		Gitea: []*gitea.Config{{
+			Host:         fake.Host(),
+			ModulePrefix: "gitea.example.com",
+			Token:        "token",
+			Transport:    fake.Client().Transport,
+		}},
+	})
+	testGoCommand(t, s, "gitea.example.com/org/lib", head)
+}
+
+// TestGoCommandBitbucket runs the go command against a server backed by a
+// fake Bitbucket Server instance
+func TestGoCommandBitbucket(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping go command test in short mode")
+	}
+	fake := bitbuckettest.NewServer()
+	defer fake.Close()
+	fake.Token = "token"
+
+	repo, head := fixtureRepo(t, "bitbucket.example.com/proj/lib")
+	fake.AddRepo("proj", "lib", repo.Dir)
+
+	s := NewServerWithConfig(&Config{
+		Bitbucket: []*bitbucket.Config{{
+			Host:         fake.Host(),
+			ModulePrefix: "bitbucket.example.com",
+			Token:        "token",
+			Transport:    fake.Client().Transport,
+		}},
+	})
+	testGoCommand(t, s, "bitbucket.example.com/proj/lib", head)
+}
+
+// TestGoCommandGit runs the go command against a server cloning from a
+// local git repository
+func TestGoCommandGit(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping go command test in short mode")
+	}
+	repo, head := fixtureRepo(t, "git.example.com/lib")
+	s := NewServerWithConfig(&Config{
+		Git: []*git.Config{{
+			ModulePrefix: "git.example.com",
+			Remote:       "file://" + filepath.ToSlash(repo.Dir),
+			CacheDir:     t.TempDir(),
+		}},
+	})
+	testGoCommand(t, s, "git.example.com/lib", head)
+}
+
+// TestGoCommandPrivateSumDB verifies modules from the git upstream against
+// the private checksum database served by the proxy
+func TestGoCommandPrivateSumDB(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping go command test in short mode")
+	}
+	skey, vkey, err := note.GenerateKey(rand.Reader, "sum.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo, head := fixtureRepo(t, "git.example.com/lib")
+	s := NewServerWithConfig(&Config{
+		Git: []*git.Config{{
+			ModulePrefix: "git.example.com",
+			Remote:       "file://" + filepath.ToSlash(repo.Dir),
+			CacheDir:     t.TempDir(),
+		}},
+		PrivateSumDB: &PrivateSumDB{
+			SignerKey:      skey,
+			Dir:            t.TempDir(),
+			ModulePrefixes: []string{"git.example.com"},
+		},
+	})
+	testGoCommand(t, s, "git.example.com/lib", head, "GOSUMDB="+vkey)
+	if n := len(s.privateSumDB.records); n != 3 {
+		t.Errorf("expected v1.0.0, the pseudo-version and v1.1.0 to be recorded, got %d records", n)
+	}
+}
+
+// TestGoCommandLocal seeds a module cache from the git upstream and serves
+// it from a second server without access to the repository
+func TestGoCommandLocal(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping go command test in short mode")
+	}
+	repo, head := fixtureRepo(t, "git.example.com/lib")
+	seed := NewServerWithConfig(&Config{
+		Git: []*git.Config{{
+			ModulePrefix: "git.example.com",
+			Remote:       "file://" + filepath.ToSlash(repo.Dir),
+			CacheDir:     t.TempDir(),
+		}},
+	})
+	modCache := testGoCommand(t, seed, "git.example.com/lib", head)
+
+	s := NewServerWithConfig(&Config{
+		Local: []*local.Config{{Dir: modCache}},
+	})
+	proxy := httptest.NewServer(s.srv.Handler)
+	defer proxy.Close()
+	goCmd, _ := goCommand(t, proxy.URL, "git.example.com/lib")
+	if got := goCmd("list", "-m", "-versions", "git.example.com/lib"); got != "git.example.com/lib v1.0.0 v1.1.0" {
+		t.Errorf("unexpected versions: %q", got)
+	}
+	goCmd("get", "git.example.com/lib@v1.0.0")
+	goCmd("build", "./...")
+	goCmd("mod", "verify")
+	goCmd("get", "git.example.com/lib@latest")
+	if got := goCmd("list", "-m", "git.example.com/lib"); got != "git.example.com/lib v1.1.0" {
+		t.Errorf("unexpected latest version: %q", got)
+	}
+}
+
+// fixtureRepo creates a repository for modPath with tags v1.0.0 and v1.1.0
+// and an untagged commit on main, whose hash is returned
+func TestGoCommandPolicy(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping go command test in short mode")
+	}
+	repo, _ := fixtureRepo(t, "git.example.com/lib")
+	s := NewServerWithConfig(&Config{
+		Git: []*git.Config{{
+			ModulePrefix: "git.example.com",
+			Remote:       "file://" + filepath.ToSlash(repo.Dir),
+			CacheDir:     t.TempDir(),
+		}},
+		Policy: &policy.Config{Rules: []*policy.Rule{
+			{Action: policy.Deny, Module: "git.example.com/lib", Version: "< v1.1.0", Reason: "upgrade to v1.1.0"},
+		}},
+	})
+	proxy := httptest.NewServer(s.srv.Handler)
+	defer proxy.Close()
+	goCmd, _ := goCommand(t, proxy.URL, "git.example.com/lib")
+	if got := goCmd("list", "-m", "-versions", "git.example.com/lib"); got != "git.example.com/lib v1.1.0" {
+		t.Errorf("unexpected versions: %q", got)
+	}
+	command, _ := goCommandExec(t, proxy.URL, "git.example.com/lib")
+	out, err := command("get", "git.example.com/lib@v1.0.0").CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "git.example.com/lib@v1.0.0 is blocked by policy: upgrade to v1.1.0") {
+		t.Errorf("denied version not refused with reason: %v\n%s", err, out)
+	}
+	goCmd("get", "git.example.com/lib@latest")
+	goCmd("build", "./...")
+}
+
+func TestGoCommandAllowlist(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping go command test in short mode")
+	}
+	repo, _ := fixtureRepo(t, "git.example.com/lib")
+	allowlist, err := policy.OpenAllowlist(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServerWithConfig(&Config{
+		Git: []*git.Config{{
+			ModulePrefix: "git.example.com",
+			Remote:       "file://" + filepath.ToSlash(repo.Dir),
+			CacheDir:     t.TempDir(),
+		}},
+		Policy:     &policy.Config{Allowlist: allowlist},
+		AdminToken: "secret",
+	})
+	proxy := httptest.NewServer(s.srv.Handler)
+	defer proxy.Close()
+	admin := func(method, path, body string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, proxy.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	resp, err := http.Post(proxy.URL+"/admin/policy/allowlist", "text/plain", strings.NewReader("git.example.com/lib v1.1.0/go.mod h1:AAAA=\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unauthenticated allowlist import not refused: %d", resp.StatusCode)
+	}
+	resp = admin(http.MethodPost, "/admin/policy/allowlist", "git.example.com/lib v1.0.0/go.mod h1:AAAA=\n")
+	resp.Body.Close()
+	goCmd, _ := goCommand(t, proxy.URL, "git.example.com/lib")
+	if got := goCmd("list", "-m", "-versions", "git.example.com/lib"); got != "git.example.com/lib v1.0.0" {
+		t.Errorf("unexpected versions: %q", got)
+	}
+	goCmd("get", "git.example.com/lib@v1.0.0")
+	goCmd("build", "./...")
+
+	command, _ := goCommandExec(t, proxy.URL, "git.example.com/lib")
+	out, err := command("get", "git.example.com/lib@v1.1.0").CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "git.example.com/lib@v1.1.0 is blocked by policy: it is not on the allowlist, an access request was recorded") {
+		t.Fatalf("unapproved version not refused: %v\n%s", err, out)
+	}
+	resp = admin(http.MethodGet, "/admin/policy/requests", "")
+	var requests []policy.AccessRequest
+	if err := json.NewDecoder(resp.Body).Decode(&requests); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(requests) != 1 || requests[0].Module != "git.example.com/lib" || requests[0].Version != "v1.1.0" {
+		t.Fatalf("unexpected access requests: %+v", requests)
+	}
+	resp, err = http.Post(proxy.URL+"/admin/policy/requests/git.example.com/lib@v1.1.0", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unauthenticated approval not refused: %d", resp.StatusCode)
+	}
+	resp = admin(http.MethodPost, "/admin/policy/requests/git.example.com/lib@v1.1.0", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("approval failed: %d", resp.StatusCode)
+	}
+	goCmd("get", "git.example.com/lib@v1.1.0")
+	goCmd("build", "./...")
+}
+
+func fixtureRepo(t *testing.T, modPath string) (*forgetest.Repo, string) {
+	repo := forgetest.NewRepo(t)
+	repo.Commit(map[string]string{
+		"go.mod":        "module " + modPath + "\n\ngo 1.17\n",
+		"lib.go":        "package lib\n\nfunc Version() string { return \"v1.0.0\" }\n",
+		"vendor/x":      "ignored\n",
+		"nested/go.mod": "module " + modPath + "/nested\n",
+	})
+	repo.Tag("v1.0.0")
+	repo.Commit(map[string]string{
+		"lib.go": "package lib\n\nfunc Version() string { return \"v1.1.0\" }\n",
+	})
+	repo.Tag("v1.1.0")
+	head := repo.Commit(map[string]string{
+		"lib.go": "package lib\n\nfunc Version() string { return \"main\" }\n",
+	})
+	return repo, head
+}
+
+// goCommand returns a function running the go command with a fresh module
+// cache in a consumer module importing modPath, and the module cache dir.
+// env overrides the default environment.
+func goCommand(t *testing.T, proxyURL, modPath string, env ...string) (func(args ...string) string, string) {
+	command, modCache := goCommandExec(t, proxyURL, modPath, env...)
+	return func(args ...string) string {
+		t.Helper()
+		out, err := command(args...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("go %v: %v\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}, modCache
+}
+
+// goCommandExec is like goCommand but returns the commands to run, for
+// tests expecting them to fail
+func goCommandExec(t *testing.T, proxyURL, modPath string, env ...string) (func(args ...string) *exec.Cmd, string) {
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go command not available")
+	}
+	work := t.TempDir()
+	files := map[string]string{
+		"go.mod":  "module example.com/consumer\n\ngo 1.17\n",
+		"main.go": "package main\n\nimport \"" + modPath + "\"\n\nfunc main() { println(lib.Version()) }\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(work, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	modCache := filepath.Join(work, "modcache")
+	return func(args ...string) *exec.Cmd {
+		cmd := exec.Command(goBin, args...)
+		cmd.Dir = work
+		cmd.Env = append(os.Environ(),
+			"GOPROXY="+proxyURL,
+			"GOSUMDB=off",
+			"GOFLAGS=-modcacherw -mod=mod",
+			"GOPATH="+filepath.Join(work, "gopath"),
+			"GOMODCACHE="+modCache,
+			"GOTOOLCHAIN=local",
+			"GOPRIVATE=",
+			"GONOPROXY=",
+		)
+		cmd.Env = append(cmd.Env, env...)
+		return cmd
+	}, modCache
+}
+
+// testGoCommand fetches and builds against modPath served by s and returns
+// the module cache used
+func testGoCommand(t *testing.T, s *Server, modPath, head string, env ...string) string {
+	proxy := httptest.NewServer(s.srv.Handler)
+	defer proxy.Close()
+	goCmd, modCache := goCommand(t, proxy.URL, modPath, env...)
+
+	if got := goCmd("list", "-m", "-versions", modPath); got != modPath+" v1.0.0 v1.1.0" {
+		t.Errorf("unexpected versions: %q", got)
+	}
+	goCmd("get", modPath+"@v1.0.0")
+	goCmd("build", "./...")
+	// go mod verify compares the downloaded zip against the hash in go.sum,
+	// which is computed from the zip served by the proxy
+	goCmd("mod", "verify")
+	goCmd("get", modPath+"@main")
+	if got := goCmd("list", "-m", modPath); !strings.HasSuffix(got, head[:12]) || !strings.Contains(got, "v1.1.1-0.") {
+		t.Errorf("unexpected version for main: %q", got)
+	}
+	goCmd("get", modPath+"@latest")
+	if got := goCmd("list", "-m", modPath); got != modPath+" v1.1.0" {
+		t.Errorf("unexpected latest version: %q", got)
+	}
+	return modCache
+}
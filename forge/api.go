@@ -0,0 +1,79 @@
+package forge
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// APIError is returned for unsuccessful responses from a hosting api
+type APIError struct {
+	// Forge names the hosting service in messages, e.g. "github"
+	Forge   string
+	Status  int
+	Message string
+	// RateLimited is set if the request was rejected by a rate limit, which
+	// some apis signal with 403 instead of 429
+	RateLimited bool
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s api error: %d %s", e.Forge, e.Status, e.Message)
+}
+
+// Is matches ErrNotFound for 404 responses
+func (e *APIError) Is(target error) bool {
+	return target == ErrNotFound && e.Status == http.StatusNotFound
+}
+
+// ClientError maps the error to the response sent to the go command. 404
+// and 410 make the go command try the next proxy, so they are only used
+// when the module really is missing.
+func (e *APIError) ClientError() ([]byte, int, error) {
+	switch {
+	case e.RateLimited || e.Status == http.StatusTooManyRequests:
+		return []byte(fmt.Sprintf("%s rate limit exceeded, try again later", e.Forge)), http.StatusServiceUnavailable, nil
+	case e.Status == http.StatusNotFound || e.Status == http.StatusGone:
+		return []byte(e.Message), e.Status, nil
+	case e.Status == http.StatusUnauthorized || e.Status == http.StatusForbidden:
+		return []byte(fmt.Sprintf("%s rejected proxy credentials: %s", e.Forge, e.Message)), http.StatusBadGateway, nil
+	}
+	return []byte(fmt.Sprintf("%s api error %d: %s", e.Forge, e.Status, e.Message)), http.StatusBadGateway, nil
+}
+
+// Transport only allows https requests to a fixed set of hosts, so
+// credentials are never sent elsewhere
+type Transport struct {
+	Hosts map[string]bool
+	Base  http.RoundTripper
+}
+
+func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if !t.Hosts[r.URL.Host] {
+		return nil, fmt.Errorf("invalid host")
+	}
+	if r.URL.Scheme != "https" {
+		return nil, fmt.Errorf("insecure connection")
+	}
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(r)
+}
+
+// NextLink returns the url of the next page from a Link header
+func NextLink(header http.Header) string {
+	for _, link := range strings.Split(header.Get("Link"), ",") {
+		parts := strings.Split(link, ";")
+		if len(parts) < 2 {
+			continue
+		}
+		for _, param := range parts[1:] {
+			if strings.TrimSpace(param) == `rel="next"` {
+				return strings.Trim(strings.TrimSpace(parts[0]), "<>")
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,21 @@
+package forge
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestNextLink(t *testing.T) {
+	tests := map[string]string{
+		"": "",
+		`<https://api.example.com/repos/o/r/tags?page=2>; rel="next", <https://api.example.com/repos/o/r/tags?page=5>; rel="last"`:  "https://api.example.com/repos/o/r/tags?page=2",
+		`<https://api.example.com/repos/o/r/tags?page=1>; rel="prev", <https://api.example.com/repos/o/r/tags?page=1>; rel="first"`: "",
+	}
+	for link, want := range tests {
+		header := http.Header{}
+		header.Set("Link", link)
+		if got := NextLink(header); got != want {
+			t.Errorf("%q: got %q, want %q", link, got, want)
+		}
+	}
+}
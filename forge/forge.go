@@ -0,0 +1,494 @@
+// Package forge implements the module proxy protocol for modules served from
+// a single git repository on a hosting service such as gitlab or github.
+// Each hosting service provides a Repo backed by its API, and the version
+// listing, pseudo-version, go.mod and zip logic is shared.
+package forge
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/wozz/modpox/upstream"
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// ErrNotFound is matched by errors.Is for missing refs, files and
+// repositories
+var ErrNotFound = errors.New("not found")
+
+// Commit is a commit in a repository
+type Commit struct {
+	Id   string
+	Time time.Time
+}
+
+// Tag is a tag pointing at a commit
+type Tag struct {
+	Name   string
+	Commit Commit
+}
+
+// Repo is a git repository on a hosting service. Errors for missing refs or
+// files must match ErrNotFound.
+type Repo interface {
+	// Tags returns all tags in the repository. The commit time may be left
+	// unset if the api doesn't return it with the tag.
+	Tags() ([]Tag, error)
+	// Head returns the latest commit on the default branch
+	Head() (Commit, error)
+	// Commit resolves a branch, tag or (short) commit hash. Unknown refs
+	// return either an empty commit or an error matching ErrNotFound.
+	Commit(ref string) (Commit, error)
+	// IsAncestor reports whether ancestor is reachable from commit
+	IsAncestor(ancestor, commit string) (bool, error)
+	// File returns the contents of a file at ref
+	File(ref, path string) ([]byte, error)
+	// Archive returns a zip of the repository at ref with all files in a
+	// single top level directory
+	Archive(ref string) ([]byte, error)
+}
+
+// IsNotFound reports whether err matches ErrNotFound
+func IsNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound)
+}
+
+type modInfo struct {
+	Version string
+	Time    string
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// Serve answers a module proxy request for the module in key, which is
+// served from the root of repo
+func Serve(repo Repo, key string) ([]byte, int, error) {
+	if strings.HasSuffix(key, "/@v/list") {
+		return list(repo, key)
+	} else if strings.HasSuffix(key, "/@latest") {
+		return latest(repo, key)
+	} else if strings.HasSuffix(key, ".zip") {
+		return modZip(repo, key)
+	} else if strings.HasSuffix(key, ".info") {
+		return info(repo, key)
+	} else if strings.HasSuffix(key, ".mod") {
+		return mod(repo, key)
+	}
+	return nil, http.StatusForbidden, nil
+}
+
+func sortedTags(t []Tag) semVerList {
+	sList := make(semVerList, len(t))
+	for i, tag := range t {
+		sList[i] = parseTag(tag)
+	}
+	sort.Sort(sList)
+	return sList
+}
+
+func list(repo Repo, key string) ([]byte, int, error) {
+	sList, err := versions(repo, key)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: list error", err)
+	}
+	var b bytes.Buffer
+	for _, s := range sList {
+		b.Write([]byte(s.raw))
+		b.Write([]byte("\n"))
+	}
+	return b.Bytes(), http.StatusOK, nil
+}
+
+func latest(repo Repo, key string) ([]byte, int, error) {
+	sList, err := versions(repo, key)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: latest error", err)
+	}
+	if len(sList) == 0 {
+		major, err := pathMajor(key)
+		if err != nil {
+			return nil, 0, err
+		}
+		head, err := repo.Head()
+		if IsNotFound(err) {
+			return []byte("no commits found"), http.StatusGone, nil
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w: could not get latest commit", err)
+		}
+		var b bytes.Buffer
+		err = json.NewEncoder(&b).Encode(modInfo{
+			Version: module.PseudoVersion(major, "", head.Time, shortRev(head.Id)),
+			Time:    formatTime(head.Time),
+		})
+		return b.Bytes(), http.StatusOK, err
+	}
+	modPath, err := ParseModulePath(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	status, err := moduleStatus(repo, modPath, sList)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: could not get module status", err)
+	}
+	if allowed := withoutRetracted(sList, status.Retractions); len(allowed) > 0 {
+		sList = allowed
+	} else {
+		log.Printf("all versions retracted: %s", key)
+	}
+	latest, _ := sList.latest()
+	if latest.date.IsZero() {
+		commit, err := repo.Commit(latest.commit)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w: could not get commit", err)
+		}
+		latest.date = commit.Time
+	}
+	var b bytes.Buffer
+	err = json.NewEncoder(&b).Encode(modInfo{Version: latest.raw, Time: latest.time()})
+	return b.Bytes(), http.StatusOK, err
+}
+
+// Status returns the retractions and deprecation of the module at modPath,
+// which is served from the root of repo
+func Status(repo Repo, modPath string) (*upstream.ModuleStatus, error) {
+	escaped, err := module.EscapePath(modPath)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid module path", err)
+	}
+	sList, err := versions(repo, fmt.Sprintf("/%s/@latest", escaped))
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not get versions", err)
+	}
+	return moduleStatus(repo, modPath, sList)
+}
+
+// moduleStatus reads retract directives and the deprecation comment from the
+// go.mod of the latest version in sList
+func moduleStatus(repo Repo, modPath string, sList semVerList) (*upstream.ModuleStatus, error) {
+	status := &upstream.ModuleStatus{
+		Module:      modPath,
+		Retractions: []upstream.Retraction{},
+	}
+	latest, ok := sList.latest()
+	if !ok {
+		return status, nil
+	}
+	status.Latest = latest.raw
+	goModFile, err := repo.File(versionRef(latest.raw), "go.mod")
+	if IsNotFound(err) {
+		return status, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: error getting go.mod", err)
+	}
+	f, err := modfile.ParseLax("go.mod", goModFile, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not parse go.mod", err)
+	}
+	if f.Module != nil {
+		status.Deprecated = f.Module.Deprecated
+	}
+	for _, r := range f.Retract {
+		status.Retractions = append(status.Retractions, upstream.Retraction{
+			Low:       r.Low,
+			High:      r.High,
+			Rationale: r.Rationale,
+		})
+	}
+	return status, nil
+}
+
+func withoutRetracted(sList semVerList, retractions []upstream.Retraction) semVerList {
+	out := make(semVerList, 0, len(sList))
+	for _, s := range sList {
+		if !isRetracted(s.raw, retractions) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func isRetracted(version string, retractions []upstream.Retraction) bool {
+	for _, r := range retractions {
+		if semver.Compare(r.Low, version) <= 0 && semver.Compare(version, r.High) <= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func modZip(repo Repo, key string) ([]byte, int, error) {
+	version, err := parseVersion(key, ".zip")
+	if err != nil {
+		return nil, 0, err
+	}
+	if !IsCanonical(version) {
+		return []byte(fmt.Sprintf("version %s is not canonical", version)), http.StatusNotFound, nil
+	}
+	modPath, err := ParseModulePath(key)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: could not parse module path for zip file", err)
+	}
+	rawZip, err := repo.Archive(versionRef(version))
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: error getting archive", err)
+	}
+	zipFile, err := moduleZip(module.Version{Path: modPath, Version: version}, rawZip)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: error getting zip", err)
+	}
+	return zipFile, http.StatusOK, nil
+}
+
+func info(repo Repo, key string) ([]byte, int, error) {
+	version, err := parseVersion(key, ".info")
+	if err != nil {
+		return nil, 0, err
+	}
+	var i modInfo
+	if IsCanonical(version) {
+		commit, err := repo.Commit(versionRef(version))
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w: could not get commit", err)
+		}
+		if commit.Id == "" {
+			return []byte(fmt.Sprintf("unknown revision %s", version)), http.StatusNotFound, nil
+		}
+		i = modInfo{Version: version, Time: formatTime(commit.Time)}
+	} else {
+		i, err = resolveQuery(repo, key, version)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w: could not resolve query", err)
+		}
+		if i.Version == "" {
+			return []byte(fmt.Sprintf("unknown revision %s", version)), http.StatusNotFound, nil
+		}
+	}
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(&i); err != nil {
+		return nil, 0, fmt.Errorf("%w: json encode error", err)
+	}
+	return b.Bytes(), http.StatusOK, nil
+}
+
+// resolveQuery turns a branch name, tag name or commit hash into a canonical
+// version. Tagged commits resolve to the highest matching tag, anything else
+// to a pseudo-version based on the closest tagged ancestor.
+func resolveQuery(repo Repo, key, query string) (modInfo, error) {
+	commit, err := repo.Commit(query)
+	if err != nil {
+		return modInfo{}, fmt.Errorf("%w: could not get commit", err)
+	}
+	if commit.Id == "" {
+		return modInfo{}, nil
+	}
+	major, err := pathMajor(key)
+	if err != nil {
+		return modInfo{}, err
+	}
+	sList, err := versions(repo, key)
+	if err != nil {
+		return modInfo{}, fmt.Errorf("%w: could not get versions", err)
+	}
+	for i := len(sList) - 1; i >= 0; i-- {
+		if sList[i].commit == commit.Id {
+			return modInfo{Version: sList[i].raw, Time: formatTime(commit.Time)}, nil
+		}
+	}
+	base := ""
+	for i := len(sList) - 1; i >= 0; i-- {
+		ok, err := repo.IsAncestor(sList[i].commit, commit.Id)
+		if err != nil {
+			return modInfo{}, fmt.Errorf("%w: could not compare commits", err)
+		}
+		if ok {
+			base = sList[i].raw
+			major = semver.Major(base)
+			break
+		}
+	}
+	return modInfo{
+		Version: module.PseudoVersion(major, base, commit.Time.UTC(), shortRev(commit.Id)),
+		Time:    formatTime(commit.Time),
+	}, nil
+}
+
+func mod(repo Repo, key string) ([]byte, int, error) {
+	version, err := parseVersion(key, ".mod")
+	if err != nil {
+		return nil, 0, err
+	}
+	if !IsCanonical(version) {
+		return []byte(fmt.Sprintf("version %s is not canonical", version)), http.StatusNotFound, nil
+	}
+	goModFile, err := repo.File(versionRef(version), "go.mod")
+	if IsNotFound(err) {
+		// repositories without a go.mod get a synthesized one, but only if
+		// the requested version actually exists
+		commit, err := repo.Commit(versionRef(version))
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w: could not get commit", err)
+		}
+		if commit.Id == "" {
+			return []byte(fmt.Sprintf("unknown revision %s", version)), http.StatusNotFound, nil
+		}
+		modPath, err := ParseModulePath(key)
+		if err != nil {
+			return nil, 0, err
+		}
+		return []byte(fmt.Sprintf("module %s\n", modfile.AutoQuote(modPath))), http.StatusOK, nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: error getting go.mod", err)
+	}
+	return goModFile, http.StatusOK, nil
+}
+
+// parseVersion extracts the unescaped version from a request such as
+// /host/group/project/@v/v1.2.3.info
+func parseVersion(key, ext string) (string, error) {
+	i := strings.LastIndex(key, "/@v/")
+	if i < 0 || !strings.HasSuffix(key, ext) {
+		return "", fmt.Errorf("could not parse request")
+	}
+	version, err := module.UnescapeVersion(strings.TrimSuffix(key[i+len("/@v/"):], ext))
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid version in request", err)
+	}
+	return version, nil
+}
+
+// ParseModulePath extracts the unescaped module path from a request key
+func ParseModulePath(key string) (string, error) {
+	i := strings.LastIndex(key, "/@")
+	if i < 0 {
+		return "", fmt.Errorf("could not parse request")
+	}
+	modPath, err := module.UnescapePath(strings.TrimPrefix(key[:i], "/"))
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid module path in request", err)
+	}
+	return modPath, nil
+}
+
+// pathMajor returns the major version implied by the module path, e.g. "v2"
+// for example.com/group/project/v2 and "" for paths without a suffix
+func pathMajor(key string) (string, error) {
+	modPath, err := ParseModulePath(key)
+	if err != nil {
+		return "", err
+	}
+	_, major, ok := module.SplitPathVersion(modPath)
+	if !ok {
+		return "", fmt.Errorf("invalid module path: %s", modPath)
+	}
+	return module.PathMajorPrefix(major), nil
+}
+
+// versions returns the sorted canonical versions of a module. For module
+// paths without a major version suffix, v2+ tags are included with an
+// +incompatible suffix the same way the go command does: only if the latest
+// v0/v1 version and the latest version of that major have no go.mod.
+func versions(repo Repo, key string) (semVerList, error) {
+	major, err := pathMajor(key)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := repo.Tags()
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not get tags", err)
+	}
+	sList := sortedTags(filterMajor(tags, major))
+	if major != "" {
+		return sList, nil
+	}
+	if len(sList) > 0 {
+		ok, err := hasGoMod(repo, sList[len(sList)-1].raw)
+		if err != nil || ok {
+			return sList, err
+		}
+	}
+	incompatible := make(map[string][]Tag)
+	for _, t := range tags {
+		if !IsCanonical(t.Name) || module.IsPseudoVersion(t.Name) || semver.Build(t.Name) != "" {
+			continue
+		}
+		if m := semver.Major(t.Name); m != "v0" && m != "v1" {
+			incompatible[m] = append(incompatible[m], t)
+		}
+	}
+	for _, group := range incompatible {
+		gList := sortedTags(group)
+		ok, err := hasGoMod(repo, gList[len(gList)-1].raw)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			continue
+		}
+		for _, s := range gList {
+			s.raw += "+incompatible"
+			sList = append(sList, s)
+		}
+	}
+	sort.Sort(sList)
+	return sList, nil
+}
+
+func hasGoMod(repo Repo, ref string) (bool, error) {
+	_, err := repo.File(ref, "go.mod")
+	if IsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// filterMajor keeps only tags that are valid for the given major version
+func filterMajor(tags []Tag, major string) []Tag {
+	out := make([]Tag, 0, len(tags))
+	for _, t := range tags {
+		if !IsCanonical(t.Name) || module.IsPseudoVersion(t.Name) || semver.Build(t.Name) != "" {
+			continue
+		}
+		m := semver.Major(t.Name)
+		if major == "" && (m == "v0" || m == "v1") || m == major {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// IsCanonical reports whether version is a canonical module version, such as
+// a release tag or pseudo-version
+func IsCanonical(version string) bool {
+	return semver.IsValid(version) && module.CanonicalVersion(version) == version
+}
+
+// versionRef maps a canonical version to the git ref it was built from
+func versionRef(version string) string {
+	if module.IsPseudoVersion(version) {
+		if rev, err := module.PseudoVersionRev(version); err == nil {
+			return rev
+		}
+	}
+	return strings.TrimSuffix(version, "+incompatible")
+}
+
+func shortRev(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
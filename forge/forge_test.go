@@ -0,0 +1,103 @@
+package forge
+
+import (
+	"testing"
+
+	"github.com/wozz/modpox/upstream"
+)
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		key     string
+		ext     string
+		version string
+		err     bool
+	}{
+		{key: "/gitlab.example.com/g/p/@v/v1.2.3.info", ext: ".info", version: "v1.2.3"},
+		{key: "/gitlab.example.com/g/p/@v/main.info", ext: ".info", version: "main"},
+		{key: "/gitlab.example.com/g/p/v2/@v/v2.0.0-rc.1.mod", ext: ".mod", version: "v2.0.0-rc.1"},
+		{key: "/gitlab.example.com/g/p/@v/v1.2.3.zip", ext: ".info", err: true},
+		{key: "/gitlab.example.com/g/p/@latest", ext: ".info", err: true},
+	}
+	for _, tt := range tests {
+		version, err := parseVersion(tt.key, tt.ext)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: expected error", tt.key)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.key, err)
+		}
+		if version != tt.version {
+			t.Errorf("%s: got %s, want %s", tt.key, version, tt.version)
+		}
+	}
+}
+
+func TestVersionRef(t *testing.T) {
+	tests := map[string]string{
+		"v1.2.3":                               "v1.2.3",
+		"v0.0.0-20200101000000-abcdef123456":   "abcdef123456",
+		"v1.2.4-0.20200101000000-abcdef123456": "abcdef123456",
+		"v2.1.0+incompatible":                  "v2.1.0",
+	}
+	for version, want := range tests {
+		if got := versionRef(version); got != want {
+			t.Errorf("%s: got %s, want %s", version, got, want)
+		}
+	}
+}
+
+func TestFilterMajor(t *testing.T) {
+	tags := []Tag{
+		{Name: "v0.1.0"},
+		{Name: "v1.0.0"},
+		{Name: "v2.0.0"},
+		{Name: "v2.1"},
+		{Name: "release-1"},
+	}
+	if got := filterMajor(tags, ""); len(got) != 2 {
+		t.Errorf("unexpected tags for v0/v1: %v", got)
+	}
+	if got := filterMajor(tags, "v2"); len(got) != 1 || got[0].Name != "v2.0.0" {
+		t.Errorf("unexpected tags for v2: %v", got)
+	}
+}
+
+func TestIsRetracted(t *testing.T) {
+	retractions := []upstream.Retraction{
+		{Low: "v1.0.1", High: "v1.0.1"},
+		{Low: "v1.2.0", High: "v1.3.0"},
+	}
+	tests := map[string]bool{
+		"v1.0.0":              false,
+		"v1.0.1":              true,
+		"v1.2.5":              true,
+		"v1.3.0":              true,
+		"v1.3.1":              false,
+		"v1.2.0-rc.1":         false,
+		"v2.0.0+incompatible": false,
+	}
+	for version, want := range tests {
+		if got := isRetracted(version, retractions); got != want {
+			t.Errorf("%s: got %v, want %v", version, got, want)
+		}
+	}
+}
+
+func TestIsCanonical(t *testing.T) {
+	tests := map[string]bool{
+		"v1.2.3":              true,
+		"v2.0.0+incompatible": true,
+		"v1.2":                false,
+		"v1.2.3+meta":         false,
+		"main":                false,
+	}
+	for version, want := range tests {
+		if got := IsCanonical(version); got != want {
+			t.Errorf("%s: got %v, want %v", version, got, want)
+		}
+	}
+}
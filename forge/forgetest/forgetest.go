@@ -0,0 +1,219 @@
+// Package forgetest provides git repository fixtures for testing upstreams
+// built on the forge package against fake hosting apis.
+package forgetest
+
+import (
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wozz/modpox/upstream"
+)
+
+// Repo is a git repository used as a project fixture served by a fake
+// hosting api
+type Repo struct {
+	Dir string
+	t   testing.TB
+}
+
+// NewRepo creates an empty git repository in a temporary directory. The
+// test is skipped if git is not installed.
+func NewRepo(t testing.TB) *Repo {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+	r := &Repo{Dir: t.TempDir(), t: t}
+	r.Git("init", "-q", "-b", "main")
+	return r
+}
+
+// Git runs a git command in the repository and returns its output
+func (r *Repo) Git(args ...string) string {
+	r.t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = r.Dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		r.t.Fatalf("git %v: %v\n%s", args, err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// Commit writes files, removing those with empty content, and commits them.
+// It returns the new commit hash.
+func (r *Repo) Commit(files map[string]string) string {
+	r.t.Helper()
+	for name, content := range files {
+		p := filepath.Join(r.Dir, filepath.FromSlash(name))
+		if content == "" {
+			r.Git("rm", "-q", "--", name)
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			r.t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			r.t.Fatal(err)
+		}
+	}
+	r.Git("add", "-A")
+	r.Git("commit", "-q", "--allow-empty", "-m", "commit")
+	return r.Git("rev-parse", "HEAD")
+}
+
+// Tag creates a lightweight tag at HEAD
+func (r *Repo) Tag(name string) {
+	r.t.Helper()
+	r.Git("tag", name)
+}
+
+// Commit is a commit in a fixture repository
+type Commit struct {
+	Sha  string
+	Time time.Time
+}
+
+func git(dir string, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	return cmd.Output()
+}
+
+func parseCommits(out []byte) []Commit {
+	var commits []Commit
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, fields[1])
+		if err != nil {
+			continue
+		}
+		commits = append(commits, Commit{Sha: fields[0], Time: t})
+	}
+	return commits
+}
+
+// Resolve returns the commit a branch, tag or (short) hash points to in the
+// git repository at dir
+func Resolve(dir, ref string) (Commit, bool) {
+	if ref == "" || strings.HasPrefix(ref, "-") {
+		return Commit{}, false
+	}
+	out, err := git(dir, "log", "-1", "--format=%H %cI", ref+"^{commit}", "--")
+	if err != nil {
+		return Commit{}, false
+	}
+	commits := parseCommits(out)
+	if len(commits) != 1 {
+		return Commit{}, false
+	}
+	return commits[0], true
+}
+
+// Tags returns the tag names in the git repository at dir
+func Tags(dir string) []string {
+	out, err := git(dir, "tag", "--list")
+	if err != nil {
+		return nil
+	}
+	return strings.Fields(string(out))
+}
+
+// RevList returns the commits reachable from head but not from base, newest
+// first. An empty base lists all commits reachable from head.
+func RevList(dir, base, head string) []Commit {
+	spec := head
+	if base != "" {
+		spec = base + ".." + head
+	}
+	if strings.HasPrefix(spec, "-") {
+		return nil
+	}
+	out, err := git(dir, "log", "--format=%H %cI", spec, "--")
+	if err != nil {
+		return nil
+	}
+	return parseCommits(out)
+}
+
+// Show returns the contents of a file at a commit
+func Show(dir, sha, filePath string) ([]byte, bool) {
+	out, err := git(dir, "show", sha+":"+filePath)
+	return out, err == nil
+}
+
+// Archive returns a zip of the repository at a commit with all files under
+// prefix, which should end in a slash
+func Archive(dir, sha, prefix string) ([]byte, error) {
+	return git(dir, "archive", "--format=zip", "--prefix="+prefix, sha)
+}
+
+// NewGitServer serves the git repositories under root over http with the
+// smart protocol, requiring basic auth with username and password if
+// username is set. Repositories are addressed by their path below root. The
+// test is skipped if git http-backend is not available.
+func NewGitServer(t testing.TB, root, username, password string) *httptest.Server {
+	t.Helper()
+	execPath, err := git("", "--exec-path")
+	if err != nil {
+		t.Skip("git not available")
+	}
+	backend := filepath.Join(strings.TrimSpace(string(execPath)), "git-http-backend")
+	if _, err := os.Stat(backend); err != nil {
+		t.Skip("git http-backend not available")
+	}
+	h := &cgi.Handler{
+		Path: backend,
+		Env:  []string{"GIT_PROJECT_ROOT=" + root, "GIT_HTTP_EXPORT_ALL=1"},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); username != "" && (!ok || user != username || pass != password) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="git"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// Request is an expected response of an upstream
+type Request struct {
+	Key    string
+	Status int
+	// Body is the expected body if set
+	Body string
+}
+
+// Check gets each request's key from u and fails the test if the status or
+// body differ from the expected ones
+func Check(t testing.TB, u upstream.Upstream, requests []Request) {
+	t.Helper()
+	for _, r := range requests {
+		b, status, err := u.Get(r.Key)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", r.Key, err)
+			continue
+		}
+		if status != r.Status {
+			t.Errorf("%s: got status %d, want %d: %s", r.Key, status, r.Status, b)
+		} else if r.Body != "" && string(b) != r.Body {
+			t.Errorf("%s: got %q, want %q", r.Key, b, r.Body)
+		}
+	}
+}
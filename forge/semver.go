@@ -0,0 +1,84 @@
+package forge
+
+import (
+	"time"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// semVer is a tag ordered by semantic version precedence
+type semVer struct {
+	raw    string
+	date   time.Time
+	commit string
+}
+
+// parseTag returns the tag as a semVer. Tags that are not canonical module
+// versions are kept but sort before all valid versions.
+func parseTag(in Tag) semVer {
+	return semVer{
+		raw:    in.Name,
+		date:   in.Commit.Time,
+		commit: in.Commit.Id,
+	}
+}
+
+// valid reports whether the tag is a canonical version the go command
+// would list, excluding tags that look like pseudo-versions
+func (s semVer) valid() bool {
+	return IsCanonical(s.raw) && !module.IsPseudoVersion(s.raw)
+}
+
+// isRelease reports whether s is a valid version without a prerelease
+func (s semVer) isRelease() bool {
+	return s.valid() && semver.Prerelease(s.raw) == ""
+}
+
+// time returns the tagged commit time formatted for .info responses
+func (s semVer) time() string {
+	return formatTime(s.date)
+}
+
+// compare returns -1, 0 or 1 following semantic version precedence
+func (s semVer) compare(o semVer) int {
+	if sv, ov := s.valid(), o.valid(); sv != ov {
+		if sv {
+			return 1
+		}
+		return -1
+	}
+	return semver.Compare(s.raw, o.raw)
+}
+
+type semVerList []semVer
+
+func (s semVerList) Less(i, j int) bool {
+	if c := s[i].compare(s[j]); c != 0 {
+		return c < 0
+	}
+	return s[i].raw < s[j].raw
+}
+
+func (s semVerList) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s semVerList) Len() int {
+	return len(s)
+}
+
+// latest returns the highest release in a sorted list, falling back to the
+// highest prerelease if there are no releases, like the go command does for
+// @latest queries
+func (s semVerList) latest() (semVer, bool) {
+	for i := len(s) - 1; i >= 0; i-- {
+		if s[i].isRelease() {
+			return s[i], true
+		}
+	}
+	if len(s) == 0 {
+		return semVer{}, false
+	}
+	return s[len(s)-1], true
+}
@@ -0,0 +1,116 @@
+package forge
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestSemVer(t *testing.T) {
+	t.Run("test parsing", func(t *testing.T) {
+		date := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+		s := parseTag(Tag{
+			Name: "v1.2.3",
+			Commit: Commit{
+				Time: date,
+				Id:   "abcdef1234567890",
+			},
+		})
+		if !s.isRelease() {
+			t.Errorf("expected release version")
+		}
+		if s.raw != "v1.2.3" {
+			t.Errorf("unexpected raw tag found")
+		}
+		if !s.date.Equal(date) {
+			t.Errorf("unexpected date found")
+		}
+		if s.commit != "abcdef1234567890" {
+			t.Errorf("unexpected commit found")
+		}
+	})
+	t.Run("test sort by major", func(t *testing.T) {
+		s1 := semVer{raw: "v5.1.1"}
+		s2 := semVer{raw: "v4.5.5"}
+		semVerList := semVerList{s1, s2}
+		sort.Sort(semVerList)
+		if semVerList[0].raw != "v4.5.5" {
+			t.Errorf("sorted incorrectly")
+		}
+	})
+	t.Run("test sort by minor", func(t *testing.T) {
+		s1 := semVer{raw: "v1.2.1"}
+		s2 := semVer{raw: "v1.1.5"}
+		semVerList := semVerList{s1, s2}
+		sort.Sort(semVerList)
+		if semVerList[0].raw != "v1.1.5" {
+			t.Errorf("sorted incorrectly")
+		}
+	})
+	t.Run("test sort by patch", func(t *testing.T) {
+		s1 := semVer{raw: "v1.1.5"}
+		s2 := semVer{raw: "v1.1.1"}
+		semVerList := semVerList{s1, s2}
+		sort.Sort(semVerList)
+		if semVerList[0].raw != "v1.1.1" {
+			t.Errorf("sorted incorrectly")
+		}
+	})
+	t.Run("test parsing prerelease", func(t *testing.T) {
+		s := parseTag(Tag{Name: "v1.2.0-rc.1"})
+		if !s.valid() {
+			t.Fatalf("expected valid version")
+		}
+		if s.isRelease() {
+			t.Errorf("expected prerelease")
+		}
+	})
+	t.Run("test invalid tags", func(t *testing.T) {
+		for _, name := range []string{"release-1", "v1.2", "v01.2.3", "v1.2.3-01", "v1.2.3-", "v1.2.3+", "v1.2.3-rc..1", "v1.2.0-rc.1+build.5", "v0.0.0-20200101000000-abcdef123456"} {
+			if parseTag(Tag{Name: name}).valid() {
+				t.Errorf("expected %s to be invalid", name)
+			}
+		}
+	})
+	t.Run("test sort precedence", func(t *testing.T) {
+		// example from the semver 2.0 specification
+		want := []string{
+			"not-a-version",
+			"v1.0.0-alpha",
+			"v1.0.0-alpha.1",
+			"v1.0.0-alpha.beta",
+			"v1.0.0-beta",
+			"v1.0.0-beta.2",
+			"v1.0.0-beta.11",
+			"v1.0.0-rc.1",
+			"v1.0.0",
+			"v1.0.1",
+			"v1.10.0",
+		}
+		list := make(semVerList, 0, len(want))
+		for i := len(want) - 1; i >= 0; i-- {
+			list = append(list, parseTag(Tag{Name: want[i]}))
+		}
+		sort.Sort(list)
+		for i, s := range list {
+			if s.raw != want[i] {
+				t.Errorf("position %d: got %s, want %s", i, s.raw, want[i])
+			}
+		}
+	})
+	t.Run("test latest prefers releases", func(t *testing.T) {
+		list := semVerList{
+			parseTag(Tag{Name: "v1.1.0"}),
+			parseTag(Tag{Name: "v1.2.0-rc.1"}),
+		}
+		sort.Sort(list)
+		if l, _ := list.latest(); l.raw != "v1.1.0" {
+			t.Errorf("unexpected latest: %s", l.raw)
+		}
+		list = semVerList{parseTag(Tag{Name: "v1.2.0-rc.1"}), parseTag(Tag{Name: "v1.2.0-beta"})}
+		sort.Sort(list)
+		if l, _ := list.latest(); l.raw != "v1.2.0-rc.1" {
+			t.Errorf("unexpected latest prerelease: %s", l.raw)
+		}
+	})
+}
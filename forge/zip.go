@@ -0,0 +1,51 @@
+package forge
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/mod/module"
+	modzip "golang.org/x/mod/zip"
+)
+
+// archiveFile is a file from a repository archive with the top level
+// directory stripped from its path
+type archiveFile struct {
+	path string
+	f    *zip.File
+}
+
+func (a archiveFile) Path() string                 { return a.path }
+func (a archiveFile) Lstat() (os.FileInfo, error)  { return a.f.FileInfo(), nil }
+func (a archiveFile) Open() (io.ReadCloser, error) { return a.f.Open() }
+
+// moduleZip converts a repository archive into a module zip file.
+// Vendor directories, nested modules, symlinks and other irregular files are
+// omitted, and size limits and case-insensitive path collisions are enforced
+// in the same way as the go command.
+func moduleZip(m module.Version, rawZip []byte) ([]byte, error) {
+	r, err := zip.NewReader(bytes.NewReader(rawZip), int64(len(rawZip)))
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not read zip file", err)
+	}
+	files := make([]modzip.File, 0, len(r.File))
+	for _, f := range r.File {
+		if strings.HasSuffix(f.Name, "/") {
+			continue
+		}
+		i := strings.Index(f.Name, "/")
+		if i < 0 {
+			return nil, fmt.Errorf("unexpected file outside of archive root: %s", f.Name)
+		}
+		files = append(files, archiveFile{path: f.Name[i+1:], f: f})
+	}
+	var b bytes.Buffer
+	if err := modzip.Create(&b, m, files); err != nil {
+		return nil, fmt.Errorf("%w: could not create module zip", err)
+	}
+	return b.Bytes(), nil
+}
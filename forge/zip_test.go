@@ -0,0 +1,153 @@
+package forge
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/sumdb/dirhash"
+	modzip "golang.org/x/mod/zip"
+)
+
+// gitRepo creates a git repository containing files and returns its path.
+// Entries with a "->" prefix are created as symlinks to the given target.
+func gitRepo(t *testing.T, files map[string]string) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+	dir := t.TempDir()
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(content, "->") {
+			if err := os.Symlink(strings.TrimPrefix(content, "->"), p); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	git(t, dir, "init", "-q")
+	git(t, dir, "add", "-A")
+	git(t, dir, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "init")
+	return dir
+}
+
+func git(t *testing.T, dir string, args ...string) []byte {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("git %v: %v", args, err)
+	}
+	return out
+}
+
+func hashZip(t *testing.T, data []byte) string {
+	t.Helper()
+	f := filepath.Join(t.TempDir(), "mod.zip")
+	if err := os.WriteFile(f, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	h, err := dirhash.HashZip(f, dirhash.Hash1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// TestModuleZip compares zips built from gitlab style archives against the
+// zips the go command builds from the same git repository in direct mode
+func TestModuleZip(t *testing.T) {
+	m := module.Version{Path: "gitlab.example.com/group/project", Version: "v1.0.0"}
+	tests := []struct {
+		name    string
+		files   map[string]string
+		invalid bool
+	}{
+		{
+			name: "simple",
+			files: map[string]string{
+				"go.mod":      "module gitlab.example.com/group/project\n",
+				"main.go":     "package project\n",
+				"sub/sub.go":  "package sub\n",
+				"LICENSE":     "license\n",
+				"README.md":   "readme\n",
+				"testdata/in": "data\n",
+			},
+		},
+		{
+			name: "vendor and nested modules",
+			files: map[string]string{
+				"go.mod":                       "module gitlab.example.com/group/project\n",
+				"main.go":                      "package project\n",
+				"vendor/modules.txt":           "# vendor\n",
+				"vendor/example.com/dep/a.go":  "package dep\n",
+				"nested/go.mod":                "module gitlab.example.com/group/project/nested\n",
+				"nested/nested.go":             "package nested\n",
+				"nested/deeper/deeper.go":      "package deeper\n",
+				"internal/vendor/notvendor.go": "package vendor\n",
+			},
+		},
+		{
+			name: "symlinks",
+			files: map[string]string{
+				"go.mod":  "module gitlab.example.com/group/project\n",
+				"main.go": "package project\n",
+				"link.go": "->main.go",
+			},
+		},
+		{
+			name: "case collision",
+			files: map[string]string{
+				"go.mod":  "module gitlab.example.com/group/project\n",
+				"file.go": "package project\n",
+				"FILE.go": "package project\n",
+			},
+			invalid: true,
+		},
+		{
+			name: "go.mod too large",
+			files: map[string]string{
+				"go.mod": "module gitlab.example.com/group/project\n" + strings.Repeat("\n", modzip.MaxGoMod),
+			},
+			invalid: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := gitRepo(t, tt.files)
+			sha := strings.TrimSpace(string(git(t, dir, "rev-parse", "HEAD")))
+			archive := git(t, dir, "archive", "--format=zip", "--prefix=project-"+sha+"/", "HEAD")
+
+			got, err := moduleZip(m, archive)
+			var want bytes.Buffer
+			wantErr := modzip.CreateFromVCS(&want, m, dir, "HEAD", "")
+			if tt.invalid {
+				if err == nil || wantErr == nil {
+					t.Fatalf("expected errors, got %v and %v", err, wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if wantErr != nil {
+				t.Fatalf("unexpected error from go command zip: %v", wantErr)
+			}
+			if gotHash, wantHash := hashZip(t, got), hashZip(t, want.Bytes()); gotHash != wantHash {
+				t.Errorf("hash mismatch: got %s, want %s", gotHash, wantHash)
+			}
+		})
+	}
+}
@@ -0,0 +1,387 @@
+// Package git implements an upstream serving modules directly from git
+// remotes over https, ssh or file://, like the go command's direct mode.
+// Remotes are kept as bare mirrors on disk and fetched incrementally, and
+// versions and zips are computed locally with the git command.
+package git
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wozz/modpox/forge"
+	"github.com/wozz/modpox/upstream"
+	"golang.org/x/mod/module"
+)
+
+const (
+	defaultMaxConcurrency = 4
+	defaultFetchInterval  = time.Minute
+)
+
+// Config is used to configure the git upstream
+type Config struct {
+	Upstream upstream.Upstream
+	// ModulePrefix is the module path prefix served by this upstream
+	ModulePrefix string
+	// Remote is the url of the repositories under ModulePrefix, with {repo}
+	// replaced by the repository path below the prefix, e.g.
+	// https://git.example.com/{repo}.git, ssh://git@git.example.com/{repo}
+	// or file:///srv/git/{repo}. The repository path is the module path
+	// below the prefix without a major version suffix.
+	Remote string
+	// CacheDir is the directory bare mirrors are kept in
+	CacheDir string
+	// MaxConcurrency limits concurrent clones and fetches, defaults to 4
+	MaxConcurrency int
+	// FetchInterval is how long a mirror is used before it is fetched
+	// again, defaults to one minute
+	FetchInterval time.Duration
+	// BasicAuth optionally returns the username and password sent to https
+	// remotes. It is called for every clone and fetch, so rotated
+	// credentials are picked up.
+	BasicAuth func() (username, password string, err error)
+}
+
+type gitUpstream struct {
+	prefix        string
+	remote        string
+	cacheDir      string
+	fetchInterval time.Duration
+	basicAuth     func() (string, string, error)
+	upstream      upstream.Upstream
+	// sem limits concurrent network operations
+	sem chan struct{}
+
+	mu      sync.Mutex
+	mirrors map[string]*mirror
+	// missing holds when repositories were last found not to exist, so
+	// they aren't looked up again until the fetch interval passed
+	missing map[string]time.Time
+}
+
+// NewGitUpstream creates a new upstream serving modules from git remotes
+func NewGitUpstream(config *Config) upstream.Upstream {
+	maxConcurrency := config.MaxConcurrency
+	if maxConcurrency <= 0 {
+		maxConcurrency = defaultMaxConcurrency
+	}
+	fetchInterval := config.FetchInterval
+	if fetchInterval == 0 {
+		fetchInterval = defaultFetchInterval
+	}
+	return &gitUpstream{
+		prefix:        config.ModulePrefix,
+		remote:        config.Remote,
+		cacheDir:      config.CacheDir,
+		fetchInterval: fetchInterval,
+		basicAuth:     config.BasicAuth,
+		upstream:      config.Upstream,
+		sem:           make(chan struct{}, maxConcurrency),
+		mirrors:       make(map[string]*mirror),
+		missing:       make(map[string]time.Time),
+	}
+}
+
+func (g *gitUpstream) Get(key string) ([]byte, int, error) {
+	if strings.HasPrefix(key, fmt.Sprintf("/%s/", g.prefix)) {
+		log.Printf("query git remote for %s", key)
+		b, status, err := g.handle(key)
+		if forge.IsNotFound(err) {
+			return []byte(err.Error()), http.StatusNotFound, nil
+		}
+		return b, status, err
+	}
+	return g.upstream.Get(key)
+}
+
+func (g *gitUpstream) handle(key string) ([]byte, int, error) {
+	modPath, err := forge.ParseModulePath(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	m, err := g.findMirror(modPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	return forge.Serve(m, key)
+}
+
+// Status implements upstream.StatusUpstream
+func (g *gitUpstream) Status(modulePath string) (*upstream.ModuleStatus, error) {
+	if !strings.HasPrefix(modulePath, g.prefix+"/") {
+		return nil, nil
+	}
+	m, err := g.findMirror(modulePath)
+	if err != nil {
+		return nil, err
+	}
+	return forge.Status(m, modulePath)
+}
+
+// remoteURL returns the remote for a repository path below the prefix
+func (g *gitUpstream) remoteURL(repoPath string) string {
+	return strings.ReplaceAll(g.remote, "{repo}", repoPath)
+}
+
+// findMirror returns the mirror of the repository serving modPath from its
+// root. Modules in subdirectories of a repository are not supported.
+func (g *gitUpstream) findMirror(modPath string) (*mirror, error) {
+	pathPrefix, _, ok := module.SplitPathVersion(modPath)
+	if !ok || !strings.HasPrefix(pathPrefix, g.prefix+"/") {
+		return nil, fmt.Errorf("%w: path not served by this upstream: %s", forge.ErrNotFound, modPath)
+	}
+	repoPath := strings.TrimPrefix(pathPrefix, g.prefix+"/")
+	g.mu.Lock()
+	m, ok := g.mirrors[repoPath]
+	g.mu.Unlock()
+	if ok {
+		return m, nil
+	}
+	if g.recentlyMissing(repoPath) {
+		return nil, fmt.Errorf("%w: no git repository found for %s", forge.ErrNotFound, modPath)
+	}
+	remote := g.remoteURL(repoPath)
+	if !g.exists(remote) {
+		g.mu.Lock()
+		g.missing[repoPath] = time.Now()
+		g.mu.Unlock()
+		return nil, fmt.Errorf("%w: no git repository found for %s", forge.ErrNotFound, modPath)
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if m, ok = g.mirrors[repoPath]; !ok {
+		sum := sha256.Sum256([]byte(remote))
+		m = &mirror{
+			g:      g,
+			remote: remote,
+			dir:    filepath.Join(g.cacheDir, hex.EncodeToString(sum[:16])+".git"),
+		}
+		g.mirrors[repoPath] = m
+	}
+	return m, nil
+}
+
+// recentlyMissing reports whether the repository was found not to exist
+// within the fetch interval, and forgets repositories missing for longer
+func (g *gitUpstream) recentlyMissing(repoPath string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for p, t := range g.missing {
+		if time.Since(t) >= g.fetchInterval {
+			delete(g.missing, p)
+		}
+	}
+	_, ok := g.missing[repoPath]
+	return ok
+}
+
+// exists reports whether remote is a reachable git repository
+func (g *gitUpstream) exists(remote string) bool {
+	g.sem <- struct{}{}
+	defer func() { <-g.sem }()
+	_, err := g.remoteGit("", "ls-remote", "--", remote)
+	return err == nil
+}
+
+// remoteGit runs a git command accessing a remote, with the credentials
+// passed in the environment so they don't show up in process lists or the
+// mirror's config
+func (g *gitUpstream) remoteGit(dir string, args ...string) ([]byte, error) {
+	if g.basicAuth == nil {
+		return git(dir, args...)
+	}
+	username, password, err := g.basicAuth()
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not get git credentials", err)
+	}
+	auth := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+	return gitEnv(dir, []string{
+		"GIT_CONFIG_COUNT=1",
+		"GIT_CONFIG_KEY_0=http.extraHeader",
+		"GIT_CONFIG_VALUE_0=Authorization: Basic " + auth,
+	}, args...)
+}
+
+func git(dir string, args ...string) ([]byte, error) {
+	return gitEnv(dir, nil, args...)
+}
+
+func gitEnv(dir string, env []string, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(append(os.Environ(), "GIT_TERMINAL_PROMPT=0"), env...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%w: git %s: %s", err, args[0], strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// mirror is a bare mirror of a remote and implements forge.Repo
+type mirror struct {
+	g      *gitUpstream
+	remote string
+	dir    string
+
+	mu      sync.Mutex
+	fetched time.Time
+}
+
+// update clones or fetches the mirror if it is older than the fetch
+// interval. A stale mirror is still used if the remote is unreachable.
+func (m *mirror) update() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if time.Since(m.fetched) < m.g.fetchInterval {
+		return nil
+	}
+	m.g.sem <- struct{}{}
+	defer func() { <-m.g.sem }()
+	if _, err := os.Stat(m.dir); errors.Is(err, os.ErrNotExist) {
+		if err := m.clone(); err != nil {
+			return err
+		}
+	} else if _, err := m.g.remoteGit(m.dir, "fetch", "--prune", "--tags", "--force", "origin"); err != nil {
+		log.Printf("git fetch failed, using mirror from %s: %s %v", m.fetched.Format(time.RFC3339), m.remote, err)
+	}
+	m.fetched = time.Now()
+	return nil
+}
+
+// clone creates the mirror in a temporary directory first so an interrupted
+// clone never leaves a partial mirror behind
+func (m *mirror) clone() error {
+	if err := os.MkdirAll(filepath.Dir(m.dir), 0755); err != nil {
+		return fmt.Errorf("%w: could not create cache dir", err)
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(m.dir), ".clone-")
+	if err != nil {
+		return fmt.Errorf("%w: could not create temp dir", err)
+	}
+	defer os.RemoveAll(tmp)
+	if _, err := m.g.remoteGit("", "clone", "--quiet", "--mirror", "--", m.remote, tmp); err != nil {
+		return fmt.Errorf("%w: could not clone %s", err, m.remote)
+	}
+	if err := os.Rename(tmp, m.dir); err != nil {
+		return fmt.Errorf("%w: could not move mirror into place", err)
+	}
+	return nil
+}
+
+func parseCommit(line string) (forge.Commit, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 2 {
+		return forge.Commit{}, fmt.Errorf("could not parse commit: %q", line)
+	}
+	t, err := time.Parse(time.RFC3339, fields[1])
+	if err != nil {
+		return forge.Commit{}, fmt.Errorf("%w: could not parse date", err)
+	}
+	return forge.Commit{Id: fields[0], Time: t.UTC()}, nil
+}
+
+func (m *mirror) Tags() ([]forge.Tag, error) {
+	// annotated tags are peeled to the tagged commit
+	if err := m.update(); err != nil {
+		return nil, err
+	}
+	out, err := git(m.dir, "for-each-ref", "refs/tags",
+		"--format=%(refname:strip=2) %(if)%(*objectname)%(then)%(*objectname) %(*committerdate:iso-strict)%(else)%(objectname) %(committerdate:iso-strict)%(end)")
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not list tags", err)
+	}
+	var tags []forge.Tag
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		c, err := parseCommit(fields[1])
+		if err != nil {
+			// tags of trees and blobs have no commit date
+			continue
+		}
+		tags = append(tags, forge.Tag{Name: fields[0], Commit: c})
+	}
+	return tags, nil
+}
+
+func (m *mirror) Head() (forge.Commit, error) {
+	return m.Commit("HEAD")
+}
+
+func (m *mirror) Commit(ref string) (forge.Commit, error) {
+	if ref == "" || strings.HasPrefix(ref, "-") {
+		return forge.Commit{}, nil
+	}
+	if err := m.update(); err != nil {
+		return forge.Commit{}, err
+	}
+	out, err := git(m.dir, "log", "-1", "--format=%H %cI", ref+"^{commit}", "--")
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return forge.Commit{}, fmt.Errorf("%w: unknown revision %s", forge.ErrNotFound, ref)
+	}
+	if err != nil {
+		return forge.Commit{}, err
+	}
+	return parseCommit(string(out))
+}
+
+func (m *mirror) IsAncestor(ancestor, commit string) (bool, error) {
+	if err := m.update(); err != nil {
+		return false, err
+	}
+	_, err := git(m.dir, "merge-base", "--is-ancestor", ancestor, commit)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (m *mirror) File(ref, filePath string) ([]byte, error) {
+	if strings.HasPrefix(ref, "-") {
+		return nil, fmt.Errorf("%w: invalid revision %s", forge.ErrNotFound, ref)
+	}
+	if err := m.update(); err != nil {
+		return nil, err
+	}
+	out, err := git(m.dir, "cat-file", "blob", ref+":"+filePath)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return nil, fmt.Errorf("%w: %s not found at %s", forge.ErrNotFound, filePath, ref)
+	}
+	return out, err
+}
+
+func (m *mirror) Archive(ref string) ([]byte, error) {
+	if strings.HasPrefix(ref, "-") {
+		return nil, fmt.Errorf("%w: invalid revision %s", forge.ErrNotFound, ref)
+	}
+	if err := m.update(); err != nil {
+		return nil, err
+	}
+	// files are archived as committed, without line ending conversion
+	// from the local git config
+	out, err := git(m.dir, "-c", "core.autocrlf=input", "-c", "core.eol=lf", "archive", "--format=zip", "--prefix=repo/", ref)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return nil, fmt.Errorf("%w: could not archive %s", forge.ErrNotFound, ref)
+	}
+	return out, err
+}
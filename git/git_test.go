@@ -0,0 +1,272 @@
+package git
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wozz/modpox/forge/forgetest"
+	"golang.org/x/mod/module"
+)
+
+type modInfo struct {
+	Version string
+	Time    string
+}
+
+// remotes links repositories into a directory served through file:// urls
+func remotes(t *testing.T, repos map[string]*forgetest.Repo) string {
+	t.Helper()
+	root := t.TempDir()
+	for repoPath, repo := range repos {
+		link := filepath.Join(root, filepath.FromSlash(repoPath))
+		if err := os.MkdirAll(filepath.Dir(link), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(repo.Dir, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestGitUpstream(t *testing.T) {
+	repo := forgetest.NewRepo(t)
+	tagged := repo.Commit(map[string]string{
+		"go.mod": "module git.example.com/group/sub/lib\n",
+		"a.go":   "package lib\n",
+	})
+	repo.Tag("v1.0.0")
+	repo.Git("tag", "-a", "-m", "annotated", "v1.1.0")
+	main := repo.Commit(map[string]string{"b.go": "package lib\n"})
+	empty := forgetest.NewRepo(t)
+	root := remotes(t, map[string]*forgetest.Repo{"group/sub/lib": repo, "group/empty": empty})
+
+	p := NewGitUpstream(&Config{
+		ModulePrefix: "git.example.com",
+		Remote:       "file://" + filepath.ToSlash(root) + "/{repo}",
+		CacheDir:     t.TempDir(),
+		// fetch on every request
+		FetchInterval: time.Nanosecond,
+	})
+	get := func(t *testing.T, key string, wantStatus int) string {
+		t.Helper()
+		b, status, err := p.Get(key)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", key, err)
+		}
+		if status != wantStatus {
+			t.Fatalf("%s: got status %d, want %d: %s", key, status, wantStatus, b)
+		}
+		return string(b)
+	}
+	info := func(t *testing.T, key string) modInfo {
+		t.Helper()
+		var i modInfo
+		if err := json.Unmarshal([]byte(get(t, key, http.StatusOK)), &i); err != nil {
+			t.Fatal(err)
+		}
+		return i
+	}
+	const mod = "/git.example.com/group/sub/lib"
+
+	t.Run("list and latest", func(t *testing.T) {
+		if got := get(t, mod+"/@v/list", http.StatusOK); got != "v1.0.0\nv1.1.0\n" {
+			t.Errorf("unexpected list: %q", got)
+		}
+		if got := info(t, mod+"/@latest"); got.Version != "v1.1.0" || got.Time == "" {
+			t.Errorf("unexpected latest: %v", got)
+		}
+		get(t, "/git.example.com/group/empty/@latest", http.StatusGone)
+	})
+	t.Run("info queries", func(t *testing.T) {
+		if got := info(t, mod+"/@v/"+tagged[:7]+".info"); got.Version != "v1.1.0" {
+			t.Errorf("short hash of tagged commit should resolve to the highest tag, got %v", got)
+		}
+		got := info(t, mod+"/@v/main.info")
+		if !module.IsPseudoVersion(got.Version) || !strings.HasPrefix(got.Version, "v1.1.1-0.") || !strings.HasSuffix(got.Version, main[:12]) {
+			t.Errorf("unexpected branch info: %v", got)
+		}
+		get(t, mod+"/@v/does-not-exist.info", http.StatusNotFound)
+		get(t, mod+"/@v/--upload-pack=x.info", http.StatusNotFound)
+	})
+	t.Run("mod and zip", func(t *testing.T) {
+		if got := get(t, mod+"/@v/v1.0.0.mod", http.StatusOK); got != "module git.example.com/group/sub/lib\n" {
+			t.Errorf("unexpected go.mod: %q", got)
+		}
+		get(t, mod+"/@v/v1.1.0.zip", http.StatusOK)
+		get(t, mod+"/@v/v9.9.9.mod", http.StatusNotFound)
+		get(t, mod+"/@v/v9.9.9.zip", http.StatusNotFound)
+	})
+	t.Run("incremental fetch", func(t *testing.T) {
+		repo.Tag("v1.2.0")
+		if got := get(t, mod+"/@v/list", http.StatusOK); got != "v1.0.0\nv1.1.0\nv1.2.0\n" {
+			t.Errorf("new tag not fetched: %q", got)
+		}
+	})
+	t.Run("not found", func(t *testing.T) {
+		get(t, "/git.example.com/group/missing/@v/list", http.StatusNotFound)
+		get(t, "/git.example.com/group/sub/lib/nested/@v/list", http.StatusNotFound)
+	})
+	t.Run("offline", func(t *testing.T) {
+		if err := os.Remove(filepath.Join(root, "group", "sub", "lib")); err != nil {
+			t.Fatal(err)
+		}
+		if got := get(t, mod+"/@v/list", http.StatusOK); got != "v1.0.0\nv1.1.0\nv1.2.0\n" {
+			t.Errorf("mirror not used while remote is unreachable: %q", got)
+		}
+	})
+}
+
+func TestGitUpstreamConcurrency(t *testing.T) {
+	repos := make(map[string]*forgetest.Repo)
+	for _, name := range []string{"a", "b", "c", "d"} {
+		repo := forgetest.NewRepo(t)
+		repo.Commit(map[string]string{"go.mod": "module git.example.com/" + name + "\n"})
+		repo.Tag("v0.1.0")
+		repos[name] = repo
+	}
+	root := remotes(t, repos)
+	p := NewGitUpstream(&Config{
+		ModulePrefix:   "git.example.com",
+		Remote:         "file://" + filepath.ToSlash(root) + "/{repo}",
+		CacheDir:       t.TempDir(),
+		MaxConcurrency: 1,
+	})
+	var wg sync.WaitGroup
+	for name := range repos {
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func(name string) {
+				defer wg.Done()
+				b, status, err := p.Get("/git.example.com/" + name + "/@v/list")
+				if err != nil || status != http.StatusOK || string(b) != "v0.1.0\n" {
+					t.Errorf("%s: unexpected response: %d %q %v", name, status, b, err)
+				}
+			}(name)
+		}
+	}
+	wg.Wait()
+}
+
+func TestGitUpstreamMissing(t *testing.T) {
+	root := remotes(t, nil)
+	p := NewGitUpstream(&Config{
+		ModulePrefix:  "git.example.com",
+		Remote:        "file://" + filepath.ToSlash(root) + "/{repo}",
+		CacheDir:      t.TempDir(),
+		FetchInterval: time.Hour,
+	}).(*gitUpstream)
+	const key = "/git.example.com/new/@v/list"
+	status := func() int {
+		t.Helper()
+		_, status, err := p.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return status
+	}
+	if got := status(); got != http.StatusNotFound {
+		t.Fatalf("expected missing repository, got %d", got)
+	}
+
+	repo := forgetest.NewRepo(t)
+	repo.Commit(map[string]string{"go.mod": "module git.example.com/new\n"})
+	repo.Tag("v1.0.0")
+	if err := os.Symlink(repo.Dir, filepath.Join(root, "new")); err != nil {
+		t.Fatal(err)
+	}
+	// missing repositories are not looked up again within the fetch interval
+	if got := status(); got != http.StatusNotFound {
+		t.Errorf("expected missing repository to be cached, got %d", got)
+	}
+	p.mu.Lock()
+	p.missing["new"] = time.Now().Add(-time.Hour)
+	p.mu.Unlock()
+	if got := status(); got != http.StatusOK {
+		t.Errorf("expected repository to be found after the fetch interval, got %d", got)
+	}
+	if len(p.missing) != 0 {
+		t.Errorf("expected expired entries to be removed: %v", p.missing)
+	}
+}
+
+func TestGitArchiveLineEndings(t *testing.T) {
+	// a global autocrlf setting must not change the zips served
+	config := filepath.Join(t.TempDir(), "gitconfig")
+	if err := os.WriteFile(config, []byte("[core]\n\tautocrlf = true\n\teol = crlf\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GIT_CONFIG_GLOBAL", config)
+	repo := forgetest.NewRepo(t)
+	repo.Commit(map[string]string{
+		"go.mod": "module git.example.com/lib\n",
+		"a.go":   "package lib\n\nfunc A() {}\n",
+	})
+	repo.Tag("v1.0.0")
+	root := remotes(t, map[string]*forgetest.Repo{"lib": repo})
+	p := NewGitUpstream(&Config{
+		ModulePrefix: "git.example.com",
+		Remote:       "file://" + filepath.ToSlash(root) + "/{repo}",
+		CacheDir:     t.TempDir(),
+	})
+	b, status, err := p.Get("/git.example.com/lib/@v/v1.0.0.zip")
+	if err != nil || status != http.StatusOK {
+		t.Fatalf("unexpected response: %d %v", status, err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := io.ReadAll(rc)
+		rc.Close()
+		if bytes.Contains(content, []byte("\r\n")) {
+			t.Errorf("%s: line endings were converted: %q", f.Name, content)
+		}
+	}
+}
+
+func TestGitUpstreamBasicAuth(t *testing.T) {
+	repo := forgetest.NewRepo(t)
+	repo.Commit(map[string]string{"go.mod": "module git.example.com/group/lib\n"})
+	repo.Tag("v1.0.0")
+	root := remotes(t, map[string]*forgetest.Repo{"group/lib.git": repo})
+	srv := forgetest.NewGitServer(t, root, "deployer", "secret")
+
+	password := "wrong"
+	p := NewGitUpstream(&Config{
+		ModulePrefix: "git.example.com",
+		Remote:       srv.URL + "/{repo}.git",
+		CacheDir:     t.TempDir(),
+		BasicAuth: func() (string, string, error) {
+			return "deployer", password, nil
+		},
+	}).(*gitUpstream)
+	const key = "/git.example.com/group/lib/@v/list"
+	if _, status, _ := p.Get(key); status != http.StatusNotFound {
+		t.Errorf("expected rejected credentials to fail, got %d", status)
+	}
+	p.mu.Lock()
+	p.missing = make(map[string]time.Time)
+	p.mu.Unlock()
+	password = "secret"
+	if b, status, err := p.Get(key); err != nil || status != http.StatusOK || string(b) != "v1.0.0\n" {
+		t.Errorf("unexpected list: %d %q %v", status, b, err)
+	}
+	if config, err := os.ReadFile(filepath.Join(p.mirrors["group/lib"].dir, "config")); err != nil || strings.Contains(string(config), "Basic") {
+		t.Errorf("credentials stored in the mirror config: %v\n%s", err, config)
+	}
+}
@@ -0,0 +1,267 @@
+// Package gitea implements an upstream for private repositories on gitea and
+// forgejo instances using the v1 api. Ancestry checks use the compare
+// endpoint, which requires gitea 1.19 or newer.
+package gitea
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/wozz/modpox/forge"
+	"github.com/wozz/modpox/upstream"
+	"golang.org/x/mod/module"
+)
+
+// perPage is the page size for list requests
+const perPage = 50
+
+// Config is used to configure the gitea upstream
+type Config struct {
+	Upstream upstream.Upstream
+	// Host is the host of the gitea or forgejo instance
+	Host string
+	// Token is an access token with read access to the repositories
+	Token string
+	// Transport is used for api requests, defaults to http.DefaultTransport
+	Transport http.RoundTripper
+	// ModulePrefix is the module path prefix served from this instance,
+	// defaults to Host
+	ModulePrefix string
+}
+
+type privateGiteaUpstream struct {
+	host     string
+	prefix   string
+	token    string
+	client   *http.Client
+	upstream upstream.Upstream
+}
+
+// NewGiteaUpstream creates a new upstream for a private gitea or forgejo
+// instance
+func NewGiteaUpstream(config *Config) upstream.Upstream {
+	prefix := config.ModulePrefix
+	if prefix == "" {
+		prefix = config.Host
+	}
+	return &privateGiteaUpstream{
+		host:   config.Host,
+		prefix: prefix,
+		token:  config.Token,
+		client: &http.Client{
+			Timeout: time.Minute,
+			Transport: &forge.Transport{
+				Hosts: map[string]bool{config.Host: true},
+				Base:  config.Transport,
+			},
+		},
+		upstream: config.Upstream,
+	}
+}
+
+func (p *privateGiteaUpstream) Get(key string) ([]byte, int, error) {
+	if strings.HasPrefix(key, fmt.Sprintf("/%s/", p.prefix)) {
+		log.Printf("query private gitea for %s", key)
+		b, status, err := p.handle(key)
+		var apiErr *forge.APIError
+		if errors.As(err, &apiErr) {
+			log.Printf("gitea api error: %s %v", key, err)
+			return apiErr.ClientError()
+		}
+		return b, status, err
+	}
+	return p.upstream.Get(key)
+}
+
+func (p *privateGiteaUpstream) handle(key string) ([]byte, int, error) {
+	modPath, err := forge.ParseModulePath(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	repo, err := p.repo(modPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	return forge.Serve(repo, key)
+}
+
+// Status implements upstream.StatusUpstream
+func (p *privateGiteaUpstream) Status(modulePath string) (*upstream.ModuleStatus, error) {
+	if !strings.HasPrefix(modulePath, p.prefix+"/") {
+		return nil, nil
+	}
+	repo, err := p.repo(modulePath)
+	if err != nil {
+		return nil, err
+	}
+	return forge.Status(repo, modulePath)
+}
+
+// repo returns the repository serving modPath. Modules are served from the
+// root of an owner/repo repository, optionally with a major version suffix.
+func (p *privateGiteaUpstream) repo(modPath string) (*giteaRepo, error) {
+	pathPrefix, _, ok := module.SplitPathVersion(modPath)
+	if !ok || !strings.HasPrefix(pathPrefix, p.prefix+"/") {
+		return nil, &forge.APIError{Forge: "gitea", Status: http.StatusNotFound, Message: fmt.Sprintf("path not served by this upstream: %s", modPath)}
+	}
+	parts := strings.Split(strings.TrimPrefix(pathPrefix, p.prefix+"/"), "/")
+	if len(parts) != 2 {
+		return nil, &forge.APIError{Forge: "gitea", Status: http.StatusNotFound, Message: fmt.Sprintf("no gitea repository found for %s", modPath)}
+	}
+	return &giteaRepo{p: p, path: url.PathEscape(parts[0]) + "/" + url.PathEscape(parts[1])}, nil
+}
+
+type commitInfo struct {
+	Sha     string    `json:"sha"`
+	Created time.Time `json:"created"`
+}
+
+// giteaRepo implements forge.Repo with the gitea repository api
+type giteaRepo struct {
+	p *privateGiteaUpstream
+	// path is the escaped owner/repo
+	path string
+}
+
+func (r *giteaRepo) apiReq(format string, args ...interface{}) ([]byte, http.Header, error) {
+	return r.p.apiReq(fmt.Sprintf("https://%s/api/v1/repos/%s/", r.p.host, r.path) + fmt.Sprintf(format, args...))
+}
+
+func (r *giteaRepo) Tags() ([]forge.Tag, error) {
+	var tags []forge.Tag
+	next := fmt.Sprintf("https://%s/api/v1/repos/%s/tags?limit=%d", r.p.host, r.path, perPage)
+	for next != "" {
+		tagData, header, err := r.p.apiReq(next)
+		if err != nil {
+			return nil, fmt.Errorf("%w: could not make api req", err)
+		}
+		tList := []struct {
+			Name   string     `json:"name"`
+			Commit commitInfo `json:"commit"`
+		}{}
+		if err := json.Unmarshal(tagData, &tList); err != nil {
+			return nil, fmt.Errorf("%w: could not parse json response", err)
+		}
+		for _, t := range tList {
+			tags = append(tags, forge.Tag{Name: t.Name, Commit: forge.Commit{Id: t.Commit.Sha, Time: t.Commit.Created}})
+		}
+		next = forge.NextLink(header)
+	}
+	return tags, nil
+}
+
+// commits returns the latest commit reachable from ref, or from the default
+// branch if ref is empty
+func (r *giteaRepo) commits(ref string) (forge.Commit, error) {
+	queryParams := &url.Values{
+		"limit":        []string{"1"},
+		"stat":         []string{"false"},
+		"verification": []string{"false"},
+		"files":        []string{"false"},
+	}
+	if ref != "" {
+		queryParams.Set("sha", ref)
+	}
+	commitData, _, err := r.apiReq("commits?%s", queryParams.Encode())
+	var apiErr *forge.APIError
+	if errors.As(err, &apiErr) && apiErr.Status == http.StatusConflict {
+		// gitea responds with 409 Conflict for empty repositories
+		return forge.Commit{}, fmt.Errorf("%w: %s", forge.ErrNotFound, apiErr.Message)
+	}
+	if err != nil {
+		return forge.Commit{}, fmt.Errorf("%w: could not make api request for commits", err)
+	}
+	var cList []commitInfo
+	if err := json.Unmarshal(commitData, &cList); err != nil {
+		return forge.Commit{}, fmt.Errorf("%w: could not parse json response", err)
+	}
+	if len(cList) == 0 {
+		return forge.Commit{}, fmt.Errorf("%w: no commits", forge.ErrNotFound)
+	}
+	return forge.Commit{Id: cList[0].Sha, Time: cList[0].Created}, nil
+}
+
+func (r *giteaRepo) Head() (forge.Commit, error) {
+	return r.commits("")
+}
+
+func (r *giteaRepo) Commit(ref string) (forge.Commit, error) {
+	return r.commits(ref)
+}
+
+// IsAncestor compares in reverse: ancestor is reachable from commit if it
+// has no commits that commit doesn't also have
+func (r *giteaRepo) IsAncestor(ancestor, commit string) (bool, error) {
+	compareData, _, err := r.apiReq("compare/%s...%s", url.PathEscape(commit), url.PathEscape(ancestor))
+	if err != nil {
+		return false, fmt.Errorf("%w: could not make api req", err)
+	}
+	compare := struct {
+		TotalCommits int `json:"total_commits"`
+	}{}
+	if err := json.Unmarshal(compareData, &compare); err != nil {
+		return false, fmt.Errorf("%w: could not parse json response", err)
+	}
+	return compare.TotalCommits == 0, nil
+}
+
+func (r *giteaRepo) File(ref, filename string) ([]byte, error) {
+	parts := strings.Split(filename, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	queryParams := &url.Values{
+		"ref": []string{ref},
+	}
+	content, _, err := r.apiReq("raw/%s?%s", strings.Join(parts, "/"), queryParams.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not make api req for raw file", err)
+	}
+	return content, nil
+}
+
+func (r *giteaRepo) Archive(ref string) ([]byte, error) {
+	rawZip, _, err := r.apiReq("archive/%s.zip", url.PathEscape(ref))
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not make api req", err)
+	}
+	return rawZip, nil
+}
+
+func (p *privateGiteaUpstream) apiReq(reqURL string) ([]byte, http.Header, error) {
+	req, err := http.NewRequest(http.MethodGet, reqURL, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: could not make request", err)
+	}
+	if p.token != "" {
+		req.Header.Set("Authorization", "token "+p.token)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: could not perform request", err)
+	}
+	defer resp.Body.Close()
+	var b bytes.Buffer
+	if _, err := io.Copy(&b, resp.Body); err != nil {
+		return nil, nil, fmt.Errorf("%w: could not copy response", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg := struct {
+			Message string `json:"message"`
+		}{}
+		message := b.String()
+		if json.Unmarshal(b.Bytes(), &msg) == nil && msg.Message != "" {
+			message = msg.Message
+		}
+		return nil, nil, &forge.APIError{Forge: "gitea", Status: resp.StatusCode, Message: message}
+	}
+	return b.Bytes(), resp.Header, nil
+}
@@ -0,0 +1,47 @@
+package gitea
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/wozz/modpox/forge/forgetest"
+	"github.com/wozz/modpox/gitea/giteatest"
+)
+
+func TestGiteaUpstream(t *testing.T) {
+	fake := giteatest.NewServer()
+	defer fake.Close()
+	fake.Token = "token"
+
+	repo := forgetest.NewRepo(t)
+	repo.Commit(map[string]string{"go.mod": "module gitea.example.com/org/project\n"})
+	repo.Tag("v1.0.0")
+	fake.AddRepo("org/project", repo.Dir)
+	fake.AddRepo("org/empty", forgetest.NewRepo(t).Dir)
+
+	p := NewGiteaUpstream(&Config{
+		Host:         fake.Host(),
+		ModulePrefix: "gitea.example.com",
+		Token:        "token",
+		Transport:    fake.Client().Transport,
+	})
+	const mod = "/gitea.example.com/org/project"
+
+	t.Run("api paths", func(t *testing.T) {
+		forgetest.Check(t, p, []forgetest.Request{
+			{Key: mod + "/@v/list", Status: http.StatusOK, Body: "v1.0.0\n"},
+			{Key: mod + "/@v/v1.0.0.mod", Status: http.StatusOK, Body: "module gitea.example.com/org/project\n"},
+			{Key: mod + "/@v/v1.0.0.zip", Status: http.StatusOK},
+			{Key: "/gitea.example.com/org/empty/@latest", Status: http.StatusGone},
+			{Key: "/gitea.example.com/org/missing/@v/list", Status: http.StatusNotFound},
+			{Key: "/gitea.example.com/org/@v/list", Status: http.StatusNotFound},
+		})
+	})
+	t.Run("error mapping", func(t *testing.T) {
+		fake.Token = "rotated"
+		defer func() { fake.Token = "token" }()
+		forgetest.Check(t, p, []forgetest.Request{
+			{Key: mod + "/@v/v1.0.0.info", Status: http.StatusBadGateway},
+		})
+	})
+}
@@ -0,0 +1,200 @@
+// Package giteatest provides an in-memory fake of the gitea v1 api backed by
+// local git repositories, for testing the gitea upstream without a real
+// gitea instance.
+package giteatest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wozz/modpox/forge/forgetest"
+)
+
+// Server is a fake gitea api. Repositories are served from local git
+// repositories added with AddRepo.
+type Server struct {
+	*httptest.Server
+
+	// Token is the access token required for api requests, if set
+	Token string
+
+	mu    sync.Mutex
+	repos map[string]string
+}
+
+// NewServer starts a fake gitea api over TLS. Use Client().Transport to
+// make requests that trust its certificate.
+func NewServer() *Server {
+	s := &Server{repos: make(map[string]string)}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Host returns the host:port of the server
+func (s *Server) Host() string {
+	u, _ := url.Parse(s.URL)
+	return u.Host
+}
+
+// AddRepo serves the git repository in dir as owner/repo
+func (s *Server) AddRepo(fullName, dir string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.repos[fullName] = dir
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"message": message})
+}
+
+type commitJSON struct {
+	Sha     string `json:"sha"`
+	Created string `json:"created"`
+}
+
+func toJSON(c forgetest.Commit) commitJSON {
+	return commitJSON{Sha: c.Sha, Created: c.Time.Format(time.RFC3339)}
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	if s.Token != "" && r.Header.Get("Authorization") != "token "+s.Token {
+		writeError(w, http.StatusUnauthorized, "token is required")
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/api/v1/"), "/")
+	if len(parts) < 4 || parts[0] != "repos" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	s.mu.Lock()
+	dir, ok := s.repos[parts[1]+"/"+parts[2]]
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "repository does not exist")
+		return
+	}
+	rest := make([]string, 0, len(parts)-4)
+	for _, part := range parts[4:] {
+		unescaped, _ := url.PathUnescape(part)
+		rest = append(rest, unescaped)
+	}
+	query := r.URL.Query()
+	switch parts[3] {
+	case "tags":
+		s.tags(w, r, dir)
+	case "commits":
+		ref := query.Get("sha")
+		if ref == "" {
+			if _, ok := forgetest.Resolve(dir, "HEAD"); !ok {
+				writeError(w, http.StatusConflict, "Git Repository is empty.")
+				return
+			}
+			ref = "HEAD"
+		}
+		c, ok := forgetest.Resolve(dir, ref)
+		if !ok {
+			writeError(w, http.StatusNotFound, "sha not found")
+			return
+		}
+		writeJSON(w, http.StatusOK, []commitJSON{toJSON(c)})
+	case "compare":
+		refs := strings.SplitN(strings.Join(rest, "/"), "...", 2)
+		if len(refs) != 2 {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+		base, bok := forgetest.Resolve(dir, refs[0])
+		head, hok := forgetest.Resolve(dir, refs[1])
+		if !bok || !hok {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+		commits := []commitJSON{}
+		for _, c := range forgetest.RevList(dir, base.Sha, head.Sha) {
+			commits = append(commits, toJSON(c))
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"total_commits": len(commits), "commits": commits})
+	case "raw":
+		ref := query.Get("ref")
+		if ref == "" {
+			ref = "HEAD"
+		}
+		c, ok := forgetest.Resolve(dir, ref)
+		if !ok {
+			writeError(w, http.StatusNotFound, "ref not found")
+			return
+		}
+		content, ok := forgetest.Show(dir, c.Sha, strings.Join(rest, "/"))
+		if !ok {
+			writeError(w, http.StatusNotFound, "file not found")
+			return
+		}
+		w.Write(content)
+	case "archive":
+		ref := strings.TrimSuffix(strings.Join(rest, "/"), ".zip")
+		c, ok := forgetest.Resolve(dir, ref)
+		if !ok {
+			writeError(w, http.StatusNotFound, "ref not found")
+			return
+		}
+		out, err := forgetest.Archive(dir, c.Sha, path.Base(parts[2])+"/")
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/zip")
+		w.Write(out)
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (s *Server) tags(w http.ResponseWriter, r *http.Request, dir string) {
+	type tagJSON struct {
+		Name   string     `json:"name"`
+		Commit commitJSON `json:"commit"`
+	}
+	tags := []tagJSON{}
+	for _, name := range forgetest.Tags(dir) {
+		if c, ok := forgetest.Resolve(dir, "refs/tags/"+name); ok {
+			tags = append(tags, tagJSON{Name: name, Commit: toJSON(c)})
+		}
+	}
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit <= 0 || limit > 50 {
+		limit = 50
+	}
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	start, end := (page-1)*limit, page*limit
+	if start > len(tags) {
+		start = len(tags)
+	}
+	if end < len(tags) {
+		next := *r.URL
+		next.Scheme, next.Host = "https", r.Host
+		q := next.Query()
+		q.Set("page", strconv.Itoa(page+1))
+		next.RawQuery = q.Encode()
+		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, next.String()))
+	} else {
+		end = len(tags)
+	}
+	writeJSON(w, http.StatusOK, tags[start:end])
+}
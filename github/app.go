@@ -0,0 +1,146 @@
+package github
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// jwtLifetime is the lifetime of app jwts, github allows at most 10
+	// minutes
+	jwtLifetime = 9 * time.Minute
+	// tokenRefresh is how long before expiry installation tokens are renewed
+	tokenRefresh = 5 * time.Minute
+)
+
+// appTokenSource creates and caches installation access tokens for a
+// github app
+type appTokenSource struct {
+	appID          int64
+	installationID int64
+	keyPEM         []byte
+	keyFile        string
+	apiURL         string
+	client         *http.Client
+
+	mu      sync.Mutex
+	key     *rsa.PrivateKey
+	token   string
+	expires time.Time
+}
+
+// parsePrivateKey parses a PEM encoded PKCS#1 or PKCS#8 RSA private key as
+// downloaded from the github app settings
+func parsePrivateKey(b []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in private key")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not parse private key", err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// jwt returns a jwt signed with the app's private key, used to request
+// installation tokens
+func (a *appTokenSource) jwt(now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]int64{
+		// backdate to allow for clock drift
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(jwtLifetime).Unix(),
+		"iss": a.appID,
+	})
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("%w: could not sign jwt", err)
+	}
+	return signed + "." + enc.EncodeToString(sig), nil
+}
+
+// get returns a valid installation token, requesting a new one if the
+// cached token is close to expiry
+func (a *appTokenSource) get() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	if a.token != "" && now.Add(tokenRefresh).Before(a.expires) {
+		return a.token, nil
+	}
+	if a.key == nil {
+		keyPEM := a.keyPEM
+		if a.keyFile != "" {
+			b, err := os.ReadFile(a.keyFile)
+			if err != nil {
+				return "", fmt.Errorf("%w: could not read private key file", err)
+			}
+			keyPEM = b
+		}
+		key, err := parsePrivateKey(keyPEM)
+		if err != nil {
+			return "", err
+		}
+		a.key = key
+	}
+	jwt, err := a.jwt(now)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/app/installations/%d/access_tokens", a.apiURL, a.installationID), nil)
+	if err != nil {
+		return "", fmt.Errorf("%w: could not make request", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("%w: could not request installation token", err)
+	}
+	defer resp.Body.Close()
+	var b bytes.Buffer
+	if _, err := b.ReadFrom(resp.Body); err != nil {
+		return "", fmt.Errorf("%w: could not read response", err)
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return "", newAPIError(resp, b.Bytes())
+	}
+	token := struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}{}
+	if err := json.Unmarshal(b.Bytes(), &token); err != nil {
+		return "", fmt.Errorf("%w: could not parse installation token", err)
+	}
+	a.token, a.expires = token.Token, token.ExpiresAt
+	return a.token, nil
+}
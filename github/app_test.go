@@ -0,0 +1,78 @@
+package github
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"testing"
+
+	"github.com/wozz/modpox/forge/forgetest"
+	"github.com/wozz/modpox/github/githubtest"
+)
+
+func TestAppInstallationToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := githubtest.NewServer()
+	defer fake.Close()
+	fake.Token = "not-used"
+	fake.SetApp(42, 7, &key.PublicKey)
+
+	repo := forgetest.NewRepo(t)
+	repo.Commit(map[string]string{"go.mod": "module github.example.com/org/app\n"})
+	repo.Tag("v0.1.0")
+	fake.AddRepo("org/app", repo.Dir)
+
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := map[string][]byte{
+		"pkcs1": pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
+		"pkcs8": pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}),
+	}
+	for name, keyPEM := range keys {
+		t.Run(name, func(t *testing.T) {
+			issued := fake.InstallationTokens()
+			p := NewGitHubUpstream(&Config{
+				Host:           fake.Host(),
+				ModulePrefix:   "github.example.com",
+				AppID:          42,
+				InstallationID: 7,
+				PrivateKey:     keyPEM,
+				Transport:      fake.Client().Transport,
+			})
+			for i := 0; i < 2; i++ {
+				b, status, err := p.Get("/github.example.com/org/app/@v/list")
+				if err != nil || status != http.StatusOK || string(b) != "v0.1.0\n" {
+					t.Fatalf("unexpected response: %d %q %v", status, b, err)
+				}
+			}
+			if got := fake.InstallationTokens() - issued; got != 1 {
+				t.Errorf("expected the installation token to be reused, %d issued", got)
+			}
+		})
+	}
+
+	t.Run("wrong key", func(t *testing.T) {
+		other, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := NewGitHubUpstream(&Config{
+			Host:           fake.Host(),
+			ModulePrefix:   "github.example.com",
+			AppID:          42,
+			InstallationID: 7,
+			PrivateKey:     pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(other)}),
+			Transport:      fake.Client().Transport,
+		})
+		if _, status, _ := p.Get("/github.example.com/org/app/@v/list"); status != http.StatusBadGateway {
+			t.Errorf("expected rejected app credentials to map to 502, got %d", status)
+		}
+	})
+}
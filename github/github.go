@@ -0,0 +1,343 @@
+// Package github implements an upstream for private repositories on
+// github.com and GitHub Enterprise Server using the REST api
+package github
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/wozz/modpox/forge"
+	"github.com/wozz/modpox/upstream"
+	"golang.org/x/mod/module"
+)
+
+const (
+	publicHost   = "github.com"
+	publicAPIURL = "https://api.github.com"
+	apiVersion   = "2022-11-28"
+	// perPage is the page size for list requests, the maximum github allows
+	perPage = 100
+)
+
+// Config is used to configure the github upstream
+type Config struct {
+	Upstream upstream.Upstream
+	// Host is github.com or the host of a GitHub Enterprise Server instance
+	Host string
+	// APIURL defaults to https://api.github.com for github.com and to
+	// https://<Host>/api/v3 otherwise
+	APIURL string
+	// Token is a personal access token, used if no github app is configured
+	Token string
+	// AppID and InstallationID authenticate as a github app installation
+	// with installation access tokens, which are renewed before they expire
+	AppID          int64
+	InstallationID int64
+	// PrivateKey is the PEM encoded private key of the github app, or
+	// PrivateKeyFile the path to it
+	PrivateKey     []byte
+	PrivateKeyFile string
+	// Transport is used for api requests, defaults to http.DefaultTransport
+	Transport http.RoundTripper
+	// ModulePrefix is the module path prefix served from this github
+	// instance, defaults to Host
+	ModulePrefix string
+}
+
+type privateGitHubUpstream struct {
+	host     string
+	apiURL   string
+	prefix   string
+	client   *http.Client
+	upstream upstream.Upstream
+
+	token string
+	app   *appTokenSource
+}
+
+// NewGitHubUpstream creates a new upstream for private github repositories
+func NewGitHubUpstream(config *Config) upstream.Upstream {
+	host := config.Host
+	if host == "" {
+		host = publicHost
+	}
+	apiURL := strings.TrimSuffix(config.APIURL, "/")
+	if apiURL == "" {
+		apiURL = publicAPIURL
+		if host != publicHost {
+			apiURL = fmt.Sprintf("https://%s/api/v3", host)
+		}
+	}
+	hosts := map[string]bool{
+		host: true,
+		// archives redirect to codeload
+		"codeload." + host: true,
+	}
+	if u, err := url.Parse(apiURL); err == nil {
+		hosts[u.Host] = true
+	}
+	hc := &http.Client{
+		Timeout: time.Minute,
+		Transport: &forge.Transport{
+			Hosts: hosts,
+			Base:  config.Transport,
+		},
+	}
+	prefix := config.ModulePrefix
+	if prefix == "" {
+		prefix = host
+	}
+	p := &privateGitHubUpstream{
+		host:     host,
+		apiURL:   apiURL,
+		prefix:   prefix,
+		client:   hc,
+		upstream: config.Upstream,
+		token:    config.Token,
+	}
+	if config.AppID != 0 {
+		p.app = &appTokenSource{
+			appID:          config.AppID,
+			installationID: config.InstallationID,
+			keyPEM:         config.PrivateKey,
+			keyFile:        config.PrivateKeyFile,
+			apiURL:         apiURL,
+			client:         hc,
+		}
+	}
+	return p
+}
+
+func (p *privateGitHubUpstream) Get(key string) ([]byte, int, error) {
+	if strings.HasPrefix(key, fmt.Sprintf("/%s/", p.prefix)) {
+		log.Printf("query private github for %s", key)
+		b, status, err := p.handle(key)
+		var apiErr *forge.APIError
+		if errors.As(err, &apiErr) {
+			log.Printf("github api error: %s %v", key, err)
+			return apiErr.ClientError()
+		}
+		return b, status, err
+	}
+	return p.upstream.Get(key)
+}
+
+func (p *privateGitHubUpstream) handle(key string) ([]byte, int, error) {
+	modPath, err := forge.ParseModulePath(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	repo, err := p.repo(modPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	return forge.Serve(repo, key)
+}
+
+// Status implements upstream.StatusUpstream
+func (p *privateGitHubUpstream) Status(modulePath string) (*upstream.ModuleStatus, error) {
+	if !strings.HasPrefix(modulePath, p.prefix+"/") {
+		return nil, nil
+	}
+	repo, err := p.repo(modulePath)
+	if err != nil {
+		return nil, err
+	}
+	return forge.Status(repo, modulePath)
+}
+
+// repo returns the repository serving modPath. Modules are served from the
+// root of an owner/repo repository, optionally with a major version suffix.
+func (p *privateGitHubUpstream) repo(modPath string) (*githubRepo, error) {
+	pathPrefix, _, ok := module.SplitPathVersion(modPath)
+	if !ok || !strings.HasPrefix(pathPrefix, p.prefix+"/") {
+		return nil, &forge.APIError{Forge: "github", Status: http.StatusNotFound, Message: fmt.Sprintf("path not served by this upstream: %s", modPath)}
+	}
+	parts := strings.Split(strings.TrimPrefix(pathPrefix, p.prefix+"/"), "/")
+	if len(parts) != 2 {
+		return nil, &forge.APIError{Forge: "github", Status: http.StatusNotFound, Message: fmt.Sprintf("no github repository found for %s", modPath)}
+	}
+	return &githubRepo{p: p, path: url.PathEscape(parts[0]) + "/" + url.PathEscape(parts[1])}, nil
+}
+
+type commitInfo struct {
+	Sha    string `json:"sha"`
+	Commit struct {
+		Committer struct {
+			Date time.Time `json:"date"`
+		} `json:"committer"`
+	} `json:"commit"`
+}
+
+func (c commitInfo) commit() forge.Commit {
+	return forge.Commit{Id: c.Sha, Time: c.Commit.Committer.Date}
+}
+
+// githubRepo implements forge.Repo with the github repository api
+type githubRepo struct {
+	p *privateGitHubUpstream
+	// path is the escaped owner/repo
+	path string
+}
+
+func (r *githubRepo) apiReq(accept, format string, args ...interface{}) ([]byte, http.Header, error) {
+	return r.p.apiReq(fmt.Sprintf("%s/repos/%s/", r.p.apiURL, r.path)+fmt.Sprintf(format, args...), accept)
+}
+
+func (r *githubRepo) Tags() ([]forge.Tag, error) {
+	var tags []forge.Tag
+	next := fmt.Sprintf("%s/repos/%s/tags?per_page=%d", r.p.apiURL, r.path, perPage)
+	for next != "" {
+		tagData, header, err := r.p.apiReq(next, "")
+		if err != nil {
+			return nil, fmt.Errorf("%w: could not make api req", err)
+		}
+		tList := []struct {
+			Name   string `json:"name"`
+			Commit struct {
+				Sha string `json:"sha"`
+			} `json:"commit"`
+		}{}
+		if err := json.Unmarshal(tagData, &tList); err != nil {
+			return nil, fmt.Errorf("%w: could not parse json response", err)
+		}
+		for _, t := range tList {
+			tags = append(tags, forge.Tag{Name: t.Name, Commit: forge.Commit{Id: t.Commit.Sha}})
+		}
+		next = forge.NextLink(header)
+	}
+	return tags, nil
+}
+
+func (r *githubRepo) Head() (forge.Commit, error) {
+	commitData, _, err := r.apiReq("", "commits?per_page=1")
+	var apiErr *forge.APIError
+	if errors.As(err, &apiErr) && apiErr.Status == http.StatusConflict {
+		// github responds with 409 Conflict for empty repositories
+		return forge.Commit{}, fmt.Errorf("%w: %s", forge.ErrNotFound, apiErr.Message)
+	}
+	if err != nil {
+		return forge.Commit{}, fmt.Errorf("%w: could not make api req", err)
+	}
+	var cList []commitInfo
+	if err := json.Unmarshal(commitData, &cList); err != nil {
+		return forge.Commit{}, fmt.Errorf("%w: could not parse json response", err)
+	}
+	if len(cList) == 0 {
+		return forge.Commit{}, fmt.Errorf("%w: no commits", forge.ErrNotFound)
+	}
+	return cList[0].commit(), nil
+}
+
+func (r *githubRepo) Commit(ref string) (forge.Commit, error) {
+	commitData, _, err := r.apiReq("", "commits/%s", url.PathEscape(ref))
+	var apiErr *forge.APIError
+	if errors.As(err, &apiErr) && apiErr.Status == http.StatusUnprocessableEntity {
+		// unknown refs are rejected with 422 No commit found
+		return forge.Commit{}, nil
+	}
+	if err != nil {
+		return forge.Commit{}, fmt.Errorf("%w: could not make api request for commits", err)
+	}
+	var c commitInfo
+	if err := json.Unmarshal(commitData, &c); err != nil {
+		return forge.Commit{}, fmt.Errorf("%w: could not parse json response", err)
+	}
+	return c.commit(), nil
+}
+
+func (r *githubRepo) IsAncestor(ancestor, commit string) (bool, error) {
+	compareData, _, err := r.apiReq("", "compare/%s...%s", url.PathEscape(ancestor), url.PathEscape(commit))
+	if err != nil {
+		return false, fmt.Errorf("%w: could not make api req", err)
+	}
+	compare := struct {
+		Status string `json:"status"`
+	}{}
+	if err := json.Unmarshal(compareData, &compare); err != nil {
+		return false, fmt.Errorf("%w: could not parse json response", err)
+	}
+	return compare.Status == "ahead" || compare.Status == "identical", nil
+}
+
+func (r *githubRepo) File(ref, filename string) ([]byte, error) {
+	parts := strings.Split(filename, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	queryParams := &url.Values{
+		"ref": []string{ref},
+	}
+	content, _, err := r.apiReq("application/vnd.github.raw", "contents/%s?%s", strings.Join(parts, "/"), queryParams.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not make api req for contents", err)
+	}
+	return content, nil
+}
+
+func (r *githubRepo) Archive(ref string) ([]byte, error) {
+	rawZip, _, err := r.apiReq("", "zipball/%s", url.PathEscape(ref))
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not make api req", err)
+	}
+	return rawZip, nil
+}
+
+func newAPIError(resp *http.Response, body []byte) *forge.APIError {
+	msg := struct {
+		Message string `json:"message"`
+	}{}
+	message := string(body)
+	if json.Unmarshal(body, &msg) == nil && msg.Message != "" {
+		message = msg.Message
+	}
+	return &forge.APIError{
+		Forge:   "github",
+		Status:  resp.StatusCode,
+		Message: message,
+		// github signals an exhausted rate limit with either 429 or 403
+		RateLimited: resp.StatusCode == http.StatusForbidden && resp.Header.Get("X-RateLimit-Remaining") == "0",
+	}
+}
+
+func (p *privateGitHubUpstream) apiReq(reqURL, accept string) ([]byte, http.Header, error) {
+	req, err := http.NewRequest(http.MethodGet, reqURL, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: could not make request", err)
+	}
+	if accept == "" {
+		accept = "application/vnd.github+json"
+	}
+	req.Header.Set("Accept", accept)
+	req.Header.Set("X-GitHub-Api-Version", apiVersion)
+	token := p.token
+	if p.app != nil {
+		if token, err = p.app.get(); err != nil {
+			return nil, nil, fmt.Errorf("%w: could not get installation token", err)
+		}
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: could not perform request", err)
+	}
+	defer resp.Body.Close()
+	var b bytes.Buffer
+	if _, err := io.Copy(&b, resp.Body); err != nil {
+		return nil, nil, fmt.Errorf("%w: could not copy response", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, nil, newAPIError(resp, b.Bytes())
+	}
+	return b.Bytes(), resp.Header, nil
+}
@@ -0,0 +1,127 @@
+package github
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/wozz/modpox/forge/forgetest"
+	"github.com/wozz/modpox/github/githubtest"
+	"golang.org/x/mod/module"
+)
+
+type modInfo struct {
+	Version string
+	Time    string
+}
+
+// newTestUpstream starts a fake github serving fixture repositories
+func newTestUpstream(t *testing.T) (*privateGitHubUpstream, *githubtest.Server, map[string]string) {
+	t.Helper()
+	fake := githubtest.NewServer()
+	t.Cleanup(fake.Close)
+	fake.Token = "token"
+	// force pagination of tag lists
+	fake.MaxPerPage = 2
+	commits := make(map[string]string)
+
+	repo := forgetest.NewRepo(t)
+	commits["v1.0.0"] = repo.Commit(map[string]string{
+		"go.mod": "module github.example.com/org/project\n",
+		"a.go":   "package project\n",
+	})
+	repo.Tag("v1.0.0")
+	repo.Tag("release-1")
+	repo.Commit(map[string]string{"b.go": "package project\n"})
+	repo.Tag("v1.1.0-rc.1")
+	repo.Commit(map[string]string{"c.go": "package project\n"})
+	repo.Tag("v1.1.0")
+	repo.Commit(map[string]string{
+		"go.mod": "module github.example.com/org/project\n\nretract v1.2.0 // broken\n",
+	})
+	repo.Tag("v1.2.0")
+	commits["main"] = repo.Commit(map[string]string{"d.go": "package project\n"})
+	fake.AddRepo("org/project", repo.Dir)
+
+	untagged := forgetest.NewRepo(t)
+	commits["untagged"] = untagged.Commit(map[string]string{"a.go": "package untagged\n"})
+	fake.AddRepo("org/untagged", untagged.Dir)
+
+	p := NewGitHubUpstream(&Config{
+		Host:         fake.Host(),
+		ModulePrefix: "github.example.com",
+		Token:        "token",
+		Transport:    fake.Client().Transport,
+	}).(*privateGitHubUpstream)
+	return p, fake, commits
+}
+
+func TestGitHubUpstream(t *testing.T) {
+	p, fake, commits := newTestUpstream(t)
+	get := func(t *testing.T, key string, wantStatus int) string {
+		t.Helper()
+		b, status, err := p.Get(key)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", key, err)
+		}
+		if status != wantStatus {
+			t.Fatalf("%s: got status %d, want %d: %s", key, status, wantStatus, b)
+		}
+		return string(b)
+	}
+	info := func(t *testing.T, key string) modInfo {
+		t.Helper()
+		var i modInfo
+		if err := json.Unmarshal([]byte(get(t, key, http.StatusOK)), &i); err != nil {
+			t.Fatal(err)
+		}
+		return i
+	}
+	const mod = "/github.example.com/org/project"
+
+	t.Run("list", func(t *testing.T) {
+		want := "v1.0.0\nv1.1.0-rc.1\nv1.1.0\nv1.2.0\n"
+		if got := get(t, mod+"/@v/list", http.StatusOK); got != want {
+			t.Errorf("got list %q, want %q", got, want)
+		}
+	})
+	t.Run("latest", func(t *testing.T) {
+		got := info(t, mod+"/@latest")
+		if got.Version != "v1.1.0" || got.Time == "" {
+			t.Errorf("unexpected latest: %v", got)
+		}
+		untagged := info(t, "/github.example.com/org/untagged/@latest")
+		if !module.IsPseudoVersion(untagged.Version) || !strings.HasSuffix(untagged.Version, commits["untagged"][:12]) {
+			t.Errorf("unexpected latest for untagged repo: %v", untagged)
+		}
+	})
+	t.Run("info queries", func(t *testing.T) {
+		if got := info(t, mod+"/@v/"+commits["v1.0.0"][:7]+".info"); got.Version != "v1.0.0" {
+			t.Errorf("short hash of tagged commit should resolve to the tag, got %v", got)
+		}
+		got := info(t, mod+"/@v/main.info")
+		if !strings.HasPrefix(got.Version, "v1.2.1-0.") || !strings.HasSuffix(got.Version, commits["main"][:12]) {
+			t.Errorf("unexpected branch info: %v", got)
+		}
+		get(t, mod+"/@v/does-not-exist.info", http.StatusNotFound)
+	})
+	t.Run("mod and zip", func(t *testing.T) {
+		if got := get(t, mod+"/@v/v1.0.0.mod", http.StatusOK); got != "module github.example.com/org/project\n" {
+			t.Errorf("unexpected go.mod: %q", got)
+		}
+		get(t, mod+"/@v/v1.1.0.zip", http.StatusOK)
+		get(t, mod+"/@v/v9.9.9.mod", http.StatusNotFound)
+		get(t, "/github.example.com/org/untagged/@v/"+info(t, "/github.example.com/org/untagged/@latest").Version+".mod", http.StatusOK)
+	})
+	t.Run("not found", func(t *testing.T) {
+		get(t, "/github.example.com/org/missing/@v/list", http.StatusNotFound)
+		get(t, "/github.example.com/org/project/sub/@v/list", http.StatusNotFound)
+		get(t, "/github.example.com/org/@v/list", http.StatusNotFound)
+	})
+	t.Run("error mapping", func(t *testing.T) {
+		fake.Token = "rotated"
+		defer func() { fake.Token = "token" }()
+		get(t, mod+"/@v/v1.0.0.info", http.StatusBadGateway)
+	})
+}
@@ -0,0 +1,413 @@
+// Package githubtest provides an in-memory fake of the github REST api
+// backed by local git repositories, for testing the github upstream without
+// a real github instance.
+package githubtest
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is a fake GitHub Enterprise Server api, served under /api/v3.
+// Repositories are served from local git repositories added with AddRepo.
+type Server struct {
+	*httptest.Server
+
+	// Token is the token required for api requests, if set
+	Token string
+	// MaxPerPage caps the page size of list requests, defaults to 100
+	MaxPerPage int
+
+	mu    sync.Mutex
+	repos map[string]string
+	app   *app
+	// tokens are the installation tokens issued to the app
+	tokens   map[string]time.Time
+	requests int
+}
+
+type app struct {
+	id             int64
+	installationID int64
+	key            *rsa.PublicKey
+}
+
+// NewServer starts a fake github api over TLS. Use Client().Transport to
+// make requests that trust its certificate.
+func NewServer() *Server {
+	s := &Server{
+		repos:  make(map[string]string),
+		tokens: make(map[string]time.Time),
+	}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Host returns the host:port of the server
+func (s *Server) Host() string {
+	u, _ := url.Parse(s.URL)
+	return u.Host
+}
+
+// AddRepo serves the git repository in dir as owner/repo
+func (s *Server) AddRepo(fullName, dir string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.repos[fullName] = dir
+}
+
+// SetApp registers a github app installation. Installation tokens are
+// issued for jwts signed with the private key matching key.
+func (s *Server) SetApp(appID, installationID int64, key *rsa.PublicKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.app = &app{id: appID, installationID: installationID, key: key}
+}
+
+// InstallationTokens returns the number of installation tokens issued
+func (s *Server) InstallationTokens() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.tokens)
+}
+
+// Requests returns the number of api requests served
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"message": message})
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	auth := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if expires, ok := s.tokens[auth]; ok {
+		return time.Now().Before(expires)
+	}
+	return s.Token == "" || auth == s.Token
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests++
+	s.mu.Unlock()
+	if strings.HasPrefix(r.URL.Path, "/_codeload/") {
+		s.codeload(w, r)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/api/v3/"), "/")
+	if len(parts) == 4 && parts[0] == "app" && parts[1] == "installations" && parts[3] == "access_tokens" && r.Method == http.MethodPost {
+		s.accessToken(w, r, parts[2])
+		return
+	}
+	if !s.authorized(r) {
+		writeError(w, http.StatusUnauthorized, "Bad credentials")
+		return
+	}
+	if len(parts) < 4 || parts[0] != "repos" {
+		writeError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	fullName := parts[1] + "/" + parts[2]
+	s.mu.Lock()
+	dir, ok := s.repos[fullName]
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	repo := &repo{name: fullName, dir: dir}
+	rest := make([]string, 0, len(parts)-4)
+	for _, part := range parts[4:] {
+		unescaped, _ := url.PathUnescape(part)
+		rest = append(rest, unescaped)
+	}
+	query := r.URL.Query()
+	switch parts[3] {
+	case "tags":
+		s.tags(w, r, repo)
+	case "commits":
+		if len(rest) == 0 {
+			repo.commits(w)
+			return
+		}
+		repo.commit(w, strings.Join(rest, "/"))
+	case "compare":
+		repo.compare(w, strings.Join(rest, "/"))
+	case "contents":
+		repo.contents(w, r, strings.Join(rest, "/"), query.Get("ref"))
+	case "zipball":
+		c, ok := repo.resolve(strings.Join(rest, "/"))
+		if !ok {
+			writeError(w, http.StatusNotFound, "Not Found")
+			return
+		}
+		// github redirects archive downloads to codeload
+		http.Redirect(w, r, fmt.Sprintf("/_codeload/%s/legacy.zip/%s", fullName, c.Sha), http.StatusFound)
+	default:
+		writeError(w, http.StatusNotFound, "Not Found")
+	}
+}
+
+// accessToken verifies the app jwt and issues an installation token
+func (s *Server) accessToken(w http.ResponseWriter, r *http.Request, installationID string) {
+	s.mu.Lock()
+	a := s.app
+	s.mu.Unlock()
+	if a == nil || installationID != strconv.FormatInt(a.installationID, 10) {
+		writeError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	jwt := strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), ".")
+	if len(jwt) != 3 {
+		writeError(w, http.StatusUnauthorized, "A JSON web token could not be decoded")
+		return
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(jwt[2])
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, "A JSON web token could not be decoded")
+		return
+	}
+	digest := sha256.Sum256([]byte(jwt[0] + "." + jwt[1]))
+	if err := rsa.VerifyPKCS1v15(a.key, crypto.SHA256, digest[:], sig); err != nil {
+		writeError(w, http.StatusUnauthorized, "A JSON web token could not be decoded")
+		return
+	}
+	claimsJSON, _ := base64.RawURLEncoding.DecodeString(jwt[1])
+	claims := struct {
+		Iat int64 `json:"iat"`
+		Exp int64 `json:"exp"`
+		Iss int64 `json:"iss"`
+	}{}
+	if err := json.Unmarshal(claimsJSON, &claims); err != nil || claims.Iss != a.id {
+		writeError(w, http.StatusUnauthorized, "Integration not found")
+		return
+	}
+	now := time.Now()
+	if now.Unix() > claims.Exp || claims.Exp-claims.Iat > 600 {
+		writeError(w, http.StatusUnauthorized, "Expiration time' claim ('exp') is too far in the future")
+		return
+	}
+	expires := now.Add(time.Hour).UTC().Truncate(time.Second)
+	s.mu.Lock()
+	token := fmt.Sprintf("ghs_%d", len(s.tokens)+1)
+	s.tokens[token] = expires
+	s.mu.Unlock()
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"token":      token,
+		"expires_at": expires.Format(time.RFC3339),
+	})
+}
+
+func (s *Server) tags(w http.ResponseWriter, r *http.Request, repo *repo) {
+	out, err := repo.git("tag", "--list")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	type tagJSON struct {
+		Name   string `json:"name"`
+		Commit struct {
+			Sha string `json:"sha"`
+		} `json:"commit"`
+	}
+	tags := []tagJSON{}
+	for _, name := range strings.Fields(string(out)) {
+		if c, ok := repo.resolve("refs/tags/" + name); ok {
+			t := tagJSON{Name: name}
+			t.Commit.Sha = c.Sha
+			tags = append(tags, t)
+		}
+	}
+	perPage, _ := strconv.Atoi(r.URL.Query().Get("per_page"))
+	if perPage <= 0 || perPage > 100 {
+		perPage = 100
+	}
+	if s.MaxPerPage > 0 && perPage > s.MaxPerPage {
+		perPage = s.MaxPerPage
+	}
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	start, end := (page-1)*perPage, page*perPage
+	if start > len(tags) {
+		start = len(tags)
+	}
+	if end < len(tags) {
+		next := *r.URL
+		next.Scheme, next.Host = "https", r.Host
+		q := next.Query()
+		q.Set("page", strconv.Itoa(page+1))
+		next.RawQuery = q.Encode()
+		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, next.String()))
+	} else {
+		end = len(tags)
+	}
+	writeJSON(w, http.StatusOK, tags[start:end])
+}
+
+// codeload serves archives like codeload.github.com, with all files in an
+// owner-repo-sha directory
+func (s *Server) codeload(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/_codeload/"), "/")
+	if len(parts) != 4 || parts[2] != "legacy.zip" {
+		writeError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	s.mu.Lock()
+	dir, ok := s.repos[parts[0]+"/"+parts[1]]
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	repo := &repo{name: parts[0] + "/" + parts[1], dir: dir}
+	c, ok := repo.resolve(parts[3])
+	if !ok {
+		writeError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	prefix := fmt.Sprintf("%s-%s-%s/", parts[0], parts[1], c.Sha[:7])
+	out, err := repo.git("archive", "--format=zip", "--prefix="+prefix, c.Sha)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Write(out)
+}
+
+type repo struct {
+	name string
+	dir  string
+}
+
+type commitJSON struct {
+	Sha    string `json:"sha"`
+	Commit struct {
+		Committer struct {
+			Date string `json:"date"`
+		} `json:"committer"`
+	} `json:"commit"`
+}
+
+func (r *repo) git(args ...string) ([]byte, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = r.dir
+	return cmd.Output()
+}
+
+// resolve returns the commit a ref points to
+func (r *repo) resolve(ref string) (commitJSON, bool) {
+	var c commitJSON
+	if ref == "" || strings.HasPrefix(ref, "-") {
+		return c, false
+	}
+	out, err := r.git("log", "-1", "--format=%H %cI", ref+"^{commit}", "--")
+	if err != nil {
+		return c, false
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) != 2 {
+		return c, false
+	}
+	c.Sha = fields[0]
+	c.Commit.Committer.Date = fields[1]
+	return c, true
+}
+
+func (r *repo) commits(w http.ResponseWriter) {
+	c, ok := r.resolve("HEAD")
+	if !ok {
+		writeError(w, http.StatusConflict, "Git Repository is empty.")
+		return
+	}
+	writeJSON(w, http.StatusOK, []commitJSON{c})
+}
+
+func (r *repo) commit(w http.ResponseWriter, ref string) {
+	c, ok := r.resolve(ref)
+	if !ok {
+		writeError(w, http.StatusUnprocessableEntity, "No commit found for SHA: "+ref)
+		return
+	}
+	writeJSON(w, http.StatusOK, c)
+}
+
+func (r *repo) compare(w http.ResponseWriter, spec string) {
+	refs := strings.SplitN(spec, "...", 2)
+	if len(refs) != 2 {
+		writeError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	base, bok := r.resolve(refs[0])
+	head, hok := r.resolve(refs[1])
+	if !bok || !hok {
+		writeError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	status := "diverged"
+	switch {
+	case base.Sha == head.Sha:
+		status = "identical"
+	case r.isAncestor(base.Sha, head.Sha):
+		status = "ahead"
+	case r.isAncestor(head.Sha, base.Sha):
+		status = "behind"
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": status})
+}
+
+func (r *repo) isAncestor(ancestor, commit string) bool {
+	_, err := r.git("merge-base", "--is-ancestor", ancestor, commit)
+	return err == nil
+}
+
+func (r *repo) contents(w http.ResponseWriter, req *http.Request, filePath, ref string) {
+	if ref == "" {
+		ref = "HEAD"
+	}
+	c, ok := r.resolve(ref)
+	if !ok {
+		writeError(w, http.StatusNotFound, "No commit found for the ref "+ref)
+		return
+	}
+	content, err := r.git("show", c.Sha+":"+filePath)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	if req.Header.Get("Accept") == "application/vnd.github.raw" {
+		w.Write(content)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"path":     filePath,
+		"encoding": "base64",
+		"content":  content,
+	})
+}
@@ -0,0 +1,152 @@
+package gitlab
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenType selects how a token is sent to the gitlab API
+type TokenType int
+
+const (
+	// PrivateToken is a personal, group or project access token sent in the
+	// Private-Token header
+	PrivateToken TokenType = iota
+	// OAuthToken is an OAuth2 access token sent as a bearer token
+	OAuthToken
+	// JobToken is a CI job token sent in the JOB-TOKEN header. GitLab only
+	// accepts job tokens on an allowlisted set of API endpoints, while this
+	// upstream reads GET /projects/:id and the repository tags, commits,
+	// merge_base, files and archive.zip endpoints of a project. Use it only
+	// if the instance allows job tokens there, requests refused with 401 or
+	// 403 fail with 502 Bad Gateway.
+	JobToken
+	// DeployToken is a deploy token with the read_repository scope. Deploy
+	// tokens can't use the API, so projects under the group prefix are
+	// mirrored over https with git instead, which requires Config.CacheDir.
+	// The module path below the prefix must be the project path, modules
+	// in subdirectories of projects and ?go-get=1 discovery are not
+	// supported.
+	DeployToken
+)
+
+// Credential is used to authenticate requests for projects under a group
+type Credential struct {
+	// GroupPrefix limits the credential to projects under a group such as
+	// "team-a" or "team-a/backend". The longest matching prefix wins, an
+	// empty prefix matches every project.
+	GroupPrefix string
+	Type        TokenType
+	// Username is the username of a deploy token
+	Username string
+	// Token is a static token. If TokenFile or TokenEnv are set instead,
+	// the token is reloaded when the file or environment changes so rotated
+	// tokens are picked up without a restart.
+	Token     string
+	TokenFile string
+	TokenEnv  string
+
+	mu      sync.Mutex
+	modTime time.Time
+	cached  string
+}
+
+func (c *Credential) matches(projectPath string) bool {
+	prefix := strings.Trim(c.GroupPrefix, "/")
+	return prefix == "" || projectPath == prefix || strings.HasPrefix(projectPath, prefix+"/")
+}
+
+// token returns the current value of the token
+func (c *Credential) token() (string, error) {
+	switch {
+	case c.TokenFile != "":
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		info, err := os.Stat(c.TokenFile)
+		if err != nil {
+			return "", fmt.Errorf("%w: could not stat token file", err)
+		}
+		if !info.ModTime().Equal(c.modTime) {
+			b, err := os.ReadFile(c.TokenFile)
+			if err != nil {
+				return "", fmt.Errorf("%w: could not read token file", err)
+			}
+			c.cached = strings.TrimSpace(string(b))
+			c.modTime = info.ModTime()
+		}
+		return c.cached, nil
+	case c.TokenEnv != "":
+		return os.Getenv(c.TokenEnv), nil
+	}
+	return c.Token, nil
+}
+
+// apply adds the credential to a request
+func (c *Credential) apply(r *http.Request) error {
+	t, err := c.token()
+	if err != nil {
+		return err
+	}
+	if t == "" {
+		return nil
+	}
+	switch c.Type {
+	case DeployToken:
+		// deploy tokens are only sent to git, see gitAuth
+	case OAuthToken:
+		r.Header.Set("Authorization", "Bearer "+t)
+	case JobToken:
+		r.Header.Set("JOB-TOKEN", t)
+	default:
+		r.Header.Set("Private-Token", t)
+	}
+	return nil
+}
+
+// gitAuth returns the basic auth credentials of a deploy token for git
+func (c *Credential) gitAuth() (string, string, error) {
+	t, err := c.token()
+	return c.Username, t, err
+}
+
+// credential selects the credential with the longest group prefix matching
+// projectPath
+func (p *privateGitLabUpstream) credential(projectPath string) *Credential {
+	var best *Credential
+	for _, c := range p.credentials {
+		if !c.matches(projectPath) {
+			continue
+		}
+		if best == nil || len(c.GroupPrefix) > len(best.GroupPrefix) {
+			best = c
+		}
+	}
+	return best
+}
+
+// apiProjectPath returns the project path an api request is made for, used
+// to select credentials. Requests that are not for a project return "".
+func (p *privateGitLabUpstream) apiProjectPath(apiPath string) string {
+	if !strings.HasPrefix(apiPath, "projects/") {
+		return ""
+	}
+	project := strings.TrimPrefix(apiPath, "projects/")
+	if i := strings.IndexAny(project, "/?"); i >= 0 {
+		project = project[:i]
+	}
+	if id, err := strconv.Atoi(project); err == nil {
+		pi, _ := p.projects.byId(id)
+		return pi.Path
+	}
+	projectPath, err := url.PathUnescape(project)
+	if err != nil {
+		return ""
+	}
+	return projectPath
+}
@@ -0,0 +1,111 @@
+package gitlab
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/wozz/modpox/forge/forgetest"
+)
+
+func TestCredentials(t *testing.T) {
+	t.Setenv("TEAM_B_TOKEN", "env-token")
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("file-token-1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p := NewGitLabUpstream(&Config{
+		Host:  "gitlab.example.com",
+		Token: "default-token",
+		Credentials: []*Credential{
+			{GroupPrefix: "team-a", Type: OAuthToken, Token: "team-a-token"},
+			{GroupPrefix: "team-a/backend", Type: JobToken, TokenFile: tokenFile},
+			{GroupPrefix: "team-b", TokenEnv: "TEAM_B_TOKEN"},
+		},
+	}).(*privateGitLabUpstream)
+
+	header := func(projectPath string) http.Header {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, "https://gitlab.example.com/api/v4/projects", nil)
+		if err := p.credential(projectPath).apply(req); err != nil {
+			t.Fatal(err)
+		}
+		return req.Header
+	}
+	if h := header("other/project"); h.Get("Private-Token") != "default-token" {
+		t.Errorf("expected default token, got %v", h)
+	}
+	if h := header("team-a/project"); h.Get("Authorization") != "Bearer team-a-token" {
+		t.Errorf("expected oauth token, got %v", h)
+	}
+	if h := header("team-ab/project"); h.Get("Private-Token") != "default-token" {
+		t.Errorf("group prefix should match whole path elements, got %v", h)
+	}
+	if h := header("team-a/backend/project"); h.Get("JOB-TOKEN") != "file-token-1" {
+		t.Errorf("expected job token from file, got %v", h)
+	}
+	if h := header("team-b/project"); h.Get("Private-Token") != "env-token" {
+		t.Errorf("expected private token from environment, got %v", h)
+	}
+
+	// rotate the token file
+	if err := os.WriteFile(tokenFile, []byte("file-token-2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(tokenFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if h := header("team-a/backend/project"); h.Get("JOB-TOKEN") != "file-token-2" {
+		t.Errorf("expected rotated job token, got %v", h)
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestDeployToken(t *testing.T) {
+	repo := forgetest.NewRepo(t)
+	repo.Commit(map[string]string{"go.mod": "module gitlab.example.com/team-d/lib\n"})
+	repo.Tag("v1.0.0")
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "team-d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(repo.Dir, filepath.Join(root, "team-d", "lib.git")); err != nil {
+		t.Fatal(err)
+	}
+	srv := forgetest.NewGitServer(t, root, "deployer", "deploy-token")
+
+	deploy := &Credential{GroupPrefix: "team-d", Type: DeployToken, Username: "deployer", Token: "deploy-token"}
+	p := NewGitLabUpstream(&Config{
+		Host:        "gitlab.example.com",
+		Credentials: []*Credential{deploy},
+		CacheDir:    t.TempDir(),
+		// deploy tokens can't use the api
+		Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			t.Errorf("unexpected api request: %s", r.URL)
+			return nil, errors.New("unexpected api request")
+		}),
+	}).(*privateGitLabUpstream)
+	// the fake git server doesn't speak https
+	p.deploy[deploy] = p.deployUpstream(deploy, srv.URL, t.TempDir())
+
+	b, status, err := p.Get("/gitlab.example.com/team-d/lib/@v/list")
+	if err != nil || status != http.StatusOK || string(b) != "v1.0.0\n" {
+		t.Errorf("unexpected list: %d %q %v", status, b, err)
+	}
+	if root, err := p.RepoRoot("gitlab.example.com/team-d/lib"); err != nil || root != nil {
+		t.Errorf("unexpected repo root for deploy token project: %v %v", root, err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, "https://gitlab.example.com/api/v4/projects", nil)
+	if err := deploy.apply(req); err != nil || len(req.Header) != 0 {
+		t.Errorf("deploy token sent to the api: %v %v", req.Header, err)
+	}
+}
@@ -1,200 +1,234 @@
 package gitlab
 
 import (
-	"archive/zip"
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/url"
-	"regexp"
-	"sort"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/wozz/modpox/forge"
+	"github.com/wozz/modpox/git"
 	"github.com/wozz/modpox/upstream"
 )
 
+// perPage is the page size for list requests, the maximum gitlab allows
+const perPage = 100
+
 // Config is used to configure the gitlab upstream
 type Config struct {
 	Upstream upstream.Upstream
 	Host     string
-	Token    string
+	// Token is a private token used for projects without a more specific
+	// entry in Credentials
+	Token string
+	// Credentials are used for projects under specific groups
+	Credentials []*Credential
+	// PassThrough forwards the basic auth credentials sent by the go command
+	// to gitlab instead of using the proxy's own credentials, so each user
+	// can only read the projects they have access to. The password must be a
+	// personal access token with the read_api scope. Module status, ?go-get=1
+	// discovery and webhook prefetching are disabled in this mode since they
+	// have no user to act for.
+	PassThrough bool
+	// WebhookSecret is the secret token gitlab sends with webhooks, webhooks
+	// are rejected if it is not set
+	WebhookSecret string
+	// MaxConcurrency limits concurrent api requests, defaults to 4
+	MaxConcurrency int
+	// RateLimitReserve is the number of requests left in a rate limit window
+	// at which requests start waiting for the window to reset, leaving
+	// budget for other users of the same token
+	RateLimitReserve int
+	// Transport is used for api requests, defaults to http.DefaultTransport
+	Transport http.RoundTripper
+	// ModulePrefix is the module path prefix served from this gitlab
+	// instance, defaults to Host. Setting it allows serving modules under
+	// a vanity domain.
+	ModulePrefix string
+	// CacheDir is the directory git mirrors of projects read with deploy
+	// tokens are kept in
+	CacheDir string
 }
 
 type privateGitLabUpstream struct {
 	host     string
+	prefix   string
 	client   *http.Client
 	upstream upstream.Upstream
+
+	credentials []*Credential
+	passThrough bool
+	// webhookSecret is the expected X-Gitlab-Token for webhooks
+	webhookSecret string
+	limiter       *rateLimiter
+	// deploy are the git upstreams serving the projects of deploy token
+	// credentials
+	deploy map[*Credential]upstream.Upstream
+	// user is set on per request copies made by GetAs
+	user *upstream.Credentials
+
+	projects *projectCache
 }
 
 // NewGitLabUpstream creates a new upstream for a private gitlab instance
 func NewGitLabUpstream(config *Config) upstream.Upstream {
 	hc := &http.Client{
 		Timeout: time.Minute,
-		Transport: &gitLabRT{
-			token: config.Token,
-			host:  config.Host,
-			base:  http.DefaultTransport,
+		Transport: &forge.Transport{
+			Hosts: map[string]bool{config.Host: true},
+			Base:  config.Transport,
 		},
 	}
-	return &privateGitLabUpstream{
-		client:   hc,
-		host:     config.Host,
-		upstream: config.Upstream,
+	credentials := config.Credentials
+	if config.Token != "" {
+		credentials = append([]*Credential{{Type: PrivateToken, Token: config.Token}}, credentials...)
+	}
+	prefix := config.ModulePrefix
+	if prefix == "" {
+		prefix = config.Host
+	}
+	p := &privateGitLabUpstream{
+		client:        hc,
+		host:          config.Host,
+		prefix:        prefix,
+		upstream:      config.Upstream,
+		credentials:   credentials,
+		passThrough:   config.PassThrough,
+		webhookSecret: config.WebhookSecret,
+		limiter:       newRateLimiter(config.MaxConcurrency, config.RateLimitReserve),
+		projects:      newProjectCache(),
+		deploy:        make(map[*Credential]upstream.Upstream),
+	}
+	for _, c := range credentials {
+		if c.Type != DeployToken {
+			continue
+		}
+		if config.CacheDir == "" {
+			log.Printf("gitlab: deploy token for %s/%s requires a cache dir, ignoring it", config.Host, c.GroupPrefix)
+			continue
+		}
+		p.deploy[c] = p.deployUpstream(c, "https://"+config.Host, config.CacheDir)
 	}
+	return p
 }
 
-func sortedTags(t []tagInfo) semVerList {
-	sList := make(semVerList, len(t))
-	for i, tag := range t {
-		sList[i] = parseTag(tag)
-	}
-	sort.Sort(sList)
-	return sList
+// deployUpstream creates the git upstream serving the projects under the
+// group prefix of a deploy token from baseURL
+func (p *privateGitLabUpstream) deployUpstream(c *Credential, baseURL, cacheDir string) upstream.Upstream {
+	prefix, remote := p.prefix, baseURL+"/{repo}.git"
+	if group := strings.Trim(c.GroupPrefix, "/"); group != "" {
+		prefix += "/" + group
+		remote = baseURL + "/" + group + "/{repo}.git"
+	}
+	return git.NewGitUpstream(&git.Config{
+		Upstream:     p.upstream,
+		ModulePrefix: prefix,
+		Remote:       remote,
+		CacheDir:     cacheDir,
+		BasicAuth:    c.gitAuth,
+	})
 }
 
-type modInfo struct {
-	Version string
-	Time    string
+// deployed returns the git upstream serving importPath with a deploy token,
+// if any. Deploy tokens are the proxy's own credentials, so they are not
+// used in pass through mode.
+func (p *privateGitLabUpstream) deployed(importPath string) (upstream.Upstream, bool) {
+	projectPath, ok := p.projectPath(importPath)
+	if !ok || p.passThrough {
+		return nil, false
+	}
+	c := p.credential(projectPath)
+	if c == nil || c.Type != DeployToken {
+		return nil, false
+	}
+	du, ok := p.deploy[c]
+	return du, ok
 }
 
-func (p *privateGitLabUpstream) list(key string) ([]byte, int, error) {
-	tags, err := p.getProjectTags(key)
-	if err != nil {
-		return nil, 0, fmt.Errorf("%w: privateGitLabUpstream list error", err)
+// Status implements upstream.StatusUpstream. In pass through mode the
+// proxy's own credentials are never used, so no status is reported.
+func (p *privateGitLabUpstream) Status(modulePath string) (*upstream.ModuleStatus, error) {
+	if _, ok := p.projectPath(modulePath); !ok || p.passThrough {
+		return nil, nil
 	}
-	sList := sortedTags(tags)
-	var b bytes.Buffer
-	for _, s := range sList {
-		b.Write([]byte(s.raw))
-		b.Write([]byte("\n"))
+	if du, ok := p.deployed(modulePath); ok {
+		return du.(upstream.StatusUpstream).Status(modulePath)
 	}
-	return b.Bytes(), http.StatusOK, nil
-}
-
-func (p *privateGitLabUpstream) latest(key string) ([]byte, int, error) {
-	tags, err := p.getProjectTags(key)
+	project, err := p.findProject(modulePath)
 	if err != nil {
-		return nil, 0, fmt.Errorf("%w: privateGitLabUpstream latest error", err)
+		return nil, err
 	}
-	if len(tags) == 0 {
-		commits, err := p.getProjectCommits(key)
-		if err != nil {
-			return nil, 0, fmt.Errorf("%w: project commits error", err)
+	return forge.Status(p.repo(project), modulePath)
+}
+
+func (p *privateGitLabUpstream) Get(key string) ([]byte, int, error) {
+	if strings.HasPrefix(key, fmt.Sprintf("/%s/", p.prefix)) {
+		log.Printf("query private gitlab for %s", key)
+		if p.passThrough && p.user == nil {
+			return []byte("authentication required"), http.StatusUnauthorized, nil
 		}
-		if len(commits) == 0 {
-			return nil, 0, fmt.Errorf("could not find latest")
+		if modPath, err := forge.ParseModulePath(key); err == nil {
+			if du, ok := p.deployed(modPath); ok {
+				return du.Get(key)
+			}
 		}
-		var b bytes.Buffer
-		err = json.NewEncoder(&b).Encode(modInfo{Version: commits[0].versionTag(), Time: commits[0].Date})
-		return b.Bytes(), http.StatusOK, err
-	}
-	sList := sortedTags(tags)
-	if len(sList) == 0 {
-		return nil, http.StatusGone, nil
-	}
-	var b bytes.Buffer
-	err = json.NewEncoder(&b).Encode(modInfo{Version: sList[len(sList)-1].raw, Time: sList[len(sList)-1].date})
-	return b.Bytes(), http.StatusOK, err
-}
-
-func (p *privateGitLabUpstream) zip(key string) ([]byte, int, error) {
-	// match in reverse so non-greedy match works correctly
-	re := regexp.MustCompile(`^piz\.((?U).*)/v@/`)
-	revkey := rev(key)
-	revmatches := re.FindStringSubmatch(revkey)
-	if len(revmatches) < 2 {
-		return nil, 0, fmt.Errorf("could not parse request")
-	}
-	version := rev(revmatches[1])
-	versionRE := regexp.MustCompile(`^v\d+\.\d+\.\d+-\d{14}-([\da-f]{12})$`)
-	pseudov := versionRE.FindStringSubmatch(version)
-	if len(pseudov) == 2 {
-		// set to commit sha
-		version = pseudov[1]
-	}
-	zipFile, err := p.getZip(key, version)
-	if err != nil {
-		return nil, 0, fmt.Errorf("%w: error getting zip", err)
+		b, status, err := p.handle(key)
+		var apiErr *forge.APIError
+		if errors.As(err, &apiErr) {
+			log.Printf("gitlab api error: %s %v", key, err)
+			if p.user != nil && (apiErr.Status == http.StatusUnauthorized || apiErr.Status == http.StatusForbidden) {
+				// the user's own credentials were rejected
+				return []byte(fmt.Sprintf("gitlab denied access: %s", apiErr.Message)), apiErr.Status, nil
+			}
+			return apiErr.ClientError()
+		}
+		return b, status, err
 	}
-	return zipFile, http.StatusOK, nil
+	return p.upstream.Get(key)
 }
 
-func (p *privateGitLabUpstream) info(key string) ([]byte, int, error) {
-	info := struct {
-		Version string
-		Time    string
-	}{}
-	re := regexp.MustCompile(`^ofni\.((?U).*)/v@/`)
-	revkey := rev(key)
-	revmatches := re.FindStringSubmatch(revkey)
-	if len(revmatches) < 2 {
-		return nil, 0, fmt.Errorf("could not parse request")
-	}
-	version := rev(revmatches[1])
-	info.Version = version
-	versionRE := regexp.MustCompile(`^v\d+\.\d+\.\d+-\d{14}-([\da-f]{12})$`)
-	pseudov := versionRE.FindStringSubmatch(version)
-	if len(pseudov) == 2 {
-		version = pseudov[1]
-	}
-	commit, err := p.getCommit(key, version)
-	if err != nil {
-		return nil, 0, fmt.Errorf("%w: could not get commit", err)
+// GetAs implements upstream.AuthUpstream. In pass through mode requests are
+// made with creds, otherwise it behaves the same as Get.
+func (p *privateGitLabUpstream) GetAs(key string, creds *upstream.Credentials) ([]byte, int, error) {
+	if strings.HasPrefix(key, fmt.Sprintf("/%s/", p.prefix)) {
+		if !p.passThrough {
+			return p.Get(key)
+		}
+		user := *p
+		user.user = creds
+		return user.Get(key)
 	}
-	info.Time = commit.Date
-	var b bytes.Buffer
-	if err := json.NewEncoder(&b).Encode(&info); err != nil {
-		return nil, 0, fmt.Errorf("%w: json encode error", err)
+	if au, ok := p.upstream.(upstream.AuthUpstream); ok {
+		return au.GetAs(key, creds)
 	}
-	return b.Bytes(), http.StatusOK, nil
+	return p.upstream.Get(key)
 }
 
-func (p *privateGitLabUpstream) mod(key string) ([]byte, int, error) {
-	re := regexp.MustCompile(`^dom\.((?U).*)/v@/`)
-	revkey := rev(key)
-	revmatches := re.FindStringSubmatch(revkey)
-	if len(revmatches) < 2 {
-		return nil, 0, fmt.Errorf("could not parse request")
-	}
-	version := rev(revmatches[1])
-	versionRE := regexp.MustCompile(`^v\d+\.\d+\.\d+-\d{14}-([\da-f]{12})$`)
-	pseudov := versionRE.FindStringSubmatch(version)
-	if len(pseudov) == 2 {
-		version = pseudov[1]
+func (p *privateGitLabUpstream) handle(key string) ([]byte, int, error) {
+	modPath, err := forge.ParseModulePath(key)
+	if err != nil {
+		return nil, 0, err
 	}
-	goModFile, err := p.getFile(key, version, "go.mod")
+	project, err := p.findProject(modPath)
 	if err != nil {
-		return nil, 0, fmt.Errorf("%w: error getting go.mod", err)
+		return nil, 0, err
 	}
-	return goModFile, http.StatusOK, nil
-}
-
-func (p *privateGitLabUpstream) Get(key string) ([]byte, int, error) {
-	if strings.HasPrefix(key, fmt.Sprintf("/%s", p.host)) {
-		log.Printf("query private gitlab for %s", key)
-		if strings.HasSuffix(key, "/@v/list") {
-			return p.list(key)
-		} else if strings.HasSuffix(key, "/@latest") {
-			return p.latest(key)
-		} else if strings.HasSuffix(key, ".zip") {
-			return p.zip(key)
-		} else if strings.HasSuffix(key, ".info") {
-			return p.info(key)
-		} else if strings.HasSuffix(key, ".mod") {
-			return p.mod(key)
-		}
-		return nil, http.StatusForbidden, nil
-	}
-	return p.upstream.Get(key)
+	return forge.Serve(p.repo(project), key)
 }
 
 type projectInfo struct {
-	Id   int    `json:"id"`
-	Path string `json:"path_with_namespace"`
+	Id            int    `json:"id"`
+	Path          string `json:"path_with_namespace"`
+	WebURL        string `json:"web_url"`
+	RepoURL       string `json:"http_url_to_repo"`
+	DefaultBranch string `json:"default_branch"`
 }
 
 type commitInfo struct {
@@ -202,34 +236,38 @@ type commitInfo struct {
 	Date string `json:"created_at"`
 }
 
-func (c commitInfo) versionTag() string {
-	t, err := time.Parse("2006-01-02T15:04:05.000Z", c.Date)
+func (c commitInfo) commit() (forge.Commit, error) {
+	t, err := time.Parse(time.RFC3339, c.Date)
 	if err != nil {
-		log.Printf("could not parse date: %s %v", c.Date, err)
-		return ""
-	}
-	id := ""
-	if len(c.Id) > 12 {
-		id = c.Id[:12]
-	} else {
-		id = c.Id
+		return forge.Commit{}, fmt.Errorf("%w: could not parse date", err)
 	}
-	return fmt.Sprintf("v0.0.0-%s-%s", t.Format("20060102150405"), id)
+	return forge.Commit{Id: c.Id, Time: t}, nil
 }
 
-func (p *privateGitLabUpstream) getFile(key string, version string, filename string) ([]byte, error) {
-	projectPath, err := parseProjectPath(key)
-	if err != nil {
-		return nil, fmt.Errorf("%w: could not get project path", err)
-	}
-	projectId, err := p.getProjectId(projectPath)
-	if err != nil {
-		return nil, fmt.Errorf("%w: could not get project id", err)
-	}
+type tagInfo struct {
+	Name   string     `json:"name"`
+	Commit commitInfo `json:"commit"`
+}
+
+// gitlabRepo implements forge.Repo with the gitlab repository api
+type gitlabRepo struct {
+	p  *privateGitLabUpstream
+	id int
+}
+
+func (p *privateGitLabUpstream) repo(project projectInfo) *gitlabRepo {
+	return &gitlabRepo{p: p, id: project.Id}
+}
+
+func (r *gitlabRepo) apiReq(format string, args ...interface{}) ([]byte, error) {
+	return r.p.apiReq(fmt.Sprintf("projects/%d/repository/", r.id) + fmt.Sprintf(format, args...))
+}
+
+func (r *gitlabRepo) File(ref, filename string) ([]byte, error) {
 	queryParams := &url.Values{
-		"ref": []string{version},
+		"ref": []string{ref},
 	}
-	fileApiData, err := p.apiReq(fmt.Sprintf("projects/%d/repository/files/%s?%s", projectId, url.PathEscape(filename), queryParams.Encode()))
+	fileApiData, err := r.apiReq("files/%s?%s", url.PathEscape(filename), queryParams.Encode())
 	if err != nil {
 		return nil, fmt.Errorf("%w: could not make api req for files", err)
 	}
@@ -240,185 +278,299 @@ func (p *privateGitLabUpstream) getFile(key string, version string, filename str
 	return fileData.Content, err
 }
 
-func (p *privateGitLabUpstream) getZip(key string, tag string) ([]byte, error) {
-	projectPath, err := parseProjectPath(key)
-	if err != nil {
-		return nil, fmt.Errorf("%w: could not get project path", err)
-	}
-	projectId, err := p.getProjectId(projectPath)
-	if err != nil {
-		return nil, fmt.Errorf("%w: could not get project id", err)
-	}
+func (r *gitlabRepo) Archive(ref string) ([]byte, error) {
 	queryParams := &url.Values{
-		"sha": []string{tag},
+		"sha": []string{ref},
 	}
-	rawZip, err := p.apiReq(fmt.Sprintf("projects/%d/repository/archive.zip?%s", projectId, queryParams.Encode()))
+	rawZip, err := r.apiReq("archive.zip?%s", queryParams.Encode())
 	if err != nil {
 		return nil, fmt.Errorf("%w: could not make api req", err)
 	}
-	b := bytes.NewReader(rawZip)
-	outBuf := new(bytes.Buffer)
-	w := zip.NewWriter(outBuf)
-	r, err := zip.NewReader(b, int64(len(rawZip)))
-	if err != nil {
-		return nil, fmt.Errorf("%w: could not read zip file", err)
-	}
-	keyPath := strings.TrimPrefix(key, "/")
-	keyPath = strings.TrimSuffix(key, ".zip")
-	modParts := strings.Split(keyPath, "/@v/")
-	if len(modParts) != 2 {
-		return nil, fmt.Errorf("could not parse module path for zip file")
-	}
-	modPath := strings.Join(modParts, "@")
-	modPath = strings.TrimPrefix(modPath, "/")
-	for _, f := range r.File {
-		fileNameParts := strings.Split(f.Name, "/")
-		fileNameParts[0] = modPath
-		outF, err := w.Create(strings.Join(fileNameParts, "/"))
-		if err != nil {
-			return nil, fmt.Errorf("%w: could not create new zip file", err)
-		}
-		inF, err := f.Open()
-		if err != nil {
-			return nil, fmt.Errorf("%w: could not create new file for zip", err)
-		}
-		io.Copy(outF, inF)
-		inF.Close()
-	}
-	w.Flush()
-	w.Close()
-	return outBuf.Bytes(), nil
+	return rawZip, nil
 }
 
-func (p *privateGitLabUpstream) getCommit(key, version string) (commitInfo, error) {
-	projectPath, err := parseProjectPath(key)
+func (r *gitlabRepo) Commit(ref string) (forge.Commit, error) {
+	commitData, err := r.apiReq("commits/%s", url.PathEscape(ref))
 	if err != nil {
-		return commitInfo{}, fmt.Errorf("%w: could not parse project path", err)
+		return forge.Commit{}, fmt.Errorf("%w: could not make api request for commits", err)
 	}
-	projectId, err := p.getProjectId(projectPath)
-	if err != nil {
-		return commitInfo{}, fmt.Errorf("%w: could not parse project id", err)
+	var c commitInfo
+	if err := json.Unmarshal(commitData, &c); err != nil {
+		return forge.Commit{}, fmt.Errorf("%w: could not parse json response", err)
 	}
-	commitData, err := p.apiReq(fmt.Sprintf("projects/%d/repository/commits/%s", projectId, version))
-	if err != nil {
-		return commitInfo{}, fmt.Errorf("%w: could not make api request for commits", err)
+	if c.Id == "" {
+		return forge.Commit{}, nil
 	}
-	var c commitInfo
-	err = json.Unmarshal(commitData, &c)
-	return c, err
-
+	return c.commit()
 }
 
-func (p *privateGitLabUpstream) getProjectCommits(key string) ([]commitInfo, error) {
-	projectPath, err := parseProjectPath(key)
-	if err != nil {
-		return nil, fmt.Errorf("%w: could not parse project path", err)
+func (r *gitlabRepo) IsAncestor(ancestor, commit string) (bool, error) {
+	queryParams := &url.Values{
+		"refs[]": []string{ancestor, commit},
 	}
-	projectId, err := p.getProjectId(projectPath)
+	baseData, err := r.apiReq("merge_base?%s", queryParams.Encode())
 	if err != nil {
-		return nil, fmt.Errorf("%w: could not get project id", err)
+		return false, fmt.Errorf("%w: could not make api req", err)
 	}
-	commitData, err := p.apiReq(fmt.Sprintf("projects/%d/repository/commits", projectId))
-	if err != nil {
-		return nil, fmt.Errorf("%w: could not make api req", err)
+	var c commitInfo
+	if err := json.Unmarshal(baseData, &c); err != nil {
+		return false, fmt.Errorf("%w: could not parse json response", err)
 	}
-	cList := make([]commitInfo, 0)
-	err = json.Unmarshal(commitData, &cList)
-	return cList, err
+	return c.Id == ancestor, nil
 }
 
-type tagInfo struct {
-	Name   string     `json:"name"`
-	Commit commitInfo `json:"commit"`
-}
-
-func (p *privateGitLabUpstream) getProjectTags(key string) ([]tagInfo, error) {
-	projectPath, err := parseProjectPath(key)
-	if err != nil {
-		return nil, fmt.Errorf("%w: could not parse project path", err)
-	}
-	projectId, err := p.getProjectId(projectPath)
+func (r *gitlabRepo) Head() (forge.Commit, error) {
+	commitData, err := r.apiReq("commits")
 	if err != nil {
-		return nil, fmt.Errorf("%w: could not get project id", err)
+		return forge.Commit{}, fmt.Errorf("%w: could not make api req", err)
 	}
-	tagData, err := p.apiReq(fmt.Sprintf("projects/%d/repository/tags", projectId))
-	if err != nil {
-		return nil, fmt.Errorf("%w: could not make api req", err)
+	cList := make([]commitInfo, 0)
+	if err := json.Unmarshal(commitData, &cList); err != nil {
+		return forge.Commit{}, fmt.Errorf("%w: could not parse json response", err)
 	}
-	tList := make([]tagInfo, 0)
-	err = json.Unmarshal(tagData, &tList)
-	if err != nil {
-		return nil, fmt.Errorf("%w: could not parse json response", err)
+	if len(cList) == 0 {
+		return forge.Commit{}, fmt.Errorf("%w: no commits", forge.ErrNotFound)
 	}
-	return tList, nil
+	return cList[0].commit()
 }
 
-func parseProjectPath(key string) (string, error) {
-	projectPathParts := strings.Split(key, "/")
-	if len(projectPathParts) < 4 {
-		return "", fmt.Errorf("invalid path")
+func (r *gitlabRepo) Tags() ([]forge.Tag, error) {
+	var tags []forge.Tag
+	for page := "1"; page != ""; {
+		tagData, header, err := r.p.apiReqHeader(fmt.Sprintf("projects/%d/repository/tags?per_page=%d&page=%s", r.id, perPage, url.QueryEscape(page)))
+		if err != nil {
+			return nil, fmt.Errorf("%w: could not make api req", err)
+		}
+		tList := make([]tagInfo, 0)
+		if err := json.Unmarshal(tagData, &tList); err != nil {
+			return nil, fmt.Errorf("%w: could not parse json response", err)
+		}
+		for _, t := range tList {
+			c, err := t.Commit.commit()
+			if err != nil {
+				return nil, err
+			}
+			tags = append(tags, forge.Tag{Name: t.Name, Commit: c})
+		}
+		// X-Next-Page is empty on the last page
+		page = header.Get("X-Next-Page")
 	}
-	projectPath := projectPathParts[2] + "/" + projectPathParts[3]
-	return projectPath, nil
+	return tags, nil
 }
 
-func (p *privateGitLabUpstream) getProjectId(projectPath string) (int, error) {
-	projects, err := p.apiReq("projects")
-	if err != nil {
-		return 0, fmt.Errorf("%w: could not get projects", err)
+// projectPath maps a module or import path to the gitlab path it is served
+// from, e.g. gitlab.example.com/group/project/v2 -> group/project/v2
+func (p *privateGitLabUpstream) projectPath(importPath string) (string, bool) {
+	if !strings.HasPrefix(importPath, p.prefix+"/") {
+		return "", false
 	}
-	piList := make([]projectInfo, 0)
-	err = json.Unmarshal(projects, &piList)
-	if err != nil {
-		return 0, fmt.Errorf("%w: could not parse projects json", err)
+	return strings.TrimPrefix(importPath, p.prefix+"/"), true
+}
+
+// projectTTL is how long project info is cached, so renamed, moved and
+// deleted projects are eventually picked up without a webhook
+const projectTTL = time.Hour
+
+// projectCache maps project paths to project info. It is shared between
+// users in pass through mode since every api request for the project is
+// still made with the user's own credentials. Only projects that exist are
+// cached, keyed by the project path rather than the import path requested.
+type projectCache struct {
+	mu       sync.Mutex
+	projects map[string]cachedProject
+}
+
+type cachedProject struct {
+	project    projectInfo
+	expireTime time.Time
+}
+
+func newProjectCache() *projectCache {
+	return &projectCache{projects: make(map[string]cachedProject)}
+}
+
+func (pc *projectCache) get(projectPath string) (projectInfo, bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	cached, ok := pc.projects[projectPath]
+	if !ok {
+		return projectInfo{}, false
+	}
+	if time.Now().After(cached.expireTime) {
+		delete(pc.projects, projectPath)
+		return projectInfo{}, false
+	}
+	return cached.project, true
+}
+
+func (pc *projectCache) set(projectPath string, project projectInfo) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.projects[projectPath] = cachedProject{
+		project:    project,
+		expireTime: time.Now().Add(projectTTL),
 	}
-	for _, pi := range piList {
-		if pi.Path == projectPath {
-			return pi.Id, nil
+}
+
+func (pc *projectCache) byId(id int) (projectInfo, bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	for _, cached := range pc.projects {
+		if cached.project.Id == id && time.Now().Before(cached.expireTime) {
+			return cached.project, true
 		}
 	}
-	return 0, fmt.Errorf("not found")
+	return projectInfo{}, false
 }
 
-type gitLabRT struct {
-	token string
-	host  string
-	base  http.RoundTripper
+// invalidate removes a project by path or id, so a renamed project is
+// looked up again
+func (pc *projectCache) invalidate(projectPath string, id int) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	for k, cached := range pc.projects {
+		if k == projectPath || cached.project.Path == projectPath || id != 0 && cached.project.Id == id {
+			delete(pc.projects, k)
+		}
+	}
 }
 
-func (g *gitLabRT) RoundTrip(r *http.Request) (*http.Response, error) {
-	r.Header.Add("Private-Token", g.token)
-	if r.URL.Host != g.host {
-		return nil, fmt.Errorf("invalid host")
+// findProject finds the project containing importPath, trying the longest
+// path first so projects in nested subgroups and major version suffixes
+// are resolved correctly
+func (p *privateGitLabUpstream) findProject(importPath string) (projectInfo, error) {
+	projectPath, ok := p.projectPath(importPath)
+	if !ok {
+		return projectInfo{}, &forge.APIError{Forge: "gitlab", Status: http.StatusNotFound, Message: fmt.Sprintf("path not served by this upstream: %s", importPath)}
+	}
+	parts := strings.Split(projectPath, "/")
+	// a project can't contain other projects, so the first cached candidate
+	// is the right one
+	for i := len(parts); i >= 2; i-- {
+		if project, ok := p.projects.get(strings.Join(parts[:i], "/")); ok {
+			return project, nil
+		}
 	}
-	if r.URL.Scheme != "https" {
-		return nil, fmt.Errorf("insecure connection")
+	for i := len(parts); i >= 2; i-- {
+		candidate := strings.Join(parts[:i], "/")
+		projectData, err := p.apiReq(fmt.Sprintf("projects/%s", url.PathEscape(candidate)))
+		if forge.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return projectInfo{}, fmt.Errorf("%w: could not get project", err)
+		}
+		var project projectInfo
+		if err := json.Unmarshal(projectData, &project); err != nil {
+			return projectInfo{}, fmt.Errorf("%w: could not parse project json", err)
+		}
+		p.projects.set(candidate, project)
+		return project, nil
 	}
-	return g.base.RoundTrip(r)
+	return projectInfo{}, &forge.APIError{Forge: "gitlab", Status: http.StatusNotFound, Message: fmt.Sprintf("no gitlab project found for %s", importPath)}
 }
 
-func (p *privateGitLabUpstream) apiReq(path string) ([]byte, error) {
-	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("https://%s/api/v4/%s", p.host, path), nil)
-	if err != nil {
-		return nil, fmt.Errorf("%w: could not make request", err)
+// RepoRoot implements upstream.ImportUpstream. In pass through mode import
+// paths are not resolved, since that would reveal which projects exist to
+// users without access.
+func (p *privateGitLabUpstream) RepoRoot(importPath string) (*upstream.RepoRoot, error) {
+	if _, ok := p.projectPath(importPath); !ok || p.passThrough {
+		return nil, nil
+	}
+	if _, ok := p.deployed(importPath); ok {
+		return nil, nil
 	}
+	project, err := p.findProject(importPath)
+	if forge.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	branch := project.DefaultBranch
+	if branch == "" {
+		branch = "master"
+	}
+	return &upstream.RepoRoot{
+		Root:    fmt.Sprintf("%s/%s", p.prefix, project.Path),
+		VCS:     "git",
+		RepoURL: project.RepoURL,
+		Home:    project.WebURL,
+		Dir:     fmt.Sprintf("%s/-/tree/%s{/dir}", project.WebURL, branch),
+		File:    fmt.Sprintf("%s/-/blob/%s{/dir}/{file}#L{line}", project.WebURL, branch),
+	}, nil
+}
+
+// do performs a single request through the rate limiter
+func (p *privateGitLabUpstream) do(req *http.Request, b *bytes.Buffer, budgeted bool) (*http.Response, error) {
+	p.limiter.acquire(budgeted)
+	defer p.limiter.release()
 	resp, err := p.client.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("%w: could not perform request", err)
 	}
-	var b bytes.Buffer
 	defer resp.Body.Close()
-	_, err = io.Copy(&b, resp.Body)
-	if err != nil {
+	p.limiter.update(resp, budgeted)
+	if _, err := io.Copy(b, resp.Body); err != nil {
 		return nil, fmt.Errorf("%w: could not copy response", err)
 	}
-	return b.Bytes(), nil
+	return resp, nil
+}
+
+func (p *privateGitLabUpstream) apiReq(path string) ([]byte, error) {
+	b, _, err := p.apiReqHeader(path)
+	return b, err
 }
 
-func rev(in string) string {
-	out := ""
-	for i := range in {
-		out = string(in[i]) + out
+// apiReqHeader is apiReq also returning the response headers, e.g. for
+// pagination
+func (p *privateGitLabUpstream) apiReqHeader(path string) ([]byte, http.Header, error) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("https://%s/api/v4/%s", p.host, path), nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: could not make request", err)
+	}
+	if p.user != nil {
+		cred := &Credential{Type: PrivateToken, Token: p.user.Password}
+		if err := cred.apply(req); err != nil {
+			return nil, nil, fmt.Errorf("%w: could not apply user credentials", err)
+		}
+	} else if cred := p.credential(p.apiProjectPath(path)); cred != nil {
+		if err := cred.apply(req); err != nil {
+			return nil, nil, fmt.Errorf("%w: could not apply credentials", err)
+		}
+	}
+	// requests made with end user credentials count against the user's own
+	// rate limit, so they are queued but not budgeted
+	budgeted := p.user == nil
+	var b bytes.Buffer
+	var resp *http.Response
+	for attempt := 0; ; attempt++ {
+		b.Reset()
+		resp, err = p.do(req, &b, budgeted)
+		if err != nil {
+			return nil, nil, err
+		}
+		if resp.StatusCode != http.StatusTooManyRequests || attempt >= maxRetries {
+			break
+		}
+		wait := retryAfter(resp)
+		log.Printf("gitlab rate limited, retrying in %s: %s", wait, path)
+		time.Sleep(wait)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg := struct {
+			Message string `json:"message"`
+			Error   string `json:"error"`
+		}{}
+		message := b.String()
+		if json.Unmarshal(b.Bytes(), &msg) == nil {
+			if msg.Message != "" {
+				message = msg.Message
+			} else if msg.Error != "" {
+				message = msg.Error
+			}
+		}
+		return nil, nil, &forge.APIError{Forge: "gitlab", Status: resp.StatusCode, Message: message}
 	}
-	return out
+	return b.Bytes(), resp.Header, nil
 }
@@ -0,0 +1,333 @@
+package gitlab
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wozz/modpox/forge"
+	"github.com/wozz/modpox/forge/forgetest"
+	"github.com/wozz/modpox/gitlab/gitlabtest"
+	"github.com/wozz/modpox/upstream"
+	"golang.org/x/mod/module"
+)
+
+type modInfo struct {
+	Version string
+	Time    string
+}
+
+func TestFindProjectOutsidePrefix(t *testing.T) {
+	p := NewGitLabUpstream(&Config{Host: "gitlab.example.com"}).(*privateGitLabUpstream)
+	// the go command probes the prefix itself when resolving module paths,
+	// which must fall through instead of failing the request
+	for _, importPath := range []string{"gitlab.example.com", "other.example.com/group/project"} {
+		if _, err := p.findProject(importPath); !forge.IsNotFound(err) {
+			t.Errorf("%s: expected not found error, got %v", importPath, err)
+		}
+	}
+}
+
+// newTestUpstream starts a fake gitlab serving fixture projects
+func newTestUpstream(t *testing.T) (*privateGitLabUpstream, *gitlabtest.Server, map[string]string) {
+	t.Helper()
+	fake := gitlabtest.NewServer()
+	t.Cleanup(fake.Close)
+	fake.Token = "token"
+	commits := make(map[string]string)
+
+	repo := forgetest.NewRepo(t)
+	commits["v1.0.0"] = repo.Commit(map[string]string{
+		"go.mod": "module gitlab.example.com/group/sub/project\n",
+		"a.go":   "package project\n",
+	})
+	repo.Tag("v1.0.0")
+	repo.Tag("release-1")
+	repo.Commit(map[string]string{"b.go": "package project\n"})
+	repo.Tag("v1.1.0-rc.1")
+	repo.Commit(map[string]string{"c.go": "package project\n"})
+	repo.Tag("v1.1.0")
+	repo.Commit(map[string]string{
+		"go.mod": "// Deprecated: use gitlab.example.com/group/other\nmodule gitlab.example.com/group/sub/project\n\nretract v1.2.0 // broken\n",
+	})
+	repo.Tag("v1.2.0")
+	commits["main"] = repo.Commit(map[string]string{"d.go": "package project\n"})
+	fake.AddProject("group/sub/project", repo.Dir)
+
+	legacy := forgetest.NewRepo(t)
+	legacy.Commit(map[string]string{"a.go": "package legacy\n"})
+	legacy.Tag("v1.0.0")
+	legacy.Commit(map[string]string{"b.go": "package legacy\n"})
+	legacy.Tag("v2.0.0")
+	fake.AddProject("group/legacy", legacy.Dir)
+
+	p := NewGitLabUpstream(&Config{
+		Host:         fake.Host(),
+		ModulePrefix: "gitlab.example.com",
+		Token:        "token",
+		Transport:    fake.Client().Transport,
+	}).(*privateGitLabUpstream)
+	return p, fake, commits
+}
+
+func TestGitLabUpstream(t *testing.T) {
+	p, fake, commits := newTestUpstream(t)
+	get := func(t *testing.T, key string, wantStatus int) string {
+		t.Helper()
+		b, status, err := p.Get(key)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", key, err)
+		}
+		if status != wantStatus {
+			t.Fatalf("%s: got status %d, want %d: %s", key, status, wantStatus, b)
+		}
+		return string(b)
+	}
+	info := func(t *testing.T, key string) modInfo {
+		t.Helper()
+		var i modInfo
+		if err := json.Unmarshal([]byte(get(t, key, http.StatusOK)), &i); err != nil {
+			t.Fatal(err)
+		}
+		return i
+	}
+	const mod = "/gitlab.example.com/group/sub/project"
+
+	t.Run("list", func(t *testing.T) {
+		want := "v1.0.0\nv1.1.0-rc.1\nv1.1.0\nv1.2.0\n"
+		if got := get(t, mod+"/@v/list", http.StatusOK); got != want {
+			t.Errorf("got list %q, want %q", got, want)
+		}
+	})
+	t.Run("latest skips retracted", func(t *testing.T) {
+		if got := info(t, mod+"/@latest"); got.Version != "v1.1.0" {
+			t.Errorf("unexpected latest: %v", got)
+		}
+	})
+	t.Run("status", func(t *testing.T) {
+		status, err := p.Status("gitlab.example.com/group/sub/project")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.Deprecated != "use gitlab.example.com/group/other" {
+			t.Errorf("unexpected deprecation: %q", status.Deprecated)
+		}
+		if len(status.Retractions) != 1 || status.Retractions[0].Low != "v1.2.0" || status.Retractions[0].Rationale != "broken" {
+			t.Errorf("unexpected retractions: %v", status.Retractions)
+		}
+	})
+	t.Run("info queries", func(t *testing.T) {
+		if got := info(t, mod+"/@v/v1.0.0.info"); got.Version != "v1.0.0" {
+			t.Errorf("unexpected tag info: %v", got)
+		}
+		if got := info(t, mod+"/@v/"+commits["v1.0.0"][:7]+".info"); got.Version != "v1.0.0" {
+			t.Errorf("short hash of tagged commit should resolve to the tag, got %v", got)
+		}
+		got := info(t, mod+"/@v/main.info")
+		if !module.IsPseudoVersion(got.Version) || !strings.HasPrefix(got.Version, "v1.2.1-0.") || !strings.HasSuffix(got.Version, commits["main"][:12]) {
+			t.Errorf("unexpected branch info: %v", got)
+		}
+		if pseudo := info(t, mod+"/@v/"+got.Version+".info"); pseudo.Version != got.Version {
+			t.Errorf("pseudo-version should resolve to itself, got %v", pseudo)
+		}
+		get(t, mod+"/@v/does-not-exist.info", http.StatusNotFound)
+	})
+	t.Run("mod and zip", func(t *testing.T) {
+		if got := get(t, mod+"/@v/v1.0.0.mod", http.StatusOK); got != "module gitlab.example.com/group/sub/project\n" {
+			t.Errorf("unexpected go.mod: %q", got)
+		}
+		get(t, mod+"/@v/main.mod", http.StatusNotFound)
+		get(t, mod+"/@v/main.zip", http.StatusNotFound)
+		get(t, mod+"/@v/v1.1.0.zip", http.StatusOK)
+	})
+	t.Run("incompatible", func(t *testing.T) {
+		const legacy = "/gitlab.example.com/group/legacy"
+		if got := get(t, legacy+"/@v/list", http.StatusOK); got != "v1.0.0\nv2.0.0+incompatible\n" {
+			t.Errorf("unexpected list: %q", got)
+		}
+		if got := get(t, legacy+"/@v/v2.0.0+incompatible.mod", http.StatusOK); got != "module gitlab.example.com/group/legacy\n" {
+			t.Errorf("unexpected synthesized go.mod: %q", got)
+		}
+		get(t, legacy+"/@v/v3.0.0+incompatible.mod", http.StatusNotFound)
+	})
+	t.Run("not found", func(t *testing.T) {
+		get(t, "/gitlab.example.com/group/missing/@v/list", http.StatusNotFound)
+		get(t, "/gitlab.example.com/group/@v/list", http.StatusNotFound)
+		get(t, "/gitlab.example.com/@v/list", http.StatusNotFound)
+	})
+	t.Run("error mapping", func(t *testing.T) {
+		fake.Token = "rotated"
+		defer func() { fake.Token = "token" }()
+		get(t, "/gitlab.example.com/group/legacy/@v/v1.0.0.info", http.StatusBadGateway)
+	})
+	t.Run("rate limit", func(t *testing.T) {
+		fake.SetRateLimit(1)
+		defer fake.SetRateLimit(0)
+		get(t, "/gitlab.example.com/group/legacy/@v/list", http.StatusServiceUnavailable)
+		if m := p.Metrics(); len(m) == 0 {
+			t.Errorf("expected metrics")
+		}
+		if p.limiter.rateLimited == 0 {
+			t.Errorf("expected rate limited requests to be counted")
+		}
+	})
+}
+
+func TestGitLabTagPagination(t *testing.T) {
+	p, fake, _ := newTestUpstream(t)
+	repo := forgetest.NewRepo(t)
+	repo.Commit(map[string]string{
+		"go.mod": "module gitlab.example.com/group/many\n",
+	})
+	const n = 150
+	for i := 0; i < n; i++ {
+		repo.Tag(fmt.Sprintf("v1.0.%d", i))
+	}
+	fake.AddProject("group/many", repo.Dir)
+
+	b, status, err := p.Get("/gitlab.example.com/group/many/@v/list")
+	if err != nil || status != http.StatusOK {
+		t.Fatalf("unexpected response: %d %v", status, err)
+	}
+	versions := strings.Fields(string(b))
+	if len(versions) != n || versions[n-1] != fmt.Sprintf("v1.0.%d", n-1) {
+		t.Errorf("expected all %d tags across pages, got %d", n, len(versions))
+	}
+}
+
+func TestRepoRoot(t *testing.T) {
+	p, fake, _ := newTestUpstream(t)
+	root, err := p.RepoRoot("gitlab.example.com/group/sub/project/internal/pkg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	webURL := fake.URL + "/group/sub/project"
+	want := upstream.RepoRoot{
+		Root:    "gitlab.example.com/group/sub/project",
+		VCS:     "git",
+		RepoURL: webURL + ".git",
+		Home:    webURL,
+		Dir:     webURL + "/-/tree/main{/dir}",
+		File:    webURL + "/-/blob/main{/dir}/{file}#L{line}",
+	}
+	if root == nil || *root != want {
+		t.Errorf("got repo root %+v, want %+v", root, want)
+	}
+	for _, importPath := range []string{"gitlab.example.com/group/missing", "gitlab.example.com", "other.example.com/group/project"} {
+		if root, err := p.RepoRoot(importPath); root != nil || err != nil {
+			t.Errorf("%s: expected no repo root, got %+v %v", importPath, root, err)
+		}
+	}
+}
+
+func TestProjectCache(t *testing.T) {
+	p, fake, _ := newTestUpstream(t)
+	find := func(importPath string) projectInfo {
+		t.Helper()
+		project, err := p.findProject(importPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return project
+	}
+	project := find("gitlab.example.com/group/sub/project/a")
+	requests := fake.Requests()
+	// other packages of the same project are resolved from the cache, which
+	// only holds the project itself
+	find("gitlab.example.com/group/sub/project/b/c")
+	find("gitlab.example.com/group/sub/project")
+	if fake.Requests() != requests {
+		t.Errorf("expected cached project, got %d api requests", fake.Requests()-requests)
+	}
+	if len(p.projects.projects) != 1 {
+		t.Errorf("unexpected cache entries: %v", p.projects.projects)
+	}
+
+	// expired entries are looked up again
+	cached := p.projects.projects["group/sub/project"]
+	cached.expireTime = time.Now().Add(-time.Second)
+	p.projects.projects["group/sub/project"] = cached
+	find("gitlab.example.com/group/sub/project/a")
+	if fake.Requests() == requests {
+		t.Errorf("expected expired project to be looked up again")
+	}
+
+	// webhooks for the project invalidate it, e.g. after a rename
+	p.webhookSecret = "secret"
+	header := http.Header{}
+	header.Set("X-Gitlab-Token", "secret")
+	body := fmt.Sprintf(`{"object_kind": "push", "project": {"id": %d, "path_with_namespace": "group/renamed", "web_url": "%s/group/renamed"}}`, project.Id, fake.URL)
+	if _, err := p.ParseWebhook(header, []byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.projects.byId(project.Id); ok {
+		t.Errorf("expected project to be invalidated by webhook")
+	}
+}
+
+// authUpstream records the credentials of requests passed down the chain
+type authUpstream struct {
+	creds *upstream.Credentials
+}
+
+func (a *authUpstream) Get(key string) ([]byte, int, error) {
+	a.creds = nil
+	return []byte("proxy"), http.StatusOK, nil
+}
+
+func (a *authUpstream) GetAs(key string, creds *upstream.Credentials) ([]byte, int, error) {
+	a.creds = creds
+	return []byte("user"), http.StatusOK, nil
+}
+
+func TestPassThrough(t *testing.T) {
+	_, fake, _ := newTestUpstream(t)
+	inner := &authUpstream{}
+	p := NewGitLabUpstream(&Config{
+		Host:          fake.Host(),
+		ModulePrefix:  "gitlab.example.com",
+		Token:         "token",
+		PassThrough:   true,
+		WebhookSecret: "secret",
+		Transport:     fake.Client().Transport,
+		Upstream:      inner,
+	}).(*privateGitLabUpstream)
+	const list = "/gitlab.example.com/group/sub/project/@v/list"
+	user := &upstream.Credentials{Username: "user", Password: "token"}
+
+	// the proxy's own token is never used
+	if _, status, _ := p.Get(list); status != http.StatusUnauthorized {
+		t.Errorf("expected unauthenticated request to be refused, got %d", status)
+	}
+	if b, status, err := p.GetAs(list, user); err != nil || status != http.StatusOK || string(b) != "v1.0.0\nv1.1.0-rc.1\nv1.1.0\nv1.2.0\n" {
+		t.Errorf("unexpected response with user credentials: %d %q %v", status, b, err)
+	}
+	if _, status, _ := p.GetAs(list, &upstream.Credentials{Username: "user", Password: "wrong"}); status != http.StatusUnauthorized {
+		t.Errorf("expected rejected user credentials to be reported as such, got %d", status)
+	}
+	if root, err := p.RepoRoot("gitlab.example.com/group/sub/project"); root != nil || err != nil {
+		t.Errorf("expected no repo root in pass through mode, got %v %v", root, err)
+	}
+	if status, err := p.Status("gitlab.example.com/group/sub/project"); status != nil || err != nil {
+		t.Errorf("expected no status in pass through mode, got %v %v", status, err)
+	}
+
+	// other requests are passed on with the credentials
+	if b, _, _ := p.GetAs("/example.com/other/@v/list", user); string(b) != "user" || inner.creds != user {
+		t.Errorf("expected credentials to be passed down the chain, got %q %v", b, inner.creds)
+	}
+
+	header := http.Header{}
+	header.Set("X-Gitlab-Token", "secret")
+	body := fmt.Sprintf(`{"object_kind": "tag_push", "ref": "refs/tags/v1.3.0", "checkout_sha": "abc", "project": {"path_with_namespace": "group/sub/project", "web_url": "%s/group/sub/project"}}`, fake.URL)
+	change, err := p.ParseWebhook(header, []byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(change.Modules) != 1 || len(change.Versions) != 0 {
+		t.Errorf("expected invalidation without prefetch in pass through mode, got %+v", change)
+	}
+}
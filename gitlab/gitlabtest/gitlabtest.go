@@ -0,0 +1,337 @@
+// Package gitlabtest provides an in-memory fake of the gitlab v4 API backed by
+// local git repositories, for testing the gitlab upstream without a real
+// gitlab instance.
+package gitlabtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Server is a fake gitlab v4 API. Projects are served from local git
+// repositories added with AddProject.
+type Server struct {
+	*httptest.Server
+
+	// Token is the private token required for api requests, if set
+	Token string
+
+	mu       sync.Mutex
+	projects []*project
+	requests int
+	// limit rejects requests with 429 after this many requests, if set
+	limit int
+}
+
+type project struct {
+	id   int
+	path string
+	dir  string
+}
+
+// NewServer starts a fake gitlab API over TLS. Use Client().Transport to
+// make requests that trust its certificate.
+func NewServer() *Server {
+	s := &Server{}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Host returns the host:port of the server
+func (s *Server) Host() string {
+	u, _ := url.Parse(s.URL)
+	return u.Host
+}
+
+// AddProject serves the git repository in dir as the project at
+// projectPath, e.g. group/subgroup/project, and returns its id
+func (s *Server) AddProject(projectPath, dir string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := len(s.projects) + 1
+	s.projects = append(s.projects, &project{id: id, path: projectPath, dir: dir})
+	return id
+}
+
+// Requests returns the number of api requests served
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// SetRateLimit makes the server respond with 429 Too Many Requests once more
+// than limit requests have been made. Zero disables the limit.
+func (s *Server) SetRateLimit(limit int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limit = limit
+	s.requests = 0
+}
+
+func (s *Server) findProject(idOrPath string) *project {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, err := strconv.Atoi(idOrPath)
+	for _, p := range s.projects {
+		if err == nil && p.id == id || p.path == idOrPath {
+			return p
+		}
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func notFound(w http.ResponseWriter, what string) {
+	writeJSON(w, http.StatusNotFound, map[string]string{"message": fmt.Sprintf("404 %s Not Found", what)})
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests++
+	requests, limit := s.requests, s.limit
+	s.mu.Unlock()
+	if limit > 0 {
+		remaining := limit - requests
+		if remaining < 0 {
+			remaining = 0
+		}
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(limit))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+		if requests > limit {
+			w.Header().Set("Retry-After", "0")
+			writeJSON(w, http.StatusTooManyRequests, map[string]string{"message": "Retry later"})
+			return
+		}
+	}
+	if s.Token != "" && r.Header.Get("Private-Token") != s.Token &&
+		r.Header.Get("Authorization") != "Bearer "+s.Token &&
+		r.Header.Get("JOB-TOKEN") != s.Token {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"message": "401 Unauthorized"})
+		return
+	}
+	// project paths are url encoded, so split the escaped path
+	parts := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/api/v4/"), "/")
+	if len(parts) < 2 || parts[0] != "projects" {
+		notFound(w, "Endpoint")
+		return
+	}
+	idOrPath, _ := url.PathUnescape(parts[1])
+	p := s.findProject(idOrPath)
+	if p == nil {
+		notFound(w, "Project")
+		return
+	}
+	if len(parts) == 2 {
+		writeJSON(w, http.StatusOK, p.info(s.URL))
+		return
+	}
+	if len(parts) < 4 || parts[2] != "repository" {
+		notFound(w, "Endpoint")
+		return
+	}
+	rest := make([]string, 0, len(parts)-4)
+	for _, part := range parts[4:] {
+		unescaped, _ := url.PathUnescape(part)
+		rest = append(rest, unescaped)
+	}
+	query := r.URL.Query()
+	switch parts[3] {
+	case "tags":
+		p.tags(w, r)
+	case "commits":
+		if len(rest) == 0 {
+			p.commits(w, query.Get("ref_name"))
+			return
+		}
+		p.commit(w, strings.Join(rest, "/"))
+	case "merge_base":
+		p.mergeBase(w, query["refs[]"])
+	case "files":
+		p.file(w, strings.Join(rest, "/"), query.Get("ref"))
+	case "archive.zip":
+		p.archive(w, query.Get("sha"))
+	default:
+		notFound(w, "Endpoint")
+	}
+}
+
+func (p *project) git(args ...string) ([]byte, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = p.dir
+	return cmd.Output()
+}
+
+func (p *project) info(baseURL string) map[string]interface{} {
+	branch, _ := p.git("symbolic-ref", "--short", "HEAD")
+	webURL := fmt.Sprintf("%s/%s", baseURL, p.path)
+	return map[string]interface{}{
+		"id":                  p.id,
+		"path_with_namespace": p.path,
+		"web_url":             webURL,
+		"http_url_to_repo":    webURL + ".git",
+		"default_branch":      strings.TrimSpace(string(branch)),
+	}
+}
+
+type commitJSON struct {
+	Id        string `json:"id"`
+	CreatedAt string `json:"created_at"`
+}
+
+// resolve returns the commit a ref points to
+func (p *project) resolve(ref string) (commitJSON, bool) {
+	if ref == "" || strings.HasPrefix(ref, "-") {
+		return commitJSON{}, false
+	}
+	out, err := p.git("log", "-1", "--format=%H %cI", ref+"^{commit}", "--")
+	if err != nil {
+		return commitJSON{}, false
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) != 2 {
+		return commitJSON{}, false
+	}
+	return commitJSON{Id: fields[0], CreatedAt: fields[1]}, true
+}
+
+func (p *project) tags(w http.ResponseWriter, r *http.Request) {
+	out, err := p.git("tag", "--list")
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"message": err.Error()})
+		return
+	}
+	type tagJSON struct {
+		Name   string     `json:"name"`
+		Commit commitJSON `json:"commit"`
+	}
+	tags := []tagJSON{}
+	for _, name := range strings.Fields(string(out)) {
+		if c, ok := p.resolve("refs/tags/" + name); ok {
+			tags = append(tags, tagJSON{Name: name, Commit: c})
+		}
+	}
+	// gitlab pages lists with 20 entries by default and at most 100
+	perPage, _ := strconv.Atoi(r.URL.Query().Get("per_page"))
+	if perPage <= 0 {
+		perPage = 20
+	}
+	if perPage > 100 {
+		perPage = 100
+	}
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	start, end := (page-1)*perPage, page*perPage
+	if start > len(tags) {
+		start = len(tags)
+	}
+	w.Header().Set("X-Page", strconv.Itoa(page))
+	w.Header().Set("X-Total", strconv.Itoa(len(tags)))
+	if end < len(tags) {
+		w.Header().Set("X-Next-Page", strconv.Itoa(page+1))
+	} else {
+		end = len(tags)
+		w.Header().Set("X-Next-Page", "")
+	}
+	writeJSON(w, http.StatusOK, tags[start:end])
+}
+
+func (p *project) commits(w http.ResponseWriter, ref string) {
+	if ref == "" {
+		ref = "HEAD"
+	}
+	out, err := p.git("log", "--format=%H %cI", ref, "--")
+	if err != nil {
+		notFound(w, "Commit")
+		return
+	}
+	commits := []commitJSON{}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			commits = append(commits, commitJSON{Id: fields[0], CreatedAt: fields[1]})
+		}
+	}
+	writeJSON(w, http.StatusOK, commits)
+}
+
+func (p *project) commit(w http.ResponseWriter, ref string) {
+	c, ok := p.resolve(ref)
+	if !ok {
+		notFound(w, "Commit")
+		return
+	}
+	writeJSON(w, http.StatusOK, c)
+}
+
+func (p *project) mergeBase(w http.ResponseWriter, refs []string) {
+	if len(refs) != 2 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "Provide exactly two refs"})
+		return
+	}
+	a, aok := p.resolve(refs[0])
+	b, bok := p.resolve(refs[1])
+	if !aok || !bok {
+		notFound(w, "Commit")
+		return
+	}
+	out, err := p.git("merge-base", a.Id, b.Id)
+	if err != nil {
+		notFound(w, "Merge Base")
+		return
+	}
+	p.commit(w, strings.TrimSpace(string(out)))
+}
+
+func (p *project) file(w http.ResponseWriter, filePath, ref string) {
+	c, ok := p.resolve(ref)
+	if !ok {
+		notFound(w, "Commit")
+		return
+	}
+	content, err := p.git("show", c.Id+":"+filePath)
+	if err != nil {
+		notFound(w, "File")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"file_path": filePath,
+		"ref":       ref,
+		"encoding":  "base64",
+		"content":   content,
+	})
+}
+
+func (p *project) archive(w http.ResponseWriter, ref string) {
+	if ref == "" {
+		ref = "HEAD"
+	}
+	c, ok := p.resolve(ref)
+	if !ok {
+		notFound(w, "Commit")
+		return
+	}
+	prefix := fmt.Sprintf("%s-%s/", path.Base(p.path), c.Id)
+	out, err := p.git("archive", "--format=zip", "--prefix="+prefix, c.Id)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"message": err.Error()})
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Write(out)
+}
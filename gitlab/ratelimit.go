@@ -0,0 +1,146 @@
+package gitlab
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/wozz/modpox/upstream"
+)
+
+const (
+	defaultMaxConcurrency = 4
+	// maxRetryWait caps how long a request waits for the rate limit to reset
+	maxRetryWait = 30 * time.Second
+	maxRetries   = 3
+)
+
+// rateLimiter queues api requests and tracks the RateLimit-* headers sent by
+// gitlab, so a burst of requests doesn't exhaust the budget of a shared token
+type rateLimiter struct {
+	sem     chan struct{}
+	reserve int
+
+	mu        sync.Mutex
+	limit     int
+	remaining int
+	reset     time.Time
+	// requests counts api responses by status code
+	requests    map[int]int64
+	throttled   int64
+	rateLimited int64
+}
+
+func newRateLimiter(maxConcurrency, reserve int) *rateLimiter {
+	if maxConcurrency <= 0 {
+		maxConcurrency = defaultMaxConcurrency
+	}
+	return &rateLimiter{
+		sem:       make(chan struct{}, maxConcurrency),
+		reserve:   reserve,
+		remaining: -1,
+		requests:  make(map[int]int64),
+	}
+}
+
+// acquire blocks until a request may be sent. If the remaining budget is at
+// or below the reserve, it first waits for the rate limit window to reset,
+// without holding a concurrency slot so other requests aren't stalled.
+func (rl *rateLimiter) acquire(budgeted bool) {
+	if budgeted {
+		if wait := rl.wait(); wait > 0 {
+			log.Printf("gitlab rate limit budget exhausted, waiting %s", wait)
+			time.Sleep(wait)
+		}
+	}
+	rl.sem <- struct{}{}
+}
+
+// wait returns how long a budgeted request has to wait for the rate limit
+// window to reset
+func (rl *rateLimiter) wait() time.Duration {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if rl.remaining < 0 || rl.remaining > rl.reserve {
+		return 0
+	}
+	wait := time.Until(rl.reset)
+	if wait <= 0 {
+		return 0
+	}
+	rl.throttled++
+	if wait > maxRetryWait {
+		wait = maxRetryWait
+	}
+	return wait
+}
+
+func (rl *rateLimiter) release() {
+	<-rl.sem
+}
+
+// update records the response status and rate limit headers
+func (rl *rateLimiter) update(resp *http.Response, budgeted bool) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.requests[resp.StatusCode]++
+	if resp.StatusCode == http.StatusTooManyRequests {
+		rl.rateLimited++
+	}
+	if !budgeted {
+		return
+	}
+	if v, err := strconv.Atoi(resp.Header.Get("RateLimit-Limit")); err == nil {
+		rl.limit = v
+	}
+	if v, err := strconv.Atoi(resp.Header.Get("RateLimit-Remaining")); err == nil {
+		rl.remaining = v
+	}
+	if v, err := strconv.ParseInt(resp.Header.Get("RateLimit-Reset"), 10, 64); err == nil {
+		rl.reset = time.Unix(v, 0)
+	}
+}
+
+// retryAfter returns how long to wait before retrying a 429 response
+func retryAfter(resp *http.Response) time.Duration {
+	wait := time.Second
+	if v, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		wait = time.Duration(v) * time.Second
+	} else if v, err := strconv.ParseInt(resp.Header.Get("RateLimit-Reset"), 10, 64); err == nil {
+		wait = time.Until(time.Unix(v, 0))
+	}
+	if wait > maxRetryWait {
+		wait = maxRetryWait
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	return wait
+}
+
+// Metrics implements upstream.MetricsUpstream
+func (p *privateGitLabUpstream) Metrics() []upstream.Metric {
+	rl := p.limiter
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	labels := map[string]string{"host": p.host}
+	metrics := []upstream.Metric{
+		{Name: "modpox_gitlab_ratelimit_limit", Help: "Request limit of the current gitlab rate limit window.", Labels: labels, Value: float64(rl.limit)},
+		{Name: "modpox_gitlab_ratelimit_remaining", Help: "Requests remaining in the current gitlab rate limit window.", Labels: labels, Value: float64(rl.remaining)},
+		{Name: "modpox_gitlab_ratelimit_reset_timestamp_seconds", Help: "Time the current gitlab rate limit window resets.", Labels: labels, Value: float64(rl.reset.Unix())},
+		{Name: "modpox_gitlab_throttled_total", Help: "Requests delayed to stay within the gitlab rate limit budget.", Labels: labels, Value: float64(rl.throttled)},
+		{Name: "modpox_gitlab_rate_limited_total", Help: "Requests rejected by gitlab with 429 Too Many Requests.", Labels: labels, Value: float64(rl.rateLimited)},
+	}
+	for status, count := range rl.requests {
+		metrics = append(metrics, upstream.Metric{
+			Name:   "modpox_gitlab_api_requests_total",
+			Help:   "Requests made to the gitlab API by response status.",
+			Labels: map[string]string{"host": p.host, "status": fmt.Sprint(status)},
+			Value:  float64(count),
+		})
+	}
+	return metrics
+}
@@ -0,0 +1,78 @@
+package gitlab
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// rateLimitResponse returns a response with gitlab rate limit headers
+func rateLimitResponse(status, limit, remaining int, reset time.Time) *http.Response {
+	header := http.Header{}
+	header.Set("RateLimit-Limit", strconv.Itoa(limit))
+	header.Set("RateLimit-Remaining", strconv.Itoa(remaining))
+	header.Set("RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+	return &http.Response{StatusCode: status, Header: header}
+}
+
+func TestRateLimiterUpdate(t *testing.T) {
+	rl := newRateLimiter(1, 10)
+	if wait := rl.wait(); wait != 0 {
+		t.Errorf("expected no wait before the first response, got %s", wait)
+	}
+	reset := time.Now().Add(20 * time.Second)
+	rl.update(rateLimitResponse(http.StatusOK, 600, 11, reset), true)
+	if wait := rl.wait(); wait != 0 {
+		t.Errorf("expected no wait above the reserve, got %s", wait)
+	}
+	rl.update(rateLimitResponse(http.StatusOK, 600, 10, reset), true)
+	if wait := rl.wait(); wait <= 10*time.Second || wait > 20*time.Second {
+		t.Errorf("expected to wait for the window to reset, got %s", wait)
+	}
+	rl.update(rateLimitResponse(http.StatusOK, 600, 0, time.Now().Add(time.Hour)), true)
+	if wait := rl.wait(); wait != maxRetryWait {
+		t.Errorf("expected wait to be capped at %s, got %s", maxRetryWait, wait)
+	}
+	rl.update(rateLimitResponse(http.StatusOK, 600, 0, time.Now().Add(-time.Second)), true)
+	if wait := rl.wait(); wait != 0 {
+		t.Errorf("expected no wait after the window reset, got %s", wait)
+	}
+
+	// responses to requests made with end user credentials don't count
+	// against the proxy's budget
+	rl.update(rateLimitResponse(http.StatusTooManyRequests, 600, 0, time.Now().Add(time.Hour)), false)
+	if wait := rl.wait(); wait != 0 {
+		t.Errorf("unbudgeted responses must not affect the budget, got wait %s", wait)
+	}
+	if rl.limit != 600 || rl.throttled != 2 || rl.rateLimited != 1 || rl.requests[http.StatusOK] != 4 || rl.requests[http.StatusTooManyRequests] != 1 {
+		t.Errorf("unexpected counters: limit %d throttled %d rate limited %d requests %v", rl.limit, rl.throttled, rl.rateLimited, rl.requests)
+	}
+}
+
+func TestRateLimiterAcquire(t *testing.T) {
+	rl := newRateLimiter(1, 0)
+	rl.mu.Lock()
+	rl.remaining = 0
+	rl.reset = time.Now().Add(300 * time.Millisecond)
+	rl.mu.Unlock()
+
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		rl.acquire(true)
+		rl.release()
+		close(done)
+	}()
+	// the throttled request must not hold the only slot while it waits
+	time.Sleep(50 * time.Millisecond)
+	rl.acquire(false)
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("unbudgeted request was blocked by a throttled one for %s", elapsed)
+	}
+	rl.release()
+	<-done
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Errorf("throttled request did not wait for the reset, took %s", elapsed)
+	}
+}
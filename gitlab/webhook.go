@@ -0,0 +1,75 @@
+package gitlab
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/wozz/modpox/forge"
+	"github.com/wozz/modpox/upstream"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// ErrInvalidWebhookToken is returned for webhooks with a missing or wrong
+// secret token
+var ErrInvalidWebhookToken = errors.New("invalid webhook token")
+
+type webhookEvent struct {
+	ObjectKind  string `json:"object_kind"`
+	Ref         string `json:"ref"`
+	CheckoutSHA string `json:"checkout_sha"`
+	Project     struct {
+		Id     int    `json:"id"`
+		Path   string `json:"path_with_namespace"`
+		WebURL string `json:"web_url"`
+	} `json:"project"`
+}
+
+// ParseWebhook implements upstream.WebhookUpstream for push and tag push
+// events. The X-Gitlab-Token header must match the configured secret.
+func (p *privateGitLabUpstream) ParseWebhook(header http.Header, body []byte) (*upstream.ModuleChange, error) {
+	var event webhookEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, fmt.Errorf("%w: could not parse webhook json", err)
+	}
+	u, err := url.Parse(event.Project.WebURL)
+	if err != nil || u.Host != p.host {
+		return nil, nil
+	}
+	if p.webhookSecret == "" {
+		return nil, fmt.Errorf("webhooks are not enabled for %s", p.host)
+	}
+	if subtle.ConstantTimeCompare([]byte(header.Get("X-Gitlab-Token")), []byte(p.webhookSecret)) != 1 {
+		return nil, ErrInvalidWebhookToken
+	}
+	p.projects.invalidate(event.Project.Path, event.Project.Id)
+	modPath := fmt.Sprintf("%s/%s", p.prefix, event.Project.Path)
+	change := &upstream.ModuleChange{Modules: []string{modPath}}
+	switch event.ObjectKind {
+	case "push":
+	case "tag_push":
+		tag := strings.TrimPrefix(event.Ref, "refs/tags/")
+		if !forge.IsCanonical(tag) {
+			break
+		}
+		tagPath := modPath
+		if major := semver.Major(tag); major != "v0" && major != "v1" {
+			tagPath = modPath + "/" + major
+			change.Modules = append(change.Modules, tagPath)
+		}
+		// tag pushes with an empty checkout sha are tag deletions. In pass
+		// through mode versions are only fetched with end user credentials,
+		// so they are not prefetched.
+		if event.CheckoutSHA != "" && !p.passThrough {
+			change.Versions = append(change.Versions, module.Version{Path: tagPath, Version: tag})
+		}
+	default:
+		return nil, fmt.Errorf("unsupported webhook event: %s", event.ObjectKind)
+	}
+	return change, nil
+}
@@ -0,0 +1,46 @@
+package gitlab
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestParseWebhook(t *testing.T) {
+	p := NewGitLabUpstream(&Config{
+		Host:          "gitlab.example.com",
+		WebhookSecret: "secret",
+	}).(*privateGitLabUpstream)
+	header := http.Header{}
+	header.Set("X-Gitlab-Token", "secret")
+
+	tagPush := []byte(`{
+		"object_kind": "tag_push",
+		"ref": "refs/tags/v2.1.0",
+		"checkout_sha": "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7",
+		"project": {
+			"path_with_namespace": "group/project",
+			"web_url": "https://gitlab.example.com/group/project"
+		}
+	}`)
+	change, err := p.ParseWebhook(header, tagPush)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(change.Modules) != 2 || change.Modules[0] != "gitlab.example.com/group/project" || change.Modules[1] != "gitlab.example.com/group/project/v2" {
+		t.Errorf("unexpected modules: %v", change.Modules)
+	}
+	if len(change.Versions) != 1 || change.Versions[0].Path != "gitlab.example.com/group/project/v2" || change.Versions[0].Version != "v2.1.0" {
+		t.Errorf("unexpected versions: %v", change.Versions)
+	}
+
+	header.Set("X-Gitlab-Token", "wrong")
+	if _, err := p.ParseWebhook(header, tagPush); !errors.Is(err, ErrInvalidWebhookToken) {
+		t.Errorf("expected invalid token error, got %v", err)
+	}
+
+	other := []byte(`{"object_kind": "push", "project": {"web_url": "https://gitlab.other.com/group/project"}}`)
+	if change, err := p.ParseWebhook(header, other); change != nil || err != nil {
+		t.Errorf("expected webhook for other host to be ignored, got %v %v", change, err)
+	}
+}
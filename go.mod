@@ -1,3 +1,5 @@
 module github.com/wozz/modpox
 
-go 1.13
+go 1.17
+
+require golang.org/x/mod v0.10.0
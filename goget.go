@@ -0,0 +1,47 @@
+package modpox
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+)
+
+var goGetTemplate = template.Must(template.New("go-get").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta name="go-import" content="{{.Root}} {{.VCS}} {{.RepoURL}}">
+<meta name="go-source" content="{{.Root}} {{.Home}} {{.Dir}} {{.File}}">
+</head>
+<body>
+go get {{.Root}}
+</body>
+</html>
+`))
+
+func isGoGet(r *http.Request) bool {
+	return r.URL.Query().Get("go-get") == "1"
+}
+
+// serveGoGet answers ?go-get=1 discovery requests with go-import and
+// go-source meta tags for the repository containing the import path
+func (s *Server) serveGoGet(w http.ResponseWriter, r *http.Request) {
+	importPath := strings.Trim(r.URL.Path, "/")
+	for _, iu := range s.imports {
+		root, err := iu.RepoRoot(importPath)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Printf("repo root error: %s %v", importPath, err)
+			return
+		}
+		if root == nil {
+			continue
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := goGetTemplate.Execute(w, root); err != nil {
+			log.Printf("go-get template error: %v", err)
+		}
+		return
+	}
+	http.NotFound(w, r)
+}
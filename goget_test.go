@@ -0,0 +1,66 @@
+package modpox
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/wozz/modpox/upstream"
+)
+
+type importUpstream map[string]*upstream.RepoRoot
+
+func (iu importUpstream) Get(key string) ([]byte, int, error) {
+	return nil, http.StatusNotFound, nil
+}
+
+func (iu importUpstream) RepoRoot(importPath string) (*upstream.RepoRoot, error) {
+	if importPath == "gitlab.example.com/broken" {
+		return nil, errors.New("api error")
+	}
+	return iu[importPath], nil
+}
+
+func TestServeGoGet(t *testing.T) {
+	root := &upstream.RepoRoot{
+		Root:    "gitlab.example.com/group/project",
+		VCS:     "git",
+		RepoURL: "https://gitlab.example.com/group/project.git",
+		Home:    "https://gitlab.example.com/group/project",
+		Dir:     "https://gitlab.example.com/group/project/-/tree/main{/dir}",
+		File:    "https://gitlab.example.com/group/project/-/blob/main{/dir}/{file}#L{line}",
+	}
+	srv := &Server{imports: []upstream.ImportUpstream{
+		importUpstream{},
+		importUpstream{"gitlab.example.com/group/project/pkg": root},
+	}}
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		srv.serveGoGet(w, httptest.NewRequest(http.MethodGet, path+"?go-get=1", nil))
+		return w
+	}
+
+	w := get("/gitlab.example.com/group/project/pkg")
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+	for _, want := range []string{
+		`<meta name="go-import" content="gitlab.example.com/group/project git https://gitlab.example.com/group/project.git">`,
+		`<meta name="go-source" content="gitlab.example.com/group/project https://gitlab.example.com/group/project https://gitlab.example.com/group/project/-/tree/main{/dir} https://gitlab.example.com/group/project/-/blob/main{/dir}/{file}#L{line}">`,
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("missing %s in:\n%s", want, w.Body)
+		}
+	}
+	if w := get("/example.com/unknown"); w.Code != http.StatusNotFound {
+		t.Errorf("expected not found for unknown import path, got %d", w.Code)
+	}
+	if w := get("/gitlab.example.com/broken"); w.Code != http.StatusInternalServerError {
+		t.Errorf("expected error status, got %d", w.Code)
+	}
+	if isGoGet(httptest.NewRequest(http.MethodGet, "/gitlab.example.com/group/project/@v/list", nil)) {
+		t.Errorf("module requests are not go-get requests")
+	}
+}
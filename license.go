@@ -0,0 +1,430 @@
+package modpox
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/wozz/modpox/upstream"
+	"golang.org/x/mod/module"
+)
+
+// LicensePolicy denies or flags module versions by the licenses found in
+// their zips. Licenses are SPDX identifiers like MIT or GPL-3.0, matched
+// with path.Match patterns like GPL-*. UNKNOWN matches license files that
+// couldn't be classified and NONE modules without license files. An empty
+// policy only classifies licenses for the report.
+type LicensePolicy struct {
+	// Deny refuses .zip downloads of versions with these licenses
+	Deny []string
+	// Flag logs .zip downloads of versions with these licenses
+	Flag []string
+	// Exceptions are GOPRIVATE style module path patterns the policy
+	// doesn't apply to, e.g. modules developed in house
+	Exceptions []string
+	// Nested also classifies license files in subdirectories, like those
+	// of third party code copied into a module. By default only license
+	// files in the module root are classified.
+	Nested bool
+}
+
+// LicenseFile is the classification of a license file in a module zip
+type LicenseFile struct {
+	// Path is the file path relative to the module root
+	Path    string
+	License string
+}
+
+// licenseKey is the cache key of the classification stored alongside a
+// .zip file
+func licenseKey(zipKey string) string {
+	return strings.TrimSuffix(zipKey, ".zip") + ".license"
+}
+
+var licenseFileRE = regexp.MustCompile(`(?i)^(licen[cs]e|copying|unlicense)([.\-_].*)?$`)
+
+// sourceExts are the extensions of files named like license files that
+// contain code, like license.go or license_test.go
+var sourceExts = map[string]bool{".go": true, ".s": true, ".c": true, ".h": true, ".py": true, ".js": true, ".sh": true}
+
+// isLicenseFile reports whether a file name is that of a license file
+func isLicenseFile(name string) bool {
+	return licenseFileRE.MatchString(name) && !sourceExts[strings.ToLower(path.Ext(name))]
+}
+
+// classifyZip finds and classifies the license files in the root of a
+// module zip, or in all directories if nested is set
+func classifyZip(m module.Version, b []byte, nested bool) ([]LicenseFile, error) {
+	r, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid module zip", err)
+	}
+	files := []LicenseFile{}
+	for _, f := range r.File {
+		// module zip files are prefixed with module@version/
+		name := strings.TrimPrefix(f.Name, m.String()+"/")
+		if name == f.Name || f.FileInfo().IsDir() || !isLicenseFile(path.Base(name)) {
+			continue
+		}
+		if !nested && strings.Contains(name, "/") {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, fmt.Errorf("%w: could not read %s", err, f.Name)
+		}
+		// license texts are short, the start is enough to classify them
+		text, err := io.ReadAll(io.LimitReader(rc, 64<<10))
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%w: could not read %s", err, f.Name)
+		}
+		files = append(files, LicenseFile{Path: name, License: classifyLicense(string(text))})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files, nil
+}
+
+var spdxRE = regexp.MustCompile(`SPDX-License-Identifier:\s*([A-Za-z0-9.\-+]+)`)
+
+// licenseTexts identify licenses by phrases of their text, checked in order
+var licenseTexts = []struct {
+	license string
+	phrases []string
+}{
+	{"MPL-2.0", []string{"mozilla public license", "2.0"}},
+	{"Apache-2.0", []string{"apache license", "version 2.0"}},
+	{"EPL-2.0", []string{"eclipse public license - v 2.0"}},
+	{"SSPL-1.0", []string{"server side public license"}},
+	{"BUSL-1.1", []string{"business source license"}},
+	{"MIT", []string{"permission is hereby granted, free of charge, to any person obtaining a copy"}},
+	{"ISC", []string{"permission to use, copy, modify, and", "distribute this software for any purpose with or without fee is hereby granted"}},
+	{"BSD-3-Clause", []string{"redistribution and use in source and binary forms", "neither the name"}},
+	{"BSD-3-Clause", []string{"redistribution and use in source and binary forms", "the names of its contributors may not be used"}},
+	{"BSD-2-Clause", []string{"redistribution and use in source and binary forms"}},
+	{"Unlicense", []string{"this is free and unencumbered software released into the public domain"}},
+	{"CC0-1.0", []string{"cc0 1.0 universal"}},
+}
+
+// gnuLicenses are the GNU license titles by license family. The GPL texts
+// mention each other, so the title appearing first decides.
+var gnuLicenses = []struct {
+	title    string
+	license  string
+	versions []string
+}{
+	{"gnu affero general public license", "AGPL", []string{"3.0"}},
+	{"gnu lesser general public license", "LGPL", []string{"3.0", "2.1"}},
+	{"gnu library general public license", "LGPL", []string{"2.0"}},
+	{"gnu general public license", "GPL", []string{"3.0", "2.0", "1.0"}},
+}
+
+// classifyLicense returns the SPDX identifier of a license text, or
+// UNKNOWN
+func classifyLicense(text string) string {
+	if m := spdxRE.FindStringSubmatch(text); m != nil {
+		return m[1]
+	}
+	text = strings.ToLower(strings.Join(strings.Fields(text), " "))
+	first, gnu := -1, -1
+	for i, l := range gnuLicenses {
+		if j := strings.Index(text, l.title); j >= 0 && (first < 0 || j < first) {
+			first, gnu = j, i
+		}
+	}
+	if gnu >= 0 && first < 500 {
+		l := gnuLicenses[gnu]
+		title := text[first:]
+		if len(title) > 200 {
+			title = title[:200]
+		}
+		for _, v := range l.versions {
+			if strings.Contains(title, "version "+strings.TrimSuffix(v, ".0")) {
+				return l.license + "-" + v
+			}
+		}
+		return l.license
+	}
+	for _, l := range licenseTexts {
+		found := true
+		for _, p := range l.phrases {
+			found = found && strings.Contains(text, p)
+		}
+		if found {
+			return l.license
+		}
+	}
+	return "UNKNOWN"
+}
+
+// licenseUpstream classifies the licenses of module zips as they are
+// fetched, stores the classification in the cache next to the zip and in
+// the backend, if any, and enforces the license policy on .zip downloads
+type licenseUpstream struct {
+	cache    *cache
+	backend  Backend
+	policy   *LicensePolicy
+	upstream upstream.Upstream
+
+	mu      sync.Mutex
+	denied  int
+	flagged int
+}
+
+func newLicenseUpstream(c *cache, backend Backend, policy *LicensePolicy, u upstream.Upstream) *licenseUpstream {
+	return &licenseUpstream{cache: c, backend: backend, policy: policy, upstream: u}
+}
+
+func (l *licenseUpstream) Get(key string) ([]byte, int, error) {
+	return l.get(key, nil)
+}
+
+// GetAs implements upstream.AuthUpstream
+func (l *licenseUpstream) GetAs(key string, creds *upstream.Credentials) ([]byte, int, error) {
+	return l.get(key, creds)
+}
+
+func (l *licenseUpstream) get(key string, creds *upstream.Credentials) ([]byte, int, error) {
+	if strings.HasSuffix(key, ".license") {
+		// classifications are served by the report endpoint only
+		return []byte{}, http.StatusNotFound, nil
+	}
+	m, ext, ok := parseDownloadKey(key)
+	if !ok || ext != ".zip" {
+		return upstream.GetAs(l.upstream, key, creds)
+	}
+	if files, ok := l.stored(key); ok {
+		if reason := l.check(m, files); reason != "" {
+			return []byte(reason), http.StatusForbidden, nil
+		}
+	}
+	b, status, err := upstream.GetAs(l.upstream, key, creds)
+	if err != nil || status != http.StatusOK {
+		return b, status, err
+	}
+	files, ok := l.stored(key)
+	if !ok {
+		if files, err = l.classify(m, key, b); err != nil {
+			// the zip is not valid, which the go command reports itself
+			log.Printf("license: %v", err)
+			return b, status, nil
+		}
+	}
+	if reason := l.check(m, files); reason != "" {
+		return []byte(reason), http.StatusForbidden, nil
+	}
+	return b, status, nil
+}
+
+// stored returns the stored classification of a zip. Classifications
+// found in the backend are cached again.
+func (l *licenseUpstream) stored(key string) ([]LicenseFile, bool) {
+	b, status := l.cache.get(licenseKey(key))
+	if status != http.StatusOK && l.backend != nil {
+		var err error
+		if b, status, err = l.backend.Get(licenseKey(key)); err != nil {
+			return nil, false
+		}
+		if status == http.StatusOK {
+			l.cache.set(licenseKey(key), b, status)
+		}
+	}
+	if status != http.StatusOK {
+		return nil, false
+	}
+	var files []LicenseFile
+	if err := json.Unmarshal(b, &files); err != nil {
+		return nil, false
+	}
+	return files, true
+}
+
+// classify classifies a zip and stores the classification. Zips are
+// immutable, so the backend keeps it, while the cache keeps it as long as
+// the zip.
+func (l *licenseUpstream) classify(m module.Version, key string, zip []byte) ([]LicenseFile, error) {
+	files, err := classifyZip(m, zip, l.policy.Nested)
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not classify %s", err, key)
+	}
+	b, err := json.Marshal(files)
+	if err != nil {
+		return nil, err
+	}
+	l.cache.set(licenseKey(key), b, http.StatusOK)
+	if l.backend != nil {
+		if err := l.backend.Put(licenseKey(key), b, http.StatusOK); err != nil {
+			log.Printf("license: could not store classification of %s: %v", key, err)
+		}
+	}
+	return files, nil
+}
+
+// violations describes the license files whose licenses match the
+// patterns, or the missing license file if NONE matches
+func violations(files []LicenseFile, patterns []string) []string {
+	var found []string
+	match := func(license, desc string) {
+		for _, p := range patterns {
+			if ok, _ := path.Match(p, license); ok {
+				found = append(found, desc)
+				return
+			}
+		}
+	}
+	if len(files) == 0 {
+		match("NONE", "no license file")
+	}
+	for _, f := range files {
+		match(f.License, fmt.Sprintf("%s is %s", f.Path, f.License))
+	}
+	return found
+}
+
+// check returns why a version is denied by the policy, and logs versions
+// that are flagged
+func (l *licenseUpstream) check(m module.Version, files []LicenseFile) string {
+	if module.MatchPrefixPatterns(strings.Join(l.policy.Exceptions, ","), m.Path) {
+		return ""
+	}
+	if denied := violations(files, l.policy.Deny); len(denied) > 0 {
+		log.Printf("license: denied %s: %s", m, strings.Join(denied, ", "))
+		l.mu.Lock()
+		l.denied++
+		l.mu.Unlock()
+		return fmt.Sprintf("%s is blocked by license policy: %s\n", m, strings.Join(denied, ", "))
+	}
+	if flagged := violations(files, l.policy.Flag); len(flagged) > 0 {
+		log.Printf("license: WARNING flagged %s: %s", m, strings.Join(flagged, ", "))
+		l.mu.Lock()
+		l.flagged++
+		l.mu.Unlock()
+	}
+	return ""
+}
+
+// Metrics implements upstream.MetricsUpstream
+func (l *licenseUpstream) Metrics() []upstream.Metric {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return []upstream.Metric{
+		{Name: "modpox_license_denied_total", Help: "Downloads denied by the license policy.", Value: float64(l.denied)},
+		{Name: "modpox_license_flagged_total", Help: "Downloads flagged by the license policy.", Value: float64(l.flagged)},
+	}
+}
+
+// licenseReport is the license usage of a module version
+type licenseReport struct {
+	Module   string
+	Version  string
+	Licenses []LicenseFile
+	// Status is allowed, flagged or denied by the current policy
+	Status string
+}
+
+// report lists the versions with a classification stored in the backend
+// and the cached zips, which are classified if they weren't yet
+func (l *licenseUpstream) report() []licenseReport {
+	// zips maps the key of each zip to report to the cached zip, if any
+	zips := make(map[string][]byte)
+	l.cache.mu.RLock()
+	for key, v := range l.cache.c {
+		// zips fetched with end user credentials are reported once
+		key := unscopedKey(key)
+		if _, ext, ok := parseDownloadKey(key); ok && ext == ".zip" && v.status == http.StatusOK && !v.expired() {
+			zips[key] = v.value
+		}
+	}
+	l.cache.mu.RUnlock()
+	if l.backend != nil {
+		keys, err := l.backend.List("/")
+		if err != nil {
+			log.Printf("license: could not list stored classifications: %v", err)
+		}
+		for _, key := range keys {
+			if !strings.HasSuffix(key, ".license") {
+				continue
+			}
+			key = strings.TrimSuffix(key, ".license") + ".zip"
+			if _, ok := zips[key]; !ok {
+				zips[key] = nil
+			}
+		}
+	}
+	reports := []licenseReport{}
+	for key, zip := range zips {
+		m, _, ok := parseDownloadKey(key)
+		if !ok {
+			continue
+		}
+		files, ok := l.stored(key)
+		if !ok {
+			if zip == nil {
+				continue
+			}
+			var err error
+			if files, err = l.classify(m, key, zip); err != nil {
+				log.Printf("license: %v", err)
+				continue
+			}
+		}
+		status := "allowed"
+		if !module.MatchPrefixPatterns(strings.Join(l.policy.Exceptions, ","), m.Path) {
+			if len(violations(files, l.policy.Deny)) > 0 {
+				status = "denied"
+			} else if len(violations(files, l.policy.Flag)) > 0 {
+				status = "flagged"
+			}
+		}
+		reports = append(reports, licenseReport{Module: m.Path, Version: m.Version, Licenses: files, Status: status})
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		if reports[i].Module != reports[j].Module {
+			return reports[i].Module < reports[j].Module
+		}
+		return reports[i].Version < reports[j].Version
+	})
+	return reports
+}
+
+// newLicenseReportHandler serves the license usage of all known modules at
+// /admin/licenses, with the number of versions per license
+func newLicenseReportHandler(srv *Server) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if srv.licenses == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		modules := srv.licenses.report()
+		usage := make(map[string]int)
+		for _, m := range modules {
+			seen := make(map[string]bool)
+			if len(m.Licenses) == 0 {
+				seen["NONE"] = true
+			}
+			for _, f := range m.Licenses {
+				seen[f.License] = true
+			}
+			for license := range seen {
+				usage[license]++
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(struct {
+			Usage   map[string]int
+			Modules []licenseReport
+		}{usage, modules})
+		if err != nil {
+			log.Printf("json encode error: %v", err)
+		}
+	}
+}
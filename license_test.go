@@ -0,0 +1,153 @@
+package modpox
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/mod/module"
+)
+
+const (
+	mitText = `MIT License
+
+Copyright (c) 2023 Example
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction.`
+	gpl3Text = `                    GNU GENERAL PUBLIC LICENSE
+                       Version 3, 29 June 2007
+
+ Copyright (C) 2007 Free Software Foundation, Inc. <https://fsf.org/>
+
+  13. Use with the GNU Affero General Public License.`
+)
+
+func TestClassifyLicense(t *testing.T) {
+	for text, want := range map[string]string{
+		mitText:  "MIT",
+		gpl3Text: "GPL-3.0",
+		"GNU AFFERO GENERAL PUBLIC LICENSE\nVersion 3, 19 November 2007":                           "AGPL-3.0",
+		"GNU LESSER GENERAL PUBLIC LICENSE\n Version 2.1, February 1999":                           "LGPL-2.1",
+		"GNU GENERAL PUBLIC LICENSE\nVersion 2, June 1991":                                         "GPL-2.0",
+		"Apache License\nVersion 2.0, January 2004\nhttp://www.apache.org/licenses/":               "Apache-2.0",
+		"Mozilla Public License Version 2.0\n1.12. \"Secondary License\" means the GNU General...": "MPL-2.0",
+		"Redistribution and use in source and binary forms, with or without\nmodification... " +
+			"Neither the name of Google Inc. nor the names of its contributors": "BSD-3-Clause",
+		"// SPDX-License-Identifier: EUPL-1.2\n": "EUPL-1.2",
+		"All rights reserved.":                   "UNKNOWN",
+	} {
+		if got := classifyLicense(text); got != want {
+			t.Errorf("%.40q: got %s, want %s", text, got, want)
+		}
+	}
+}
+
+func TestLicenseUpstream(t *testing.T) {
+	next := mapUpstream{
+		"/example.com/mit/@v/v1.0.0.zip":      testZip(t, "example.com/mit@v1.0.0/", map[string]string{"LICENSE": mitText, "go.mod": "module example.com/mit\n"}),
+		"/example.com/gpl/@v/v1.0.0.zip":      testZip(t, "example.com/gpl@v1.0.0/", map[string]string{"LICENSE": mitText, "third_party/x/COPYING": gpl3Text}),
+		"/example.com/none/@v/v1.0.0.zip":     testZip(t, "example.com/none@v1.0.0/", map[string]string{"go.mod": "module example.com/none\n"}),
+		"/corp.example.com/gpl/@v/v1.0.0.zip": testZip(t, "corp.example.com/gpl@v1.0.0/", map[string]string{"LICENSE.md": gpl3Text}),
+		"/example.com/gpl/@v/v1.0.0.mod":      []byte("module example.com/gpl\n"),
+	}
+	c := &cache{c: make(map[string]*value)}
+	backend := NewDirBackend(t.TempDir())
+	l := newLicenseUpstream(c, backend, &LicensePolicy{
+		Deny:       []string{"GPL-*", "AGPL-*"},
+		Flag:       []string{"NONE", "UNKNOWN"},
+		Exceptions: []string{"corp.example.com"},
+		Nested:     true,
+	}, next)
+	for key, want := range map[string]struct {
+		status int
+		body   string
+	}{
+		"/example.com/mit/@v/v1.0.0.zip":      {http.StatusOK, ""},
+		"/example.com/gpl/@v/v1.0.0.zip":      {http.StatusForbidden, "example.com/gpl@v1.0.0 is blocked by license policy: third_party/x/COPYING is GPL-3.0\n"},
+		"/example.com/gpl/@v/v1.0.0.mod":      {http.StatusOK, "module example.com/gpl\n"},
+		"/example.com/none/@v/v1.0.0.zip":     {http.StatusOK, ""},
+		"/corp.example.com/gpl/@v/v1.0.0.zip": {http.StatusOK, ""},
+		"/example.com/mit/@v/v1.0.0.license":  {http.StatusNotFound, ""},
+	} {
+		b, status, err := l.Get(key)
+		if err != nil || status != want.status || (want.body != "" && string(b) != want.body) {
+			t.Errorf("%s: got %d %.80q %v, want %d %q", key, status, b, err, want.status, want.body)
+		}
+	}
+	b, _ := c.get("/example.com/gpl/@v/v1.0.0.license")
+	if string(b) != `[{"Path":"LICENSE","License":"MIT"},{"Path":"third_party/x/COPYING","License":"GPL-3.0"}]` {
+		t.Errorf("unexpected stored classification %s", b)
+	}
+	// stored classifications are enforced without fetching the zip, also
+	// once they expired from the cache
+	delete(next, "/example.com/gpl/@v/v1.0.0.zip")
+	if _, status, _ := l.Get("/example.com/gpl/@v/v1.0.0.zip"); status != http.StatusForbidden {
+		t.Errorf("stored classification not enforced: %d", status)
+	}
+	c.invalidate("/example.com/gpl/@v/v1.0.0.license")
+	if _, status, _ := l.Get("/example.com/gpl/@v/v1.0.0.zip"); status != http.StatusForbidden {
+		t.Errorf("classification in the backend not enforced: %d", status)
+	}
+	if m := l.Metrics(); m[0].Value != 3 || m[1].Value != 1 {
+		t.Errorf("unexpected metrics %v", m)
+	}
+
+	// the report covers the classifications in the backend and cached
+	// zips, whether or not they were classified when they were fetched
+	c.set("/example.com/mit/@v/v1.0.0.zip", next["/example.com/mit/@v/v1.0.0.zip"], http.StatusOK)
+	c.set("/example.com/none/@v/v1.0.0.zip", next["/example.com/none/@v/v1.0.0.zip"], http.StatusOK)
+	c.invalidate("/example.com/none/@v/v1.0.0.license")
+	backend.Delete("/example.com/none/@v/v1.0.0.license")
+	srv := &Server{adminToken: "secret", licenses: l}
+	h := requireAdmin(srv, newLicenseReportHandler(srv))
+	if w := adminRequest(h, http.MethodGet, "/admin/licenses", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected unauthenticated request to be refused, got %d", w.Code)
+	}
+	w := adminRequest(h, http.MethodGet, "/admin/licenses", "secret")
+	var report struct {
+		Usage   map[string]int
+		Modules []licenseReport
+	}
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	var statuses []string
+	for _, m := range report.Modules {
+		statuses = append(statuses, m.Module+" "+m.Status)
+	}
+	want := []string{"corp.example.com/gpl allowed", "example.com/gpl denied", "example.com/mit allowed", "example.com/none flagged"}
+	if !reflect.DeepEqual(statuses, want) || !reflect.DeepEqual(report.Usage, map[string]int{"MIT": 2, "GPL-3.0": 2, "NONE": 1}) {
+		t.Errorf("unexpected report %+v", report)
+	}
+	if !strings.Contains(w.Header().Get("Content-Type"), "json") {
+		t.Errorf("unexpected content type %q", w.Header().Get("Content-Type"))
+	}
+}
+
+func TestClassifyZip(t *testing.T) {
+	m := module.Version{Path: "example.com/m", Version: "v1.0.0"}
+	zip := testZip(t, "example.com/m@v1.0.0/", map[string]string{
+		"LICENSE":               mitText,
+		"third_party/x/COPYING": gpl3Text,
+		// code named like license files is not classified
+		"license.go":          "package m\n",
+		"license_test.go":     "package m\n",
+		"internal/copying.go": "package copying\n",
+	})
+	for nested, want := range map[bool][]LicenseFile{
+		false: {{Path: "LICENSE", License: "MIT"}},
+		true:  {{Path: "LICENSE", License: "MIT"}, {Path: "third_party/x/COPYING", License: "GPL-3.0"}},
+	} {
+		files, err := classifyZip(m, zip, nested)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(files, want) {
+			t.Errorf("nested %v: got %+v, want %+v", nested, files, want)
+		}
+	}
+}
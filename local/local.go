@@ -0,0 +1,204 @@
+// Package local implements an upstream serving modules from a GOPROXY
+// directory layout on the local filesystem, like GOPROXY=file://..., or from
+// the cache/download directory of a GOMODCACHE
+package local
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/wozz/modpox/upstream"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// Config is used to configure the local upstream
+type Config struct {
+	Upstream upstream.Upstream
+	// Dir is a directory in the GOPROXY layout, e.g. created with
+	// go mod download, or a GOMODCACHE directory, whose cache/download
+	// subdirectory is used
+	Dir string
+	// ModulePrefix limits the modules served from Dir, by default all
+	// modules found in Dir are served. Version lists and latest versions of
+	// these modules only include the versions in Dir.
+	ModulePrefix string
+}
+
+type localUpstream struct {
+	root     string
+	prefix   string
+	upstream upstream.Upstream
+}
+
+// NewLocalUpstream creates a new upstream serving modules from a directory.
+// Requests for modules that are not in the directory are passed on to the
+// next upstream. For modules that are in the directory, @v/list and @latest
+// only report the versions stored locally and don't include newer versions
+// from the next upstream, so the directory pins the versions the go command
+// resolves.
+func NewLocalUpstream(config *Config) upstream.Upstream {
+	root := config.Dir
+	if info, err := os.Stat(filepath.Join(root, "cache", "download")); err == nil && info.IsDir() {
+		root = filepath.Join(root, "cache", "download")
+	}
+	return &localUpstream{
+		root:     root,
+		prefix:   config.ModulePrefix,
+		upstream: config.Upstream,
+	}
+}
+
+func (l *localUpstream) Get(key string) ([]byte, int, error) {
+	if l.prefix != "" && !strings.HasPrefix(key, fmt.Sprintf("/%s/", l.prefix)) {
+		return l.upstream.Get(key)
+	}
+	b, status, err := l.handle(key)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Printf("%s not found in %s", key, l.root)
+		return l.upstream.Get(key)
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: localUpstream error", err)
+	}
+	return b, status, nil
+}
+
+// modDir returns the @v directory of the escaped module path in key. Keys
+// that are not valid module paths are reported as not existing.
+func (l *localUpstream) modDir(key string) (string, error) {
+	i := strings.LastIndex(key, "/@")
+	if i < 0 {
+		return "", fs.ErrNotExist
+	}
+	escaped := strings.TrimPrefix(key[:i], "/")
+	// unescaping validates the path, so it can't escape the root
+	if _, err := module.UnescapePath(escaped); err != nil {
+		return "", fs.ErrNotExist
+	}
+	return filepath.Join(l.root, filepath.FromSlash(escaped), "@v"), nil
+}
+
+func (l *localUpstream) handle(key string) ([]byte, int, error) {
+	dir, err := l.modDir(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, err := os.Stat(dir); err != nil {
+		return nil, 0, err
+	}
+	if strings.HasSuffix(key, "/@v/list") {
+		versions, err := l.versions(dir)
+		if err != nil {
+			return nil, 0, err
+		}
+		var b bytes.Buffer
+		for _, v := range versions {
+			if !module.IsPseudoVersion(v) {
+				fmt.Fprintln(&b, v)
+			}
+		}
+		return b.Bytes(), http.StatusOK, nil
+	}
+	if strings.HasSuffix(key, "/@latest") {
+		versions, err := l.versions(dir)
+		if err != nil {
+			return nil, 0, err
+		}
+		latest := latestVersion(versions)
+		if latest == "" {
+			return []byte("no versions found"), http.StatusNotFound, nil
+		}
+		escaped, err := module.EscapeVersion(latest)
+		if err != nil {
+			return nil, 0, err
+		}
+		b, err := os.ReadFile(filepath.Join(dir, escaped+".info"))
+		return b, http.StatusOK, err
+	}
+	for _, ext := range []string{".info", ".mod", ".zip"} {
+		if !strings.HasSuffix(key, ext) {
+			continue
+		}
+		name := key[strings.LastIndex(key, "/@v/")+len("/@v/"):]
+		version, err := module.UnescapeVersion(strings.TrimSuffix(name, ext))
+		if err != nil || strings.Contains(name, "/") || semver.Canonical(version) == "" {
+			// queries can't be resolved without a repository
+			return nil, 0, fs.ErrNotExist
+		}
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, 0, err
+		}
+		return b, http.StatusOK, nil
+	}
+	return nil, 0, fs.ErrNotExist
+}
+
+// versions returns the versions in dir that can be downloaded completely,
+// sorted by semver precedence
+func (l *localUpstream) versions(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		files[e.Name()] = true
+	}
+	var versions []string
+	for name := range files {
+		if !strings.HasSuffix(name, ".info") {
+			continue
+		}
+		escaped := strings.TrimSuffix(name, ".info")
+		version, err := module.UnescapeVersion(escaped)
+		if err != nil || semver.Canonical(version) == "" {
+			continue
+		}
+		// the module cache keeps go.mod files of versions that were only
+		// needed for module graph pruning, without a zip
+		if !files[escaped+".mod"] || !files[escaped+".zip"] {
+			continue
+		}
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return semver.Compare(versions[i], versions[j]) < 0
+	})
+	return versions, nil
+}
+
+// latestVersion returns the highest release, falling back to the highest
+// prerelease and then to the highest pseudo-version, like the go command
+func latestVersion(versions []string) string {
+	latest := ""
+	for _, v := range versions {
+		if !module.IsPseudoVersion(v) && semver.Prerelease(v) == "" {
+			latest = v
+		}
+	}
+	if latest != "" {
+		return latest
+	}
+	for _, v := range versions {
+		if !module.IsPseudoVersion(v) {
+			latest = v
+		}
+	}
+	if latest != "" {
+		return latest
+	}
+	if len(versions) > 0 {
+		return versions[len(versions)-1]
+	}
+	return ""
+}
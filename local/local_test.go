@@ -0,0 +1,133 @@
+package local
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type fakeUpstream struct {
+	keys []string
+}
+
+func (f *fakeUpstream) Get(key string) ([]byte, int, error) {
+	f.keys = append(f.keys, key)
+	return []byte("upstream"), http.StatusOK, nil
+}
+
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLocalUpstream(t *testing.T) {
+	const pseudo = "v1.2.1-0.20230101000000-abcdefabcdef"
+	files := map[string]string{
+		"example.com/!foo/bar/@v/v1.0.0.info":         `{"Version":"v1.0.0"}`,
+		"example.com/!foo/bar/@v/v1.0.0.mod":          "module example.com/Foo/bar\n",
+		"example.com/!foo/bar/@v/v1.0.0.zip":          "zip",
+		"example.com/!foo/bar/@v/v1.2.0.info":         `{"Version":"v1.2.0"}`,
+		"example.com/!foo/bar/@v/v1.2.0.mod":          "module example.com/Foo/bar\n",
+		"example.com/!foo/bar/@v/v1.2.0.zip":          "zip",
+		"example.com/!foo/bar/@v/v1.3.0-rc.1.info":    `{"Version":"v1.3.0-rc.1"}`,
+		"example.com/!foo/bar/@v/v1.3.0-rc.1.mod":     "module example.com/Foo/bar\n",
+		"example.com/!foo/bar/@v/v1.3.0-rc.1.zip":     "zip",
+		"example.com/!foo/bar/@v/" + pseudo + ".info": `{"Version":"` + pseudo + `"}`,
+		"example.com/!foo/bar/@v/" + pseudo + ".mod":  "module example.com/Foo/bar\n",
+		"example.com/!foo/bar/@v/" + pseudo + ".zip":  "zip",
+		// only the go.mod is in the module cache
+		"example.com/!foo/bar/@v/v1.1.0.info":       `{"Version":"v1.1.0"}`,
+		"example.com/!foo/bar/@v/v1.1.0.mod":        "module example.com/Foo/bar\n",
+		"example.com/!foo/bar/@v/v1.1.0.lock":       "",
+		"example.com/pseudo/@v/" + pseudo + ".info": `{"Version":"` + pseudo + `"}`,
+		"example.com/pseudo/@v/" + pseudo + ".mod":  "module example.com/pseudo\n",
+		"example.com/pseudo/@v/" + pseudo + ".zip":  "zip",
+		// versions with upper case letters are escaped like module paths
+		"example.com/upper/@v/v1.0.0-!r!c.1.info": `{"Version":"v1.0.0-RC.1"}`,
+		"example.com/upper/@v/v1.0.0-!r!c.1.mod":  "module example.com/upper\n",
+		"example.com/upper/@v/v1.0.0-!r!c.1.zip":  "zip",
+		"secret.txt":                              "secret",
+	}
+	for name, dir := range map[string]string{"proxy dir": "", "module cache": "cache/download"} {
+		t.Run(name, func(t *testing.T) {
+			root := t.TempDir()
+			writeFiles(t, filepath.Join(root, filepath.FromSlash(dir)), files)
+			next := &fakeUpstream{}
+			l := NewLocalUpstream(&Config{Upstream: next, Dir: root})
+			get := func(t *testing.T, key string, wantStatus int) string {
+				t.Helper()
+				b, status, err := l.Get(key)
+				if err != nil {
+					t.Fatalf("%s: unexpected error: %v", key, err)
+				}
+				if status != wantStatus {
+					t.Fatalf("%s: got status %d, want %d: %s", key, status, wantStatus, b)
+				}
+				return string(b)
+			}
+
+			const mod = "/example.com/!foo/bar"
+			if got := get(t, mod+"/@v/list", http.StatusOK); got != "v1.0.0\nv1.2.0\nv1.3.0-rc.1\n" {
+				t.Errorf("unexpected list: %q", got)
+			}
+			if got := get(t, mod+"/@latest", http.StatusOK); got != `{"Version":"v1.2.0"}` {
+				t.Errorf("unexpected latest: %s", got)
+			}
+			if got := get(t, "/example.com/pseudo/@latest", http.StatusOK); got != `{"Version":"`+pseudo+`"}` {
+				t.Errorf("unexpected latest pseudo-version: %s", got)
+			}
+			if got := get(t, "/example.com/pseudo/@v/list", http.StatusOK); got != "" {
+				t.Errorf("pseudo-versions should not be listed: %q", got)
+			}
+			if got := get(t, "/example.com/upper/@latest", http.StatusOK); got != `{"Version":"v1.0.0-RC.1"}` {
+				t.Errorf("unexpected latest escaped version: %s", got)
+			}
+			if got := get(t, mod+"/@v/v1.0.0.mod", http.StatusOK); got != "module example.com/Foo/bar\n" {
+				t.Errorf("unexpected go.mod: %q", got)
+			}
+			get(t, mod+"/@v/v1.1.0.mod", http.StatusOK)
+			if len(next.keys) != 0 {
+				t.Fatalf("unexpected upstream requests: %v", next.keys)
+			}
+
+			// misses and queries are passed on to the next upstream
+			for _, key := range []string{
+				mod + "/@v/v1.1.0.zip",
+				mod + "/@v/main.info",
+				"/example.com/missing/@v/list",
+				"/example.com/../../secret.txt/@v/list",
+				"/example.com/!foo/bar/@v/../../../../secret.txt",
+			} {
+				if got := get(t, key, http.StatusOK); got != "upstream" {
+					t.Errorf("%s: expected upstream response, got %q", key, got)
+				}
+			}
+			if len(next.keys) != 5 {
+				t.Errorf("unexpected upstream requests: %v", next.keys)
+			}
+		})
+	}
+}
+
+func TestLocalUpstreamPrefix(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"example.com/a/@v/v1.0.0.info": `{"Version":"v1.0.0"}`,
+		"example.com/a/@v/v1.0.0.mod":  "module example.com/a\n",
+		"example.com/a/@v/v1.0.0.zip":  "zip",
+	})
+	next := &fakeUpstream{}
+	l := NewLocalUpstream(&Config{Upstream: next, Dir: root, ModulePrefix: "other.com"})
+	if b, _, _ := l.Get("/example.com/a/@v/list"); string(b) != "upstream" {
+		t.Errorf("module outside prefix should not be served, got %q", b)
+	}
+}
@@ -0,0 +1,38 @@
+package modpox
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/wozz/modpox/upstream"
+)
+
+// scopedCacheUpstream is a cachingUpstream that also caches responses for
+// requests made with end user credentials, partitioned by the scope of the
+// credentials so users never see data fetched on behalf of someone else
+type scopedCacheUpstream struct {
+	cachingUpstream
+}
+
+// GetAs implements upstream.AuthUpstream
+func (sc *scopedCacheUpstream) GetAs(key string, creds *upstream.Credentials) ([]byte, int, error) {
+	scopedKey := fmt.Sprintf("%s:%s", creds.Scope(), key)
+	if b, i := sc.cache.get(scopedKey); b != nil && i != 0 {
+		return b, i, nil
+	}
+	b, i, err := upstream.GetAs(sc.upstream, key, creds)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: scopedCacheUpstream error", err)
+	}
+	sc.cache.set(scopedKey, b, i)
+	return b, i, nil
+}
+
+// unscopedKey returns the key a cache key was requested with, removing the
+// scope of keys cached for requests made with end user credentials
+func unscopedKey(key string) string {
+	if i := strings.Index(key, ":/"); i >= 0 && !strings.HasPrefix(key, "/") {
+		return key[i+1:]
+	}
+	return key
+}
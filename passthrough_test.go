@@ -0,0 +1,134 @@
+package modpox
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/wozz/modpox/forge/forgetest"
+	"github.com/wozz/modpox/gitlab"
+	"github.com/wozz/modpox/gitlab/gitlabtest"
+	"github.com/wozz/modpox/policy"
+	"github.com/wozz/modpox/upstream"
+)
+
+// userUpstream answers requests with the name of the user they were made
+// for and counts them
+type userUpstream struct {
+	requests int
+}
+
+func (u *userUpstream) Get(key string) ([]byte, int, error) {
+	u.requests++
+	return []byte("proxy"), http.StatusOK, nil
+}
+
+func (u *userUpstream) GetAs(key string, creds *upstream.Credentials) ([]byte, int, error) {
+	u.requests++
+	return []byte(creds.Username), http.StatusOK, nil
+}
+
+func TestScopedCacheUpstream(t *testing.T) {
+	c := &cache{c: make(map[string]*value)}
+	inner := &userUpstream{}
+	sc := &scopedCacheUpstream{cachingUpstream{cache: c, upstream: inner}}
+	const key = "/gitlab.example.com/group/project/@v/v1.0.0.mod"
+	alice := &upstream.Credentials{Username: "alice", Password: "a"}
+	bob := &upstream.Credentials{Username: "bob", Password: "b"}
+
+	for i := 0; i < 2; i++ {
+		if b, _, _ := sc.GetAs(key, alice); string(b) != "alice" {
+			t.Errorf("unexpected response for alice: %q", b)
+		}
+	}
+	if inner.requests != 1 {
+		t.Errorf("expected scoped response to be cached, got %d requests", inner.requests)
+	}
+	if b, _, _ := sc.GetAs(key, bob); string(b) != "bob" {
+		t.Errorf("users must not see responses fetched for someone else, got %q", b)
+	}
+	if b, _, _ := sc.Get(key); string(b) != "proxy" {
+		t.Errorf("requests without credentials must not see scoped responses, got %q", b)
+	}
+
+	c.invalidate(key)
+	if len(c.c) != 0 {
+		t.Errorf("expected scoped copies to be invalidated: %v", c.c)
+	}
+	for key, want := range map[string]string{
+		"/example.com/m/@v/list":              "/example.com/m/@v/list",
+		"0123abcd:/example.com/m/@v/list":     "/example.com/m/@v/list",
+		"/example.com/m:/@v/list":             "/example.com/m:/@v/list",
+		"/sumdb/sum.golang.org/lookup/a@v1.0": "/sumdb/sum.golang.org/lookup/a@v1.0",
+	} {
+		if got := unscopedKey(key); got != want {
+			t.Errorf("%s: got %s, want %s", key, got, want)
+		}
+	}
+}
+
+// TestPassThroughChecks makes sure requests with end user credentials are
+// subject to the same policy and quarantine as any other request
+func TestPassThroughChecks(t *testing.T) {
+	fake := gitlabtest.NewServer()
+	defer fake.Close()
+	fake.Token = "token"
+	for _, name := range []string{"lib", "denied"} {
+		repo := forgetest.NewRepo(t)
+		repo.Commit(map[string]string{"go.mod": "module gitlab.example.com/group/" + name + "\n"})
+		repo.Tag("v1.0.0")
+		fake.AddProject("group/"+name, repo.Dir)
+	}
+	public := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request to the public proxy: %s", r.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer public.Close()
+
+	s := NewServerWithConfig(&Config{
+		Proxies: []string{public.URL},
+		GitLab: []*gitlab.Config{{
+			Host:         fake.Host(),
+			ModulePrefix: "gitlab.example.com",
+			PassThrough:  true,
+			Transport:    fake.Client().Transport,
+		}},
+		AuditInterval: time.Hour,
+		Policy: &policy.Config{Rules: []*policy.Rule{
+			{Action: policy.Deny, Module: "gitlab.example.com/group/denied"},
+			{Action: policy.Deny, Module: "example.com/denied"},
+		}},
+	})
+	s.auditor.quarantine["gitlab.example.com/group/lib@v1.0.0"] = "test"
+	proxy := httptest.NewServer(s.srv.Handler)
+	defer proxy.Close()
+	get := func(path string, auth bool) int {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, proxy.URL+path, nil)
+		if auth {
+			req.SetBasicAuth("user", "token")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for path, want := range map[string]int{
+		"/gitlab.example.com/group/lib/@v/list":          http.StatusOK,
+		"/gitlab.example.com/group/lib/@v/v1.0.0.zip":    http.StatusForbidden,
+		"/gitlab.example.com/group/denied/@v/list":       http.StatusForbidden,
+		"/gitlab.example.com/group/denied/@v/v1.0.0.mod": http.StatusForbidden,
+		"/example.com/denied/@v/v1.0.0.mod":              http.StatusForbidden,
+	} {
+		if got := get(path, true); got != want {
+			t.Errorf("%s: got status %d, want %d", path, got, want)
+		}
+	}
+	if got := get("/gitlab.example.com/group/lib/@v/list", false); got != http.StatusUnauthorized {
+		t.Errorf("expected credentials to be required, got %d", got)
+	}
+}
@@ -0,0 +1,238 @@
+package policy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// AccessRequest is a denied attempt to use a module version that is not on
+// the allowlist, kept for review until it is approved or rejected
+type AccessRequest struct {
+	Module    string
+	Version   string
+	Count     int
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// Allowlist is a set of approved module versions. A policy with an
+// allowlist denies versions no rule allows unless they are approved, and
+// records the denied attempts as access requests.
+type Allowlist struct {
+	// dir stores the approved versions in the allowlist file, one
+	// "module version" pair per line, and the access requests in
+	// requests.json. Without dir the allowlist is kept in memory.
+	dir string
+
+	mu       sync.Mutex
+	approved map[module.Version]bool
+	requests map[module.Version]*AccessRequest
+}
+
+// OpenAllowlist loads the allowlist and access requests stored in dir,
+// which is created if it doesn't exist. An empty dir keeps them in memory.
+func OpenAllowlist(dir string) (*Allowlist, error) {
+	a := &Allowlist{
+		dir:      dir,
+		approved: make(map[module.Version]bool),
+		requests: make(map[module.Version]*AccessRequest),
+	}
+	if dir == "" {
+		return a, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("%w: could not create allowlist dir", err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "allowlist"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: could not read allowlist", err)
+	}
+	for i, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 || module.Check(fields[0], fields[1]) != nil {
+			return nil, fmt.Errorf("invalid allowlist entry on line %d: %q", i+1, line)
+		}
+		a.approved[module.Version{Path: fields[0], Version: fields[1]}] = true
+	}
+	b, err = os.ReadFile(filepath.Join(dir, "requests.json"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: could not read access requests", err)
+	}
+	if len(b) > 0 {
+		var requests []*AccessRequest
+		if err := json.Unmarshal(b, &requests); err != nil {
+			return nil, fmt.Errorf("%w: invalid access requests", err)
+		}
+		for _, r := range requests {
+			a.requests[module.Version{Path: r.Module, Version: r.Version}] = r
+		}
+	}
+	return a, nil
+}
+
+// Allowed reports whether a version is approved
+func (a *Allowlist) Allowed(m module.Version) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.approved[m]
+}
+
+// Approve adds versions to the allowlist and closes their access requests
+func (a *Allowlist) Approve(mods ...module.Version) error {
+	for _, m := range mods {
+		if err := module.Check(m.Path, m.Version); err != nil {
+			return fmt.Errorf("%w: can't approve %s", err, m)
+		}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var added []module.Version
+	for _, m := range mods {
+		if !a.approved[m] {
+			a.approved[m] = true
+			added = append(added, m)
+		}
+		delete(a.requests, m)
+	}
+	if a.dir == "" || len(added) == 0 {
+		return a.saveRequests()
+	}
+	f, err := os.OpenFile(filepath.Join(a.dir, "allowlist"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("%w: could not open allowlist", err)
+	}
+	var b bytes.Buffer
+	for _, m := range added {
+		fmt.Fprintf(&b, "%s %s\n", m.Path, m.Version)
+		log.Printf("policy: approved %s", m)
+	}
+	if _, err := f.Write(b.Bytes()); err != nil {
+		f.Close()
+		return fmt.Errorf("%w: could not write allowlist", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("%w: could not write allowlist", err)
+	}
+	return a.saveRequests()
+}
+
+// ImportGoSum approves the module versions listed in a go.sum file and
+// returns how many there were
+func (a *Allowlist) ImportGoSum(r io.Reader) (int, error) {
+	seen := make(map[module.Version]bool)
+	var mods []module.Version
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) != 3 {
+			continue
+		}
+		m := module.Version{Path: fields[0], Version: strings.TrimSuffix(fields[1], "/go.mod")}
+		if !seen[m] {
+			seen[m] = true
+			mods = append(mods, m)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return 0, fmt.Errorf("%w: could not read go.sum", err)
+	}
+	return len(mods), a.Approve(mods...)
+}
+
+// Reject closes an access request without approving it
+func (a *Allowlist) Reject(m module.Version) (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.requests[m]; !ok {
+		return false, nil
+	}
+	delete(a.requests, m)
+	log.Printf("policy: rejected access request for %s", m)
+	return true, a.saveRequests()
+}
+
+// Requests returns the open access requests, most recent first
+func (a *Allowlist) Requests() []AccessRequest {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	requests := make([]AccessRequest, 0, len(a.requests))
+	for _, r := range a.requests {
+		requests = append(requests, *r)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		if !requests[i].LastSeen.Equal(requests[j].LastSeen) {
+			return requests[i].LastSeen.After(requests[j].LastSeen)
+		}
+		if requests[i].Module != requests[j].Module {
+			return requests[i].Module < requests[j].Module
+		}
+		return semver.Compare(requests[i].Version, requests[j].Version) < 0
+	})
+	return requests
+}
+
+// record opens or updates the access request for a denied version
+func (a *Allowlist) record(m module.Version) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now().UTC()
+	r, ok := a.requests[m]
+	if !ok {
+		r = &AccessRequest{Module: m.Path, Version: m.Version, FirstSeen: now}
+		a.requests[m] = r
+		log.Printf("policy: access request recorded for %s", m)
+	}
+	r.Count++
+	r.LastSeen = now
+	if err := a.saveRequests(); err != nil {
+		log.Printf("policy: could not save access requests: %v", err)
+	}
+}
+
+// saveRequests writes the access requests, a.mu must be held
+func (a *Allowlist) saveRequests() error {
+	if a.dir == "" {
+		return nil
+	}
+	requests := make([]*AccessRequest, 0, len(a.requests))
+	for _, r := range a.requests {
+		requests = append(requests, r)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].FirstSeen.Before(requests[j].FirstSeen)
+	})
+	b, err := json.MarshalIndent(requests, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(a.dir, ".tmp-")
+	if err != nil {
+		return fmt.Errorf("%w: could not save access requests", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("%w: could not save access requests", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("%w: could not save access requests", err)
+	}
+	return os.Rename(tmp.Name(), filepath.Join(a.dir, "requests.json"))
+}
@@ -0,0 +1,114 @@
+package policy
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"golang.org/x/mod/module"
+)
+
+func TestAllowlist(t *testing.T) {
+	dir := t.TempDir()
+	a, err := OpenAllowlist(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gosum := `example.com/a v1.0.0 h1:AAAA=
+example.com/a v1.0.0/go.mod h1:BBBB=
+example.com/a v1.1.0/go.mod h1:CCCC=
+`
+	if n, err := a.ImportGoSum(strings.NewReader(gosum)); err != nil || n != 2 {
+		t.Fatalf("import failed: %d %v", n, err)
+	}
+	next := mapUpstream{
+		"/example.com/a/@v/list":         "v1.0.0\nv1.1.0\nv1.2.0\n",
+		"/example.com/a/@latest":         `{"Version":"v1.2.0"}`,
+		"/example.com/a/@v/v1.0.0.zip":   "zip",
+		"/example.com/a/@v/v1.1.0.mod":   "mod",
+		"/example.com/a/@v/v1.2.0.info":  `{"Version":"v1.2.0"}`,
+		"/example.com/bad/@v/v1.0.0.zip": "zip",
+	}
+	u := NewPolicyUpstream(&Config{
+		Upstream:  next,
+		Rules:     []*Rule{{Action: Deny, Module: "example.com/bad", Reason: "known bad"}},
+		Allowlist: a,
+	})
+	if err := a.Approve(module.Version{Path: "example.com/bad", Version: "v1.0.0"}); err != nil {
+		t.Fatal(err)
+	}
+	const recorded = "example.com/a@v1.2.0 is blocked by policy: it is not on the allowlist, an access request was recorded for review\n"
+	for key, want := range map[string]struct {
+		status int
+		body   string
+	}{
+		"/example.com/a/@v/list":        {http.StatusOK, "v1.0.0\nv1.1.0\n"},
+		"/example.com/a/@v/v1.0.0.zip":  {http.StatusOK, "zip"},
+		"/example.com/a/@v/v1.1.0.mod":  {http.StatusOK, "mod"},
+		"/example.com/a/@latest":        {http.StatusForbidden, recorded},
+		"/example.com/a/@v/v1.2.0.info": {http.StatusForbidden, recorded},
+		// only the .info is fetched to check that the version exists
+		"/example.com/a/@v/v1.2.0.zip":   {http.StatusForbidden, recorded},
+		"/example.com/bad/@v/v1.0.0.zip": {http.StatusForbidden, "example.com/bad@v1.0.0 is blocked by policy: known bad\n"},
+		// versions that don't exist upstream aren't recorded
+		"/example.com/a/@v/v9.0.0.zip": {http.StatusNotFound, "not found"},
+	} {
+		b, status, err := u.Get(key)
+		if err != nil || status != want.status || string(b) != want.body {
+			t.Errorf("%s: got %d %q %v, want %d %q", key, status, b, err, want.status, want.body)
+		}
+	}
+	requests := a.Requests()
+	if len(requests) != 1 || requests[0].Module != "example.com/a" || requests[0].Version != "v1.2.0" || requests[0].Count != 3 {
+		t.Fatalf("unexpected access requests: %+v", requests)
+	}
+
+	// approvals and requests are stored in dir
+	a, err = OpenAllowlist(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.Allowed(module.Version{Path: "example.com/a", Version: "v1.1.0"}) || len(a.Requests()) != 1 {
+		t.Fatalf("allowlist not stored: %+v", a.Requests())
+	}
+	if err := a.Approve(module.Version{Path: "example.com/a", Version: "v1.2.0"}); err != nil {
+		t.Fatal(err)
+	}
+	u = NewPolicyUpstream(&Config{Upstream: next, Allowlist: a})
+	if b, status, _ := u.Get("/example.com/a/@latest"); status != http.StatusOK {
+		t.Errorf("approved version not served: %d %q", status, b)
+	}
+	if ok, err := a.Reject(module.Version{Path: "example.com/a", Version: "v1.2.0"}); ok || err != nil {
+		t.Errorf("approved request still open: %v %v", ok, err)
+	}
+	if _, err := a.ImportGoSum(strings.NewReader("example.com/a ../v1 h1:AAAA=\n")); err == nil {
+		t.Errorf("invalid go.sum entry imported")
+	}
+}
+
+func TestAllowlistIncompatible(t *testing.T) {
+	a, err := OpenAllowlist("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Approve(module.Version{Path: "example.com/c", Version: "v2.0.0+incompatible"}); err != nil {
+		t.Fatal(err)
+	}
+	u := NewPolicyUpstream(&Config{
+		Upstream: mapUpstream{
+			"/example.com/c/@v/v2.0.0+incompatible.zip":  "zip",
+			"/example.com/c/@v/v2.1.0+incompatible.info": `{"Version":"v2.1.0+incompatible"}`,
+		},
+		Allowlist: a,
+	})
+	if b, status, _ := u.Get("/example.com/c/@v/v2.0.0+incompatible.zip"); status != http.StatusOK {
+		t.Errorf("approved version not served: %d %q", status, b)
+	}
+	if b, status, _ := u.Get("/example.com/c/@v/v2.1.0+incompatible.zip"); status != http.StatusForbidden {
+		t.Errorf("version not on the allowlist served: %d %q", status, b)
+	}
+	requests := a.Requests()
+	if len(requests) != 1 || requests[0].Version != "v2.1.0+incompatible" {
+		t.Errorf("unexpected access requests: %+v", requests)
+	}
+}
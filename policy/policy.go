@@ -0,0 +1,244 @@
+// Package policy implements an upstream that allows or denies module
+// requests based on rules over module paths, versions and endpoint types
+package policy
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// Action is what a rule does with a matching request
+type Action string
+
+const (
+	Allow Action = "allow"
+	Deny  Action = "deny"
+)
+
+// Endpoint is a type of GOPROXY protocol request
+type Endpoint string
+
+const (
+	List   Endpoint = "list"
+	Latest Endpoint = "latest"
+	Info   Endpoint = "info"
+	Mod    Endpoint = "mod"
+	Zip    Endpoint = "zip"
+)
+
+// Mode selects the rule that decides a request when several rules match
+type Mode string
+
+const (
+	// FirstMatch uses the first matching rule
+	FirstMatch Mode = "first-match"
+	// MostSpecific uses the matching rule with the longest module glob,
+	// preferring rules with a version constraint and then rules limited to
+	// endpoints. Ties are decided by rule order.
+	MostSpecific Mode = "most-specific"
+)
+
+// Rule allows or denies requests
+type Rule struct {
+	Action Action
+	// Module is a GOPRIVATE style glob matching module paths and their
+	// subpaths, e.g. example.com/* or golang.org/x
+	Module string
+	// Version is a comma separated list of constraints all versions must
+	// satisfy, e.g. "< v1.4.2" or ">= v1.0.0, < v2.0.0". A bare version
+	// matches only itself. Rules with a version constraint don't match
+	// requests without a version, like @v/list.
+	Version string
+	// Endpoints limits the rule to these endpoint types, by default it
+	// matches all endpoints
+	Endpoints []Endpoint
+	// Reason is shown to the go command when the rule denies a request
+	Reason string
+}
+
+// Request is a module request checked against the policy
+type Request struct {
+	Module   string
+	Version  string
+	Endpoint Endpoint
+}
+
+func (r Request) String() string {
+	if r.Version == "" {
+		return r.Module
+	}
+	return r.Module + "@" + r.Version
+}
+
+// Decision is the result of checking a request
+type Decision struct {
+	Allowed bool
+	// Rule is the rule that decided, nil if no rule matched
+	Rule *Rule
+}
+
+// Reason returns a human-readable reason for the decision
+func (d Decision) Reason() string {
+	if d.Rule == nil {
+		return "it is not on the allowlist"
+	}
+	if d.Rule.Reason != "" {
+		return d.Rule.Reason
+	}
+	return fmt.Sprintf("%s rule for %s", d.Rule.Action, d.Rule.Module)
+}
+
+type constraint struct {
+	op      string
+	version string
+}
+
+// rule is a rule with its parsed constraints
+type rule struct {
+	*Rule
+	constraints []constraint
+	// invalid rules never allow and always deny, so a typo can't open the
+	// policy up
+	invalid bool
+}
+
+// Policy evaluates requests against a list of rules
+type Policy struct {
+	rules     []rule
+	mode      Mode
+	allowlist *Allowlist
+}
+
+// New creates a policy from rules. Requests matching no rule are allowed,
+// unless an allowlist is given. Then versions matching no rule are denied
+// unless they are on the allowlist.
+func New(rules []*Rule, mode Mode, allowlist *Allowlist) *Policy {
+	p := &Policy{mode: mode, allowlist: allowlist}
+	for _, r := range rules {
+		cs, err := parseConstraints(r.Version)
+		if err != nil {
+			log.Printf("invalid policy rule for %s: %v", r.Module, err)
+		}
+		p.rules = append(p.rules, rule{Rule: r, constraints: cs, invalid: err != nil})
+	}
+	return p
+}
+
+func parseConstraints(s string) ([]constraint, error) {
+	var cs []constraint
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		c := constraint{op: "="}
+		for _, op := range []string{"<=", ">=", "!=", "<", ">", "="} {
+			if strings.HasPrefix(part, op) {
+				c.op = op
+				part = strings.TrimSpace(strings.TrimPrefix(part, op))
+				break
+			}
+		}
+		if !semver.IsValid(part) {
+			return nil, fmt.Errorf("invalid version %q in constraint %q", part, s)
+		}
+		c.version = part
+		cs = append(cs, c)
+	}
+	return cs, nil
+}
+
+func (c constraint) match(version string) bool {
+	cmp := semver.Compare(version, c.version)
+	switch c.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "!=":
+		return cmp != 0
+	}
+	return cmp == 0
+}
+
+func (r rule) match(req Request) bool {
+	if !module.MatchPrefixPatterns(r.Module, req.Module) {
+		return false
+	}
+	if len(r.Endpoints) > 0 {
+		found := false
+		for _, e := range r.Endpoints {
+			found = found || e == req.Endpoint
+		}
+		if !found {
+			return false
+		}
+	}
+	if r.invalid {
+		return r.Action == Deny
+	}
+	if len(r.constraints) > 0 && req.Version == "" {
+		return false
+	}
+	for _, c := range r.constraints {
+		if !c.match(req.Version) {
+			return false
+		}
+	}
+	return true
+}
+
+// specificity orders matching rules in MostSpecific mode
+func (r rule) specificity() [3]int {
+	s := [3]int{len(strings.Split(r.Module, "/"))*1000 + len(strings.Trim(r.Module, "*?"))}
+	if len(r.constraints) > 0 {
+		s[1] = 1
+	}
+	if len(r.Endpoints) > 0 {
+		s[2] = 1
+	}
+	return s
+}
+
+func less(a, b [3]int) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+// Check decides a request
+func (p *Policy) Check(req Request) Decision {
+	var match *rule
+	for i := range p.rules {
+		r := &p.rules[i]
+		if !r.match(req) {
+			continue
+		}
+		if p.mode != MostSpecific {
+			match = r
+			break
+		}
+		if match == nil || less(match.specificity(), r.specificity()) {
+			match = r
+		}
+	}
+	if match == nil {
+		// module level requests like @v/list are filtered instead
+		if p.allowlist == nil || req.Version == "" {
+			return Decision{Allowed: true}
+		}
+		return Decision{Allowed: p.allowlist.Allowed(module.Version{Path: req.Module, Version: req.Version})}
+	}
+	return Decision{Allowed: match.Action == Allow, Rule: match.Rule}
+}
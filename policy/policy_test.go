@@ -0,0 +1,94 @@
+package policy
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+type mapUpstream map[string]string
+
+func (m mapUpstream) Get(key string) ([]byte, int, error) {
+	b, ok := m[key]
+	if !ok {
+		return []byte("not found"), http.StatusNotFound, nil
+	}
+	return []byte(b), http.StatusOK, nil
+}
+
+func TestPolicyCheck(t *testing.T) {
+	rules := []*Rule{
+		{Action: Deny, Module: "example.com/vuln", Version: "< v1.4.2", Reason: "CVE-2023-0001"},
+		{Action: Allow, Module: "example.com/vuln/*", Version: "v1.0.0"},
+		{Action: Deny, Module: "example.com/*", Endpoints: []Endpoint{Zip}, Reason: "no downloads from example.com"},
+		{Action: Deny, Module: "example.com/vuln/sub", Reason: "sub is deprecated"},
+		{Action: Allow, Module: "example.com/typo", Version: "< 1.0"},
+		{Action: Deny, Module: "example.com/typo", Version: "< 1.0"},
+	}
+	for _, tc := range []struct {
+		req          Request
+		firstMatch   bool
+		mostSpecific bool
+		reason       string
+	}{
+		{Request{"example.com/vuln", "v1.4.1", Info}, false, false, "CVE-2023-0001"},
+		{Request{"example.com/vuln", "v1.4.2", Info}, true, true, ""},
+		{Request{"example.com/vuln", "", List}, true, true, ""},
+		{Request{"example.com/vuln", "v1.4.2", Zip}, false, false, "no downloads from example.com"},
+		{Request{"example.com/vuln/other", "v1.0.0", Zip}, false, true, "CVE-2023-0001"},
+		{Request{"example.com/vuln/sub", "v1.0.0", Zip}, false, false, "CVE-2023-0001"},
+		{Request{"example.com/vuln/sub", "v1.5.0", Zip}, false, false, "no downloads from example.com"},
+		{Request{"example.com/vuln/sub", "v1.5.0", Mod}, false, false, "sub is deprecated"},
+		{Request{"example.com/typo", "v0.1.0", Mod}, false, false, "deny rule for example.com/typo"},
+		{Request{"golang.org/x/mod", "v0.10.0", Zip}, true, true, ""},
+	} {
+		for mode, want := range map[Mode]bool{FirstMatch: tc.firstMatch, MostSpecific: tc.mostSpecific} {
+			d := New(rules, mode, nil).Check(tc.req)
+			if d.Allowed != want {
+				t.Errorf("%s %s %s: allowed %v, want %v (%v)", mode, tc.req.Endpoint, tc.req, d.Allowed, want, d.Rule)
+			}
+			if !d.Allowed && mode == FirstMatch && d.Reason() != tc.reason {
+				t.Errorf("%s %s: reason %q, want %q", tc.req.Endpoint, tc.req, d.Reason(), tc.reason)
+			}
+		}
+	}
+}
+
+func TestPolicyUpstream(t *testing.T) {
+	next := mapUpstream{
+		"/example.com/!foo/@v/list":        "v1.0.0\nv1.4.1\nv1.4.2\n",
+		"/example.com/!foo/@latest":        `{"Version":"v1.4.1"}`,
+		"/example.com/!foo/@v/master.info": `{"Version":"v1.4.1"}`,
+		"/example.com/!foo/@v/v1.4.1.zip":  "zip",
+		"/example.com/!foo/@v/v1.4.2.zip":  "zip",
+		"/example.com/bar/@v/list":         "v1.0.0\n",
+		"/sumdb/sum.golang.org/latest":     "tree",
+	}
+	u := NewPolicyUpstream(&Config{
+		Upstream: next,
+		Rules: []*Rule{
+			{Action: Deny, Module: "example.com/Foo", Version: "< v1.4.2", Reason: "upgrade to v1.4.2"},
+			{Action: Deny, Module: "example.com/bar"},
+		},
+	})
+	for key, want := range map[string]struct {
+		status int
+		body   string
+	}{
+		"/example.com/!foo/@v/list":        {http.StatusOK, "v1.4.2\n"},
+		"/example.com/!foo/@latest":        {http.StatusForbidden, "example.com/Foo@v1.4.1 is blocked by policy: upgrade to v1.4.2\n"},
+		"/example.com/!foo/@v/master.info": {http.StatusForbidden, "example.com/Foo@v1.4.1 is blocked by policy: upgrade to v1.4.2\n"},
+		"/example.com/!foo/@v/v1.4.1.zip":  {http.StatusForbidden, "example.com/Foo@v1.4.1 is blocked by policy: upgrade to v1.4.2\n"},
+		"/example.com/!foo/@v/v1.4.2.zip":  {http.StatusOK, "zip"},
+		"/example.com/bar/@v/list":         {http.StatusForbidden, "example.com/bar is blocked by policy: deny rule for example.com/bar\n"},
+		"/sumdb/sum.golang.org/latest":     {http.StatusOK, "tree"},
+	} {
+		b, status, err := u.Get(key)
+		if err != nil || status != want.status || string(b) != want.body {
+			t.Errorf("%s: got %d %q %v, want %d %q", key, status, b, err, want.status, want.body)
+		}
+	}
+	if m := u.(*policyUpstream).Metrics(); m[0].Value != 4 || !strings.HasPrefix(m[0].Name, "modpox_policy_") {
+		t.Errorf("unexpected metrics %v", m)
+	}
+}
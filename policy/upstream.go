@@ -0,0 +1,173 @@
+package policy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/wozz/modpox/upstream"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// Config is used to configure the policy upstream
+type Config struct {
+	Upstream upstream.Upstream
+	// Rules are evaluated in order
+	Rules []*Rule
+	// Mode selects how rules are evaluated, defaults to FirstMatch
+	Mode Mode
+	// Allowlist optionally enables allowlist-only mode, where versions no
+	// rule allows are only served if they are approved. Denied attempts are
+	// recorded as access requests.
+	Allowlist *Allowlist
+}
+
+type policyUpstream struct {
+	policy   *Policy
+	upstream upstream.Upstream
+
+	mu     sync.Mutex
+	denied int
+}
+
+// NewPolicyUpstream creates a new upstream refusing requests denied by the
+// policy with 403 and the reason in the body. Denied versions are removed
+// from version lists.
+func NewPolicyUpstream(config *Config) upstream.Upstream {
+	return &policyUpstream{
+		policy:   New(config.Rules, config.Mode, config.Allowlist),
+		upstream: config.Upstream,
+	}
+}
+
+// parseKey returns the request for a GOPROXY protocol key. Other keys, like
+// checksum database paths, are not checked.
+func parseKey(key string) (Request, bool) {
+	i := strings.LastIndex(key, "/@")
+	if i < 0 {
+		return Request{}, false
+	}
+	mod, err := module.UnescapePath(strings.TrimPrefix(key[:i], "/"))
+	if err != nil {
+		return Request{}, false
+	}
+	rest := key[i+1:]
+	switch {
+	case rest == "@v/list":
+		return Request{Module: mod, Endpoint: List}, true
+	case rest == "@latest":
+		return Request{Module: mod, Endpoint: Latest}, true
+	}
+	for _, e := range []Endpoint{Info, Mod, Zip} {
+		if file := strings.TrimPrefix(rest, "@v/"); file != rest && strings.HasSuffix(file, "."+string(e)) {
+			version, err := module.UnescapeVersion(strings.TrimSuffix(file, "."+string(e)))
+			if err != nil {
+				return Request{}, false
+			}
+			return Request{Module: mod, Version: version, Endpoint: e}, true
+		}
+	}
+	return Request{}, false
+}
+
+func (p *policyUpstream) Get(key string) ([]byte, int, error) {
+	return p.get(key, nil)
+}
+
+// GetAs implements upstream.AuthUpstream
+func (p *policyUpstream) GetAs(key string, creds *upstream.Credentials) ([]byte, int, error) {
+	return p.get(key, creds)
+}
+
+func (p *policyUpstream) get(key string, creds *upstream.Credentials) ([]byte, int, error) {
+	req, ok := parseKey(key)
+	if !ok {
+		return upstream.GetAs(p.upstream, key, creds)
+	}
+	// .info may be requested for a query like a branch name, whose version
+	// is checked once it is resolved
+	check := req
+	if !semver.IsValid(req.Version) || module.CanonicalVersion(req.Version) != req.Version {
+		check.Version = ""
+	}
+	d := p.policy.Check(check)
+	if !d.Allowed && d.Rule != nil {
+		return p.deny(check, d), http.StatusForbidden, nil
+	}
+	fetch := key
+	if !d.Allowed && (req.Endpoint == Mod || req.Endpoint == Zip) {
+		// versions not on the allowlist are denied once they are known to
+		// exist, without downloading the file
+		fetch = strings.TrimSuffix(key, "."+string(req.Endpoint)) + ".info"
+	}
+	b, status, err := upstream.GetAs(p.upstream, fetch, creds)
+	if err != nil || status != http.StatusOK {
+		// versions that don't exist, like those of parent paths the go
+		// command probes, are passed through so they don't become access
+		// requests
+		return b, status, err
+	}
+	if !d.Allowed {
+		return p.deny(check, d), http.StatusForbidden, nil
+	}
+	switch req.Endpoint {
+	case List:
+		return p.filter(req, b), status, nil
+	case Latest, Info:
+		var info struct{ Version string }
+		if err := json.Unmarshal(b, &info); err != nil || info.Version == "" {
+			return b, status, nil
+		}
+		if info.Version != req.Version {
+			req.Version = info.Version
+			if d := p.policy.Check(req); !d.Allowed {
+				return p.deny(req, d), http.StatusForbidden, nil
+			}
+		}
+	}
+	return b, status, nil
+}
+
+// deny returns the response body for a denied request. Versions not on the
+// allowlist are recorded as access requests.
+func (p *policyUpstream) deny(req Request, d Decision) []byte {
+	log.Printf("policy: denied %s %s: %s", req.Endpoint, req, d.Reason())
+	p.mu.Lock()
+	p.denied++
+	p.mu.Unlock()
+	if d.Rule == nil && p.policy.allowlist != nil {
+		p.policy.allowlist.record(module.Version{Path: req.Module, Version: req.Version})
+		return []byte(fmt.Sprintf("%s is blocked by policy: %s, an access request was recorded for review\n", req, d.Reason()))
+	}
+	return []byte(fmt.Sprintf("%s is blocked by policy: %s\n", req, d.Reason()))
+}
+
+// filter removes denied versions from a version list
+func (p *policyUpstream) filter(req Request, list []byte) []byte {
+	var b bytes.Buffer
+	for _, line := range strings.Split(string(list), "\n") {
+		version := strings.TrimSpace(line)
+		if version == "" {
+			continue
+		}
+		req.Version = version
+		if p.policy.Check(req).Allowed {
+			fmt.Fprintln(&b, version)
+		}
+	}
+	return b.Bytes()
+}
+
+// Metrics implements upstream.MetricsUpstream
+func (p *policyUpstream) Metrics() []upstream.Metric {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return []upstream.Metric{
+		{Name: "modpox_policy_denied_total", Help: "Requests denied by the module policy.", Value: float64(p.denied)},
+	}
+}
@@ -0,0 +1,285 @@
+package modpox
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/wozz/modpox/upstream"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/sumdb"
+	"golang.org/x/mod/sumdb/note"
+	"golang.org/x/mod/sumdb/tlog"
+)
+
+// PrivateSumDB configures a checksum database run by the proxy for private
+// modules. Clients use it by setting GOSUMDB to its verifier key.
+type PrivateSumDB struct {
+	// SignerKey is the note signer key tree heads are signed with, as
+	// generated by golang.org/x/mod/sumdb/note.GenerateKey. The database is
+	// served under /sumdb/<key name>/.
+	SignerKey string
+	// Dir is the directory the log is stored in. Without it the log is
+	// kept in memory, and clients reject the database after a restart.
+	Dir string
+	// ModulePrefixes is a list of GONOSUMDB style module path patterns
+	// recorded in the database, by default all modules are recorded
+	ModulePrefixes []string
+}
+
+const recordsFile = "records"
+
+// privateSumDB implements sumdb.ServerOps with a log that records the hashes
+// of module versions the first time their .mod or .zip is served. Lookups
+// only return recorded versions, so anonymous clients of the database can't
+// add to the log.
+type privateSumDB struct {
+	name     string
+	signer   note.Signer
+	file     string
+	patterns string
+	upstream upstream.Upstream
+
+	mu      sync.Mutex
+	records [][]byte
+	hashes  []tlog.Hash
+	lookup  map[string]int64
+}
+
+func newPrivateSumDB(config *PrivateSumDB, u upstream.Upstream) (*privateSumDB, error) {
+	signer, err := note.NewSigner(config.SignerKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid signer key", err)
+	}
+	p := &privateSumDB{
+		name:     signer.Name(),
+		signer:   signer,
+		patterns: strings.Join(config.ModulePrefixes, ","),
+		upstream: u,
+		lookup:   make(map[string]int64),
+	}
+	if config.Dir == "" {
+		log.Printf("private sumdb %s is not persisted", p.name)
+		return p, nil
+	}
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("%w: could not create sumdb dir", err)
+	}
+	p.file = filepath.Join(config.Dir, recordsFile)
+	data, err := os.ReadFile(p.file)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: could not read records", err)
+	}
+	// records end in a newline and are separated by a blank line, an
+	// incomplete record at the end was not added to the tree
+	for len(data) > 0 {
+		i := bytes.Index(data, []byte("\n\n"))
+		if i < 0 {
+			log.Printf("private sumdb %s: ignoring incomplete record", p.name)
+			break
+		}
+		if err := p.add(data[:i+1]); err != nil {
+			return nil, err
+		}
+		data = data[i+2:]
+	}
+	return p, nil
+}
+
+// add appends a record to the tree, p.mu must be held
+func (p *privateSumDB) add(record []byte) error {
+	fields := strings.Fields(string(record))
+	if len(fields) < 3 {
+		return fmt.Errorf("invalid record %q", record)
+	}
+	id := int64(len(p.records))
+	hashes, err := tlog.StoredHashesForRecordHash(id, tlog.RecordHash(record), tlog.HashReaderFunc(p.readHashes))
+	if err != nil {
+		return fmt.Errorf("%w: could not hash record", err)
+	}
+	p.records = append(p.records, record)
+	p.hashes = append(p.hashes, hashes...)
+	p.lookup[fields[0]+"@"+fields[1]] = id
+	return nil
+}
+
+func (p *privateSumDB) readHashes(indexes []int64) ([]tlog.Hash, error) {
+	list := make([]tlog.Hash, 0, len(indexes))
+	for _, i := range indexes {
+		if i < 0 || i >= int64(len(p.hashes)) {
+			return nil, fmt.Errorf("hash %d not stored", i)
+		}
+		list = append(list, p.hashes[i])
+	}
+	return list, nil
+}
+
+// record adds the go.sum lines of m to the log if they aren't recorded yet
+// and returns the record id. The .mod and .zip files not in files, by
+// extension, are downloaded with creds, if set.
+func (p *privateSumDB) record(m module.Version, files map[string][]byte, creds *upstream.Credentials) (int64, error) {
+	key := m.Path + "@" + m.Version
+	p.mu.Lock()
+	id, ok := p.lookup[key]
+	p.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+	if p.patterns != "" && !module.MatchPrefixPatterns(p.patterns, m.Path) {
+		return 0, notExist(key)
+	}
+	escPath, err := module.EscapePath(m.Path)
+	if err != nil {
+		return 0, notExist(key)
+	}
+	escVers, err := module.EscapeVersion(m.Version)
+	if err != nil || module.CanonicalVersion(m.Version) != m.Version {
+		return 0, notExist(key)
+	}
+	hashes := make(map[string]string)
+	for _, ext := range []string{".mod", ".zip"} {
+		b, ok := files[ext]
+		if !ok {
+			var status int
+			b, status, err = upstream.GetAs(p.upstream, fmt.Sprintf("/%s/@v/%s%s", escPath, escVers, ext), creds)
+			if err != nil {
+				return 0, err
+			}
+			if status == http.StatusNotFound || status == http.StatusGone {
+				return 0, notExist(key)
+			}
+			if status != http.StatusOK {
+				return 0, fmt.Errorf("could not download %s%s: status %d", key, ext, status)
+			}
+		}
+		hashes[ext], err = hashDownload(ext, b)
+		if err != nil {
+			return 0, err
+		}
+	}
+	record := []byte(fmt.Sprintf("%s %s %s\n%s %s/go.mod %s\n", m.Path, m.Version, hashes[".zip"], m.Path, m.Version, hashes[".mod"]))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// another request may have recorded the version in the meantime
+	if id, ok := p.lookup[key]; ok {
+		return id, nil
+	}
+	if p.file != "" {
+		if err := appendFile(p.file, append(record, '\n')); err != nil {
+			return 0, fmt.Errorf("%w: could not store record", err)
+		}
+	}
+	if err := p.add(record); err != nil {
+		return 0, err
+	}
+	log.Printf("private sumdb %s: recorded %s", p.name, key)
+	return p.lookup[key], nil
+}
+
+// notExist returns an error reported as 404 by sumdb.Server, which doesn't
+// unwrap errors
+func notExist(name string) error {
+	return &os.PathError{Op: "lookup", Path: name, Err: os.ErrNotExist}
+}
+
+func appendFile(name string, data []byte) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Get records module versions the first time their .mod or .zip is served
+func (p *privateSumDB) Get(key string) ([]byte, int, error) {
+	return p.get(key, nil)
+}
+
+// GetAs implements upstream.AuthUpstream
+func (p *privateSumDB) GetAs(key string, creds *upstream.Credentials) ([]byte, int, error) {
+	return p.get(key, creds)
+}
+
+func (p *privateSumDB) get(key string, creds *upstream.Credentials) ([]byte, int, error) {
+	b, status, err := upstream.GetAs(p.upstream, key, creds)
+	if err != nil || status != http.StatusOK {
+		return b, status, err
+	}
+	if m, ext, ok := parseDownloadKey(key); ok && (ext == ".mod" || ext == ".zip") {
+		if _, err := p.record(m, map[string][]byte{ext: b}, creds); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("private sumdb %s: could not record %s: %v", p.name, m, err)
+		}
+	}
+	return b, status, nil
+}
+
+func (p *privateSumDB) Signed(ctx context.Context) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	size := int64(len(p.records))
+	h, err := tlog.TreeHash(size, tlog.HashReaderFunc(p.readHashes))
+	if err != nil {
+		return nil, err
+	}
+	return note.Sign(&note.Note{Text: string(tlog.FormatTree(tlog.Tree{N: size, Hash: h}))}, p.signer)
+}
+
+func (p *privateSumDB) ReadRecords(ctx context.Context, id, n int64) ([][]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if id < 0 || id+n > int64(len(p.records)) {
+		return nil, notExist(fmt.Sprintf("records %d-%d", id, id+n-1))
+	}
+	return p.records[id : id+n], nil
+}
+
+func (p *privateSumDB) Lookup(ctx context.Context, m module.Version) (int64, error) {
+	key := m.Path + "@" + m.Version
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	id, ok := p.lookup[key]
+	if !ok {
+		return 0, notExist(key)
+	}
+	return id, nil
+}
+
+func (p *privateSumDB) ReadTileData(ctx context.Context, t tlog.Tile) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	data, err := tlog.ReadTileData(t, tlog.HashReaderFunc(p.readHashes))
+	if err != nil {
+		// the tile isn't complete yet
+		return nil, notExist(t.Path())
+	}
+	return data, nil
+}
+
+// handler serves the checksum database under /sumdb/<name>/
+func (p *privateSumDB) handler() http.Handler {
+	prefix := "/sumdb/" + p.name
+	srv := http.StripPrefix(prefix, sumdb.NewServer(p))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == prefix+"/supported" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		srv.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,117 @@
+package modpox
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/wozz/modpox/upstream"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/sumdb/note"
+)
+
+func TestPrivateSumDB(t *testing.T) {
+	skey, vkey, err := note.GenerateKey(rand.Reader, "sum.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mod := []byte("module example.com/private/a\n")
+	files := mapUpstream{
+		"/example.com/private/a/@v/v1.0.0.mod": mod,
+		"/example.com/private/a/@v/v1.0.0.zip": testZip(t, "example.com/private/a@v1.0.0/", map[string]string{"go.mod": string(mod)}),
+		"/example.com/private/a/@v/v1.1.0.mod": mod,
+		"/example.com/private/a/@v/v1.1.0.zip": testZip(t, "example.com/private/a@v1.1.0/", map[string]string{"go.mod": string(mod)}),
+		"/example.com/public/@v/v1.0.0.mod":    []byte("module example.com/public\n"),
+		"/example.com/public/@v/v1.0.0.zip":    testZip(t, "example.com/public@v1.0.0/", map[string]string{"go.mod": "module example.com/public\n"}),
+	}
+	config := &PrivateSumDB{SignerKey: skey, Dir: t.TempDir(), ModulePrefixes: []string{"example.com/private"}}
+	p, err := newPrivateSumDB(config, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(p.handler())
+	defer srv.Close()
+	db := &SumDB{Name: "sum.example.com", Key: vkey, URL: srv.URL + "/sumdb/sum.example.com"}
+	v := newVerifyingUpstream(db, nil, newSumDBUpstream([]*SumDB{db}, p))
+
+	// serving a zip records the version
+	if _, status, _ := p.Get("/example.com/private/a/@v/v1.0.0.zip"); status != http.StatusOK || len(p.records) != 1 {
+		t.Fatalf("version not recorded when served: %d %d", status, len(p.records))
+	}
+	// lookups don't record versions that weren't served yet
+	if _, err := p.Lookup(context.Background(), module.Version{Path: "example.com/private/a", Version: "v1.1.0"}); !errors.Is(err, os.ErrNotExist) || len(p.records) != 1 {
+		t.Errorf("lookup of unserved version: %v, %d records", err, len(p.records))
+	}
+	// serving a .mod records the version too
+	for _, key := range []string{"/example.com/private/a/@v/v1.0.0.zip", "/example.com/private/a/@v/v1.1.0.mod"} {
+		if b, status, _ := v.Get(key); status != http.StatusOK {
+			t.Errorf("%s: verification failed: %d %s", key, status, b)
+		}
+	}
+	if _, status, _ := v.Get("/example.com/public/@v/v1.0.0.zip"); status != http.StatusBadGateway {
+		t.Errorf("modules outside the prefixes should not be recorded, got status %d", status)
+	}
+	resp, err := http.Get(srv.URL + "/sumdb/sum.example.com/supported")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("supported endpoint: %v %v", resp, err)
+	}
+
+	// the log is restored from disk
+	signed, err := p.Signed(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p2, err := newPrivateSumDB(config, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signed2, err := p2.Signed(context.Background()); err != nil || string(signed2) != string(signed) || len(p2.records) != 2 {
+		t.Errorf("log not restored: %d records\n%s\n%s", len(p2.records), signed, signed2)
+	}
+}
+
+// countingUpstream counts the requests for each key
+type countingUpstream struct {
+	upstream upstream.Upstream
+	requests map[string]int
+}
+
+func (c *countingUpstream) Get(key string) ([]byte, int, error) {
+	c.requests[key]++
+	return c.upstream.Get(key)
+}
+
+func TestPrivateSumDBRecordDownloads(t *testing.T) {
+	skey, _, err := note.GenerateKey(rand.Reader, "sum.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mod := []byte("module example.com/private/a\n")
+	files := &countingUpstream{
+		upstream: mapUpstream{
+			"/example.com/private/a/@v/v1.0.0.mod": mod,
+			"/example.com/private/a/@v/v1.0.0.zip": testZip(t, "example.com/private/a@v1.0.0/", map[string]string{"go.mod": string(mod)}),
+		},
+		requests: make(map[string]int),
+	}
+	p, err := newPrivateSumDB(&PrivateSumDB{SignerKey: skey}, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, status, _ := p.Get("/example.com/private/a/@v/v1.0.0.zip"); status != http.StatusOK || len(p.records) != 1 {
+		t.Fatalf("version not recorded when served: %d %d", status, len(p.records))
+	}
+	// the served zip is hashed, only the .mod is downloaded to record it
+	want := map[string]int{
+		"/example.com/private/a/@v/v1.0.0.zip": 1,
+		"/example.com/private/a/@v/v1.0.0.mod": 1,
+	}
+	if !reflect.DeepEqual(files.requests, want) {
+		t.Errorf("got requests %v, want %v", files.requests, want)
+	}
+}
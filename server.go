@@ -3,17 +3,27 @@ package modpox
 import (
 	"log"
 	"net/http"
+	"strings"
+	"time"
 
+	"github.com/wozz/modpox/bitbucket"
+	"github.com/wozz/modpox/git"
+	"github.com/wozz/modpox/gitea"
+	"github.com/wozz/modpox/github"
+	"github.com/wozz/modpox/gitlab"
+	"github.com/wozz/modpox/local"
+	"github.com/wozz/modpox/policy"
 	"github.com/wozz/modpox/upstream"
+	"github.com/wozz/modpox/vuln"
 )
 
 const (
 	upstreamEndpoint = "https://proxy.golang.org"
+	defaultAddr      = "127.0.0.1:8080"
 )
 
 var (
-	blacklist = []string{}
-	token     = ""
+	token = ""
 )
 
 // SetToken sets a token to be used for private gitlab API interaction
@@ -21,65 +31,358 @@ func SetToken(t string) {
 	token = t
 }
 
+// Config is used to configure a Server
+type Config struct {
+	// Addr is the address to listen on, defaults to 127.0.0.1:8080
+	Addr string
+	// GitLab optionally enables private gitlab upstreams, one per host. The
+	// Upstream field is set by the server, and if no credentials are
+	// configured the token from SetToken is used.
+	GitLab []*gitlab.Config
+	// GitHub optionally enables private github upstreams, one per host. The
+	// Upstream field is set by the server.
+	GitHub []*github.Config
+	// Gitea optionally enables private gitea or forgejo upstreams
+	Gitea []*gitea.Config
+	// Bitbucket optionally enables private Bitbucket Server upstreams
+	Bitbucket []*bitbucket.Config
+	// Git optionally serves module path prefixes directly from git remotes
+	Git []*git.Config
+	// Local optionally serves modules from GOPROXY directories or module
+	// caches on disk, before falling back to the public proxy
+	Local []*local.Config
+	// SumDBs are the checksum databases proxied under /sumdb/, defaults to
+	// sum.golang.org
+	SumDBs []*SumDB
+	// VerifySumDB is the name of a checksum database in SumDBs that .mod
+	// and .zip downloads are verified against before they are cached or
+	// served. Downloads that fail verification are refused.
+	VerifySumDB string
+	// NoSumDB is a list of GONOSUMDB style module path patterns that are
+	// not verified, e.g. modules served by private upstreams
+	NoSumDB []string
+	// PrivateSumDB optionally runs a checksum database recording the
+	// hashes of modules served by the proxy
+	PrivateSumDB *PrivateSumDB
+	// Proxies are the public module proxies a random one of which is used
+	// for each request, defaults to proxy.golang.org
+	Proxies []string
+	// AuditInterval enables a background auditor comparing the hashes of
+	// cached .mod and .zip files with Proxies and the checksum database
+	// at this interval. Versions with inconsistent hashes are quarantined.
+	AuditInterval time.Duration
+	// AuditDir is the directory the quarantine is stored in. Without it the
+	// quarantine is kept in memory, and quarantined versions are released
+	// on restart.
+	AuditDir string
+	// Policy optionally allows or denies requests by module path, version
+	// and endpoint. The Upstream field is set by the server. If an
+	// Allowlist is set its access requests are managed under
+	// /admin/policy/.
+	Policy *policy.Config
+	// Vuln optionally blocks or warns on downloads of module versions with
+	// known vulnerabilities in a local vulnerability database mirror. The
+	// Upstream field is set by the server.
+	Vuln *vuln.Config
+	// License optionally classifies the licenses of module zips, enforces
+	// a license policy on them and reports license usage at
+	// /admin/licenses
+	License *LicensePolicy
+	// GoGet enables answering ?go-get=1 requests with go-import meta tags
+	// for import paths served by private upstreams
+	GoGet bool
+	// Prefetch fetches new versions announced by webhooks so they are
+	// cached before the first request
+	Prefetch bool
+	// Backend optionally stores immutable responses, like checksum database
+	// tiles and lookups and license classifications, which are then only
+	// cached in memory briefly. See NewDirBackend.
+	Backend Backend
+	// AdminToken is the bearer token required by the /admin/ endpoints,
+	// except /admin/metrics. The endpoints are disabled if it is not set.
+	AdminToken string
+}
+
 // Server is the main go mod proxy
 type Server struct {
 	srv     *http.Server
 	backend Backend
+	// status is the list of upstreams reporting module retractions and
+	// deprecations through the admin API
+	status []upstream.StatusUpstream
+	// imports is the list of upstreams used for ?go-get=1 discovery
+	imports []upstream.ImportUpstream
+	// auth is set if any upstream forwards end user credentials, and is used
+	// for requests under the passThrough module path prefixes
+	auth        upstream.AuthUpstream
+	passThrough []string
+	// webhooks is the list of upstreams receiving change notifications
+	webhooks []upstream.WebhookUpstream
+	// metrics is the list of upstreams exporting metrics
+	metrics []upstream.MetricsUpstream
+	// privateSumDB is the checksum database run by the proxy, if any
+	privateSumDB *privateSumDB
+	// auditor quarantines versions with inconsistent hashes, if enabled
+	auditor       *auditor
+	auditInterval time.Duration
+	// licenses classifies and enforces module licenses, if enabled
+	licenses *licenseUpstream
+	// allowlist is the allowlist of an allowlist-only policy, if any
+	allowlist *policy.Allowlist
+	cache     *cache
+	prefetch  bool
+	// adminToken authenticates requests to the admin endpoints
+	adminToken string
 }
 
 func newHandler(srv *Server) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		log.Printf("req: %s", r.URL.Path)
-		data, status, err := srv.backend.Get(r.URL.Path)
+		if isGoGet(r) && len(srv.imports) > 0 {
+			srv.serveGoGet(w, r)
+			return
+		}
+		var data []byte
+		var status int
+		var err error
+		if user, pass, ok := r.BasicAuth(); ok && srv.auth != nil && srv.isPassThrough(r.URL.Path) {
+			data, status, err = srv.auth.GetAs(r.URL.Path, &upstream.Credentials{Username: user, Password: pass})
+		} else {
+			data, status, err = srv.backend.Get(r.URL.Path)
+		}
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			log.Printf("backend error: %v", err)
 			return
 		}
+		if status == http.StatusUnauthorized {
+			w.Header().Set("WWW-Authenticate", `Basic realm="modpox"`)
+		}
 		w.WriteHeader(status)
 		w.Write(data)
 	}
 }
 
 // NewServer creates a new Server with default settings
-// This will likely change to be more configurable in the future
 func NewServer() *Server {
+	return NewServerWithConfig(&Config{})
+}
+
+// NewServerWithConfig creates a new Server from config
+func NewServerWithConfig(config *Config) *Server {
 	localCache := newCache()
-	upstream1 := &blacklistUpstream{
-		blacklist: blacklist,
-		upstream: &cachingUpstream{
-			cache: localCache,
-			upstream: &sumDBUpstream{
-				upstream: &randomUpstream{
-					upstreams: []upstream.Upstream{
-						&proxyUpstream{endpoint: upstreamEndpoint},
-					},
-				},
-			},
-		},
-	}
-	/* gitlab upstream
-	upstream2 := gitlab.NewGitLabUpstream(&gitlab.Config{
-		Host:     "<gitlab host>",
-		Token:    token,
-		Upstream: upstream1,
-	})
-	*/
-	backend := &noopBackend{
-		upstream: upstream1,
+	endpoints := config.Proxies
+	if len(endpoints) == 0 {
+		endpoints = []string{upstreamEndpoint}
+	}
+	proxies := &randomUpstream{}
+	sources := make(map[string]upstream.Upstream)
+	for _, endpoint := range endpoints {
+		p := &proxyUpstream{endpoint: strings.TrimSuffix(endpoint, "/")}
+		proxies.upstreams = append(proxies.upstreams, p)
+		sources[endpoint] = p
+	}
+	var sumDBs upstream.Upstream = newSumDBUpstream(config.SumDBs, proxies)
+	if config.Backend != nil {
+		sumDBs = &sumDBStore{
+			backend:  config.Backend,
+			upstream: sumDBs,
+		}
+	}
+	inner := &cachingUpstream{
+		cache:    localCache,
+		upstream: sumDBs,
+	}
+	if config.VerifySumDB != "" {
+		// public downloads are only cached by the outer cache, once they
+		// are verified
+		inner.skip = isDownloadKey
+	}
+	var upstream1 upstream.Upstream = inner
+	// local directories are read before the public proxy and don't need
+	// the cache
+	for _, c := range config.Local {
+		localConfig := *c
+		localConfig.Upstream = upstream1
+		upstream1 = local.NewLocalUpstream(&localConfig)
 	}
 	s := &Server{
-		srv: &http.Server{
-			Addr: "127.0.0.1:8080",
-		},
-		backend: backend,
+		cache:      localCache,
+		prefetch:   config.Prefetch,
+		adminToken: config.AdminToken,
+	}
+	for _, c := range config.Git {
+		gitConfig := *c
+		gitConfig.Upstream = upstream1
+		upstream1 = git.NewGitUpstream(&gitConfig)
+		s.register(upstream1, config.GoGet, false)
+	}
+	for _, c := range config.GitHub {
+		ghConfig := *c
+		ghConfig.Upstream = upstream1
+		upstream1 = github.NewGitHubUpstream(&ghConfig)
+		s.register(upstream1, config.GoGet, false)
+	}
+	for _, c := range config.Gitea {
+		gtConfig := *c
+		gtConfig.Upstream = upstream1
+		upstream1 = gitea.NewGiteaUpstream(&gtConfig)
+		s.register(upstream1, config.GoGet, false)
+	}
+	for _, c := range config.Bitbucket {
+		bbConfig := *c
+		bbConfig.Upstream = upstream1
+		upstream1 = bitbucket.NewBitbucketUpstream(&bbConfig)
+		s.register(upstream1, config.GoGet, false)
+	}
+	// each upstream serves its own module path prefix and passes other
+	// requests down the chain. gitlab upstreams are outermost so they can
+	// forward end user credentials in pass through mode.
+	passThrough := false
+	for _, c := range config.GitLab {
+		glConfig := *c
+		glConfig.Upstream = upstream1
+		if glConfig.Token == "" && len(glConfig.Credentials) == 0 {
+			glConfig.Token = token
+		}
+		upstream1 = gitlab.NewGitLabUpstream(&glConfig)
+		s.register(upstream1, config.GoGet, c.WebhookSecret != "")
+		if c.PassThrough {
+			passThrough = true
+			prefix := c.ModulePrefix
+			if prefix == "" {
+				prefix = c.Host
+			}
+			s.passThrough = append(s.passThrough, prefix)
+		}
+	}
+	if config.VerifySumDB != "" {
+		vu := newVerifyingUpstream(findSumDB(config.SumDBs, config.VerifySumDB), config.NoSumDB, upstream1)
+		upstream1 = vu
+		s.metrics = append(s.metrics, vu)
+	}
+	// the private sumdb records versions the first time they are served,
+	// before they are cached
+	if config.PrivateSumDB != nil {
+		p, err := newPrivateSumDB(config.PrivateSumDB, upstream1)
+		if err != nil {
+			log.Printf("could not create private sumdb: %v", err)
+		} else {
+			upstream1 = p
+			s.privateSumDB = p
+		}
+	}
+	if len(config.GitLab)+len(config.GitHub)+len(config.Gitea)+len(config.Bitbucket)+len(config.Git) > 0 ||
+		config.VerifySumDB != "" || s.privateSumDB != nil {
+		cu := cachingUpstream{
+			cache:    localCache,
+			upstream: upstream1,
+		}
+		if passThrough {
+			upstream1 = &scopedCacheUpstream{cu}
+		} else {
+			upstream1 = &cu
+		}
+	}
+	if config.AuditInterval > 0 {
+		dbs := config.SumDBs
+		if len(dbs) == 0 {
+			dbs = defaultSumDBs
+		}
+		dbName := config.VerifySumDB
+		if dbName == "" {
+			dbName = dbs[0].Name
+		}
+		s.auditor = newAuditor(localCache, sources, findSumDB(dbs, dbName), config.NoSumDB, upstream1)
+		if config.AuditDir != "" {
+			if err := s.auditor.load(config.AuditDir); err != nil {
+				log.Printf("could not load quarantine: %v", err)
+			}
+		}
+		s.auditInterval = config.AuditInterval
+		s.metrics = append(s.metrics, s.auditor)
+		upstream1 = s.auditor
+	}
+	if config.Vuln != nil {
+		vulnConfig := *config.Vuln
+		vulnConfig.Upstream = upstream1
+		upstream1 = vuln.NewVulnUpstream(&vulnConfig)
+		s.register(upstream1, false, false)
+	}
+	if config.License != nil {
+		s.licenses = newLicenseUpstream(localCache, config.Backend, config.License, upstream1)
+		s.metrics = append(s.metrics, s.licenses)
+		upstream1 = s.licenses
+	}
+	if config.Policy != nil {
+		policyConfig := *config.Policy
+		policyConfig.Upstream = upstream1
+		upstream1 = policy.NewPolicyUpstream(&policyConfig)
+		s.register(upstream1, false, false)
+		s.allowlist = policyConfig.Allowlist
+	}
+	// requests with end user credentials go through the same checks, but
+	// skip the backend which is shared between users
+	if au, ok := upstream1.(upstream.AuthUpstream); ok && passThrough {
+		s.auth = au
+	}
+	s.backend = &noopBackend{
+		upstream: upstream1,
+	}
+	addr := config.Addr
+	if addr == "" {
+		addr = defaultAddr
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", newHandler(s))
+	mux.HandleFunc("/admin/status/", requireAdmin(s, newStatusHandler(s)))
+	mux.HandleFunc("/admin/metrics", newMetricsHandler(s))
+	mux.HandleFunc("/admin/quarantine", requireAdmin(s, newQuarantineHandler(s)))
+	mux.HandleFunc("/admin/quarantine/", requireAdmin(s, newQuarantineHandler(s)))
+	mux.HandleFunc("/admin/policy/", requireAdmin(s, newAccessRequestHandler(s)))
+	mux.HandleFunc("/admin/licenses", requireAdmin(s, newLicenseReportHandler(s)))
+	mux.HandleFunc("/webhooks/gitlab", newWebhookHandler(s))
+	if s.privateSumDB != nil {
+		mux.Handle("/sumdb/"+s.privateSumDB.name+"/", s.privateSumDB.handler())
+	}
+	s.srv = &http.Server{
+		Addr:    addr,
+		Handler: mux,
 	}
-	http.HandleFunc("/", newHandler(s))
 	return s
 }
 
+// isPassThrough reports whether key is served with end user credentials
+func (s *Server) isPassThrough(key string) bool {
+	for _, prefix := range s.passThrough {
+		if strings.HasPrefix(key, "/"+prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// register collects the optional capabilities of a private upstream
+func (s *Server) register(u upstream.Upstream, goGet, webhooks bool) {
+	if su, ok := u.(upstream.StatusUpstream); ok {
+		s.status = append(s.status, su)
+	}
+	if iu, ok := u.(upstream.ImportUpstream); ok && goGet {
+		s.imports = append(s.imports, iu)
+	}
+	if wu, ok := u.(upstream.WebhookUpstream); ok && webhooks {
+		s.webhooks = append(s.webhooks, wu)
+	}
+	if mu, ok := u.(upstream.MetricsUpstream); ok {
+		s.metrics = append(s.metrics, mu)
+	}
+}
+
 // Start starts the server asyncronously and returns immediately
 func (s *Server) Start() {
+	if s.auditor != nil {
+		go s.auditor.run(s.auditInterval)
+	}
 	go func() {
 		if err := s.srv.ListenAndServe(); err != nil {
 			log.Printf("http server error: %v", err)
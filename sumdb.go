@@ -6,66 +6,246 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
 	"github.com/wozz/modpox/upstream"
+	"golang.org/x/mod/sumdb/tlog"
 )
 
-var supportedSumDatabases = [...]string{
-	"sum.golang.org",
+const (
+	// sumDBLatestTTL is how long the signed tree head is cached
+	sumDBLatestTTL = time.Minute
+	// sumDBErrorTTL is how long error responses are cached, tiles and
+	// records that don't exist yet are added to the log later
+	sumDBErrorTTL = time.Minute
+	// sumDBImmutableTTL is how long tiles and lookups are kept in memory.
+	// They never change, and are kept in the Backend if one is configured.
+	sumDBImmutableTTL = time.Hour
+)
+
+// SumDB configures a checksum database proxied under /sumdb/<name>/
+type SumDB struct {
+	// Name is the name of the checksum database, e.g. sum.golang.org
+	Name string
+	// Key is the verifier key of the database, e.g.
+	// sum.golang.org+033de0ae+Ac4zctda0e5eza+HJyk9SxEdh+s3Ld4pHu9yXQQvL1kG
+	Key string
+	// URL is the url the database is served from, defaults to https://<Name>
+	URL string
+	// Aliases are other names the database is proxied under, e.g.
+	// sum.golang.google.cn for sum.golang.org
+	Aliases []string
+	// OfflineDir is a directory synced with SyncSumDB. If set, the database
+	// is served from it without network access.
+	OfflineDir string
+}
+
+// defaultSumDBs is used if no checksum databases are configured
+var defaultSumDBs = []*SumDB{{
+	Name: "sum.golang.org",
+	Key:  "sum.golang.org+033de0ae+Ac4zctda0e5eza+HJyk9SxEdh+s3Ld4pHu9yXQQvL1kG",
+}}
+
+// ParseSumDB parses a checksum database in the GOSUMDB form, a name or
+// verifier key optionally followed by the url of the database. The key of
+// sum.golang.org is known, e.g.
+// "sum.golang.org+033de0ae+Ac4zctda0e5eza+HJyk9SxEdh+s3Ld4pHu9yXQQvL1kG https://sum.golang.google.cn"
+func ParseSumDB(s string) (*SumDB, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 2 {
+		return nil, fmt.Errorf("invalid sumdb: %q", s)
+	}
+	db := &SumDB{Name: strings.SplitN(fields[0], "+", 2)[0]}
+	if strings.Contains(fields[0], "+") {
+		db.Key = fields[0]
+	} else if known := findSumDB(defaultSumDBs, db.Name); known.Key != "" {
+		db.Key = known.Key
+	}
+	if len(fields) == 2 {
+		u, err := url.Parse(fields[1])
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid sumdb url: %q", fields[1])
+		}
+		db.URL = fields[1]
+	}
+	return db, nil
+}
+
+// findSumDB returns the configured database with name. Unknown databases
+// have no key, so verifying against them fails.
+func findSumDB(dbs []*SumDB, name string) *SumDB {
+	if len(dbs) == 0 {
+		dbs = defaultSumDBs
+	}
+	for _, db := range dbs {
+		if db.Name == name {
+			return db
+		}
+	}
+	return &SumDB{Name: name}
+}
+
+// url returns the url the database is served from
+func (db *SumDB) url() string {
+	if db.URL == "" {
+		return "https://" + db.Name
+	}
+	return strings.TrimSuffix(db.URL, "/")
 }
 
 type sumDBUpstream struct {
+	// dbs maps names and aliases to databases
+	dbs      map[string]*SumDB
+	client   *http.Client
 	upstream upstream.Upstream
 }
 
-func (sdb *sumDBUpstream) Get(key string) ([]byte, int, error) {
-	if strings.HasPrefix(key, "/sumdb/") {
-		if strings.HasSuffix(key, "/supported") {
-			for _, db := range supportedSumDatabases {
-				if key == fmt.Sprintf("/sumdb/%s/supported", db) {
-					return []byte{}, 200, nil
-				}
-			}
-			return []byte{}, 404, nil
-		}
-		endpoint := ""
-		for _, db := range supportedSumDatabases {
-			if strings.HasPrefix(key, fmt.Sprintf("/sumdb/%s/", db)) {
-				endpoint = db
-			}
-		}
-		if endpoint == "" {
-			return []byte{}, 404, nil
-		}
-		log.Printf("query sumdb: %s %s", endpoint, key)
-		keyParts := strings.Split(key, "/")
-		if len(keyParts) < 3 {
-			return nil, 0, fmt.Errorf("invalid sumdb key: %s", key)
-		}
-		realPath := strings.Join(keyParts[3:], "/")
-		hc := &http.Client{
-			Timeout: time.Minute,
-		}
-		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("https://%s/%s", endpoint, realPath), nil)
-		if err != nil {
-			log.Printf("could not create http req: %v", err)
-			return nil, 0, fmt.Errorf("%w: could not create http req", err)
-		}
-		req.Header.Set("User-Agent", useragent)
-		resp, err := hc.Do(req)
-		if err != nil {
-			log.Printf("sumdb error: %v", err)
-			return nil, 0, fmt.Errorf("%w: sumdb error", err)
-		}
-		defer resp.Body.Close()
-		if resp.StatusCode != http.StatusOK {
-			log.Printf("unexpected status code: %d", resp.StatusCode)
+func newSumDBUpstream(dbs []*SumDB, u upstream.Upstream) *sumDBUpstream {
+	if len(dbs) == 0 {
+		dbs = defaultSumDBs
+	}
+	sdb := &sumDBUpstream{
+		dbs:      make(map[string]*SumDB),
+		client:   &http.Client{Timeout: time.Minute},
+		upstream: u,
+	}
+	for _, db := range dbs {
+		sdb.dbs[db.Name] = db
+		for _, alias := range db.Aliases {
+			sdb.dbs[alias] = db
 		}
-		var b bytes.Buffer
-		io.Copy(&b, resp.Body)
-		return b.Bytes(), resp.StatusCode, nil
 	}
-	return sdb.upstream.Get(key)
+	return sdb
+}
+
+func (sdb *sumDBUpstream) Get(key string) ([]byte, int, error) {
+	if !strings.HasPrefix(key, "/sumdb/") {
+		return sdb.upstream.Get(key)
+	}
+	name, path, ok := splitSumDBKey(key)
+	db, known := sdb.dbs[name]
+	if !ok || !known {
+		return []byte{}, http.StatusNotFound, nil
+	}
+	if path == "supported" {
+		return []byte{}, http.StatusOK, nil
+	}
+	if db.OfflineDir != "" {
+		return offlineGet(db, path)
+	}
+	log.Printf("query sumdb: %s %s", db.Name, key)
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/%s", db.url(), path), nil)
+	if err != nil {
+		log.Printf("could not create http req: %v", err)
+		return nil, 0, fmt.Errorf("%w: could not create http req", err)
+	}
+	req.Header.Set("User-Agent", useragent)
+	resp, err := sdb.client.Do(req)
+	if err != nil {
+		log.Printf("sumdb error: %v", err)
+		return nil, 0, fmt.Errorf("%w: sumdb error", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("unexpected status code: %d", resp.StatusCode)
+	}
+	var b bytes.Buffer
+	io.Copy(&b, resp.Body)
+	return b.Bytes(), resp.StatusCode, nil
+}
+
+// splitSumDBKey splits a /sumdb/<name>/<path> key into the database name
+// and path
+func splitSumDBKey(key string) (string, string, bool) {
+	keyParts := strings.SplitN(strings.TrimPrefix(key, "/sumdb/"), "/", 2)
+	if !strings.HasPrefix(key, "/sumdb/") || len(keyParts) < 2 {
+		return "", "", false
+	}
+	return keyParts[0], keyParts[1], true
+}
+
+// sumDBTTL returns how long a checksum database response is cached in
+// memory
+func sumDBTTL(key string, status int) time.Duration {
+	_, path, ok := splitSumDBKey(key)
+	switch {
+	case !ok:
+		return defaultTTL
+	case path == "supported":
+		return defaultTTL
+	case status != http.StatusOK:
+		return sumDBErrorTTL
+	case path == "latest":
+		return sumDBLatestTTL
+	case isImmutableSumDBKey(key):
+		return sumDBImmutableTTL
+	}
+	return sumDBErrorTTL
+}
+
+// isImmutableSumDBKey reports whether key is a tile, including partial
+// tiles of a fixed width, or a lookup of a record, which never change in the
+// append-only log
+func isImmutableSumDBKey(key string) bool {
+	_, path, ok := splitSumDBKey(key)
+	return ok && (strings.HasPrefix(path, "tile/") || strings.HasPrefix(path, "lookup/"))
+}
+
+// partialTile returns a partial hash tile as the prefix of the full tile
+// returned by get. Servers may stop serving partial tiles once the full tile
+// exists.
+func partialTile(key string, get func(string) ([]byte, int)) ([]byte, bool) {
+	name, path, ok := splitSumDBKey(key)
+	if !ok || !strings.HasPrefix(path, "tile/") {
+		return nil, false
+	}
+	tile, err := tlog.ParseTilePath(path)
+	if err != nil || tile.L < 0 || tile.W == 1<<uint(tile.H) {
+		return nil, false
+	}
+	full := tile
+	full.W = 1 << uint(tile.H)
+	b, status := get(fmt.Sprintf("/sumdb/%s/%s", name, full.Path()))
+	if status != http.StatusOK || len(b) != full.W*tlog.HashSize {
+		return nil, false
+	}
+	return b[:tile.W*tlog.HashSize], true
+}
+
+// sumDBStore keeps the immutable responses of checksum databases in a
+// Backend, so the memory cache only needs to hold them briefly
+type sumDBStore struct {
+	backend  Backend
+	upstream upstream.Upstream
+}
+
+func (s *sumDBStore) Get(key string) ([]byte, int, error) {
+	if !isImmutableSumDBKey(key) {
+		return s.upstream.Get(key)
+	}
+	if b, status := s.stored(key); status == http.StatusOK {
+		return b, status, nil
+	}
+	if b, ok := partialTile(key, s.stored); ok {
+		return b, http.StatusOK, nil
+	}
+	b, status, err := s.upstream.Get(key)
+	if err != nil || status != http.StatusOK {
+		return b, status, err
+	}
+	if err := s.backend.Put(key, b, status); err != nil {
+		log.Printf("could not store sumdb response: %s %v", key, err)
+	}
+	return b, status, nil
+}
+
+// stored returns the response stored in the backend, if any
+func (s *sumDBStore) stored(key string) ([]byte, int) {
+	b, status, err := s.backend.Get(key)
+	if err != nil {
+		return nil, 0
+	}
+	return b, status
 }
@@ -0,0 +1,194 @@
+package modpox
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/mod/sumdb/tlog"
+)
+
+func TestParseSumDB(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want SumDB
+		err  bool
+	}{
+		{in: "sum.golang.org", want: SumDB{Name: "sum.golang.org", Key: "sum.golang.org+033de0ae+Ac4zctda0e5eza+HJyk9SxEdh+s3Ld4pHu9yXQQvL1kG"}},
+		{in: "sum.example.com https://sum.example.com", want: SumDB{Name: "sum.example.com", URL: "https://sum.example.com"}},
+		{
+			in:   "sum.golang.org+033de0ae+Ac4zctda0e5eza+HJyk9SxEdh+s3Ld4pHu9yXQQvL1kG https://sum.golang.google.cn",
+			want: SumDB{Name: "sum.golang.org", Key: "sum.golang.org+033de0ae+Ac4zctda0e5eza+HJyk9SxEdh+s3Ld4pHu9yXQQvL1kG", URL: "https://sum.golang.google.cn"},
+		},
+		{in: "", err: true},
+		{in: "sum.example.com not-a-url", err: true},
+		{in: "a b c", err: true},
+	} {
+		got, err := ParseSumDB(tc.in)
+		if (err != nil) != tc.err {
+			t.Errorf("%q: unexpected error: %v", tc.in, err)
+			continue
+		}
+		if err == nil && (got.Name != tc.want.Name || got.Key != tc.want.Key || got.URL != tc.want.URL) {
+			t.Errorf("%q: got %+v, want %+v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestSumDBUpstream(t *testing.T) {
+	var paths []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	sdb := newSumDBUpstream([]*SumDB{
+		{Name: "sum.golang.org", URL: backend.URL + "/golang/", Aliases: []string{"sum.golang.google.cn"}},
+		{Name: "sum.example.com", URL: backend.URL + "/corp"},
+	}, &randomUpstream{})
+
+	for _, tc := range []struct {
+		key    string
+		status int
+		path   string
+	}{
+		{key: "/sumdb/sum.golang.org/supported", status: http.StatusOK},
+		{key: "/sumdb/sum.golang.google.cn/supported", status: http.StatusOK},
+		{key: "/sumdb/sum.other.org/supported", status: http.StatusNotFound},
+		{key: "/sumdb/sum.golang.org/latest", status: http.StatusOK, path: "/golang/latest"},
+		{key: "/sumdb/sum.golang.google.cn/lookup/a@v1.0.0", status: http.StatusOK, path: "/golang/lookup/a@v1.0.0"},
+		{key: "/sumdb/sum.example.com/tile/8/0/000", status: http.StatusOK, path: "/corp/tile/8/0/000"},
+		{key: "/sumdb/sum.other.org/latest", status: http.StatusNotFound},
+	} {
+		paths = nil
+		_, status, err := sdb.Get(tc.key)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tc.key, err)
+		}
+		if status != tc.status {
+			t.Errorf("%s: got status %d, want %d", tc.key, status, tc.status)
+		}
+		if tc.path != "" && (len(paths) != 1 || paths[0] != tc.path) {
+			t.Errorf("%s: got backend requests %v, want %s", tc.key, paths, tc.path)
+		}
+	}
+}
+
+func TestSumDBTTL(t *testing.T) {
+	for _, tc := range []struct {
+		key    string
+		status int
+		want   time.Duration
+	}{
+		{key: "/sumdb/sum.golang.org/supported", status: http.StatusOK, want: defaultTTL},
+		{key: "/sumdb/sum.golang.org/latest", status: http.StatusOK, want: sumDBLatestTTL},
+		{key: "/sumdb/sum.golang.org/lookup/a@v1.0.0", status: http.StatusOK, want: sumDBImmutableTTL},
+		{key: "/sumdb/sum.golang.org/lookup/a@v1.0.0", status: http.StatusNotFound, want: sumDBErrorTTL},
+		{key: "/sumdb/sum.golang.org/tile/8/0/001", status: http.StatusOK, want: sumDBImmutableTTL},
+		{key: "/sumdb/sum.golang.org/tile/8/0/001.p/3", status: http.StatusOK, want: sumDBImmutableTTL},
+		{key: "/sumdb/sum.golang.org/tile/8/0/002", status: http.StatusNotFound, want: sumDBErrorTTL},
+	} {
+		if got := sumDBTTL(tc.key, tc.status); got != tc.want {
+			t.Errorf("%s %d: got ttl %v, want %v", tc.key, tc.status, got, tc.want)
+		}
+	}
+}
+
+func TestSumDBCache(t *testing.T) {
+	fullTile := bytes.Repeat([]byte{1}, 256*tlog.HashSize)
+	requests := make(map[string]int)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests[r.URL.Path]++
+		switch r.URL.Path {
+		case "/tile/8/0/000":
+			w.Write(fullTile)
+		case "/latest":
+			w.Write([]byte("tree"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer backend.Close()
+	cu := &cachingUpstream{
+		cache:    &cache{c: make(map[string]*value)},
+		upstream: newSumDBUpstream([]*SumDB{{Name: "sum.golang.org", URL: backend.URL}}, &randomUpstream{}),
+	}
+	get := func(key string) ([]byte, int) {
+		t.Helper()
+		b, status, err := cu.Get(key)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", key, err)
+		}
+		return b, status
+	}
+
+	for i := 0; i < 2; i++ {
+		get("/sumdb/sum.golang.org/tile/8/0/000")
+		get("/sumdb/sum.golang.org/latest")
+	}
+	if requests["/tile/8/0/000"] != 1 || requests["/latest"] != 1 {
+		t.Errorf("responses not cached: %v", requests)
+	}
+	// the partial tile is no longer served but can be cut from the full tile
+	b, status := get("/sumdb/sum.golang.org/tile/8/0/000.p/5")
+	if status != http.StatusOK || !bytes.Equal(b, fullTile[:5*tlog.HashSize]) {
+		t.Errorf("unexpected partial tile: %d %d bytes", status, len(b))
+	}
+	if requests["/tile/8/0/000.p/5"] != 0 {
+		t.Errorf("partial tile requested from sumdb")
+	}
+	if _, status := get("/sumdb/sum.golang.org/tile/8/data/000.p/5"); status != http.StatusNotFound {
+		t.Errorf("partial data tiles can't be cut from full tiles, got status %d", status)
+	}
+}
+
+func TestSumDBStore(t *testing.T) {
+	fullTile := bytes.Repeat([]byte{1}, 256*tlog.HashSize)
+	requests := make(map[string]int)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests[r.URL.Path]++
+		switch r.URL.Path {
+		case "/tile/8/0/000":
+			w.Write(fullTile)
+		case "/latest":
+			w.Write([]byte("tree"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer backend.Close()
+	store := &sumDBStore{
+		backend:  NewDirBackend(t.TempDir()),
+		upstream: newSumDBUpstream([]*SumDB{{Name: "sum.golang.org", URL: backend.URL}}, &randomUpstream{}),
+	}
+	get := func(key string) ([]byte, int) {
+		t.Helper()
+		b, status, err := store.Get(key)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", key, err)
+		}
+		return b, status
+	}
+
+	for i := 0; i < 2; i++ {
+		get("/sumdb/sum.golang.org/tile/8/0/000")
+		get("/sumdb/sum.golang.org/tile/8/0/001")
+		get("/sumdb/sum.golang.org/latest")
+	}
+	if requests["/tile/8/0/000"] != 1 {
+		t.Errorf("tile not stored: %v", requests)
+	}
+	// only immutable responses are stored
+	if requests["/tile/8/0/001"] != 2 || requests["/latest"] != 2 {
+		t.Errorf("unexpected sumdb requests: %v", requests)
+	}
+	b, status := get("/sumdb/sum.golang.org/tile/8/0/000.p/5")
+	if status != http.StatusOK || !bytes.Equal(b, fullTile[:5*tlog.HashSize]) {
+		t.Errorf("unexpected partial tile: %d %d bytes", status, len(b))
+	}
+	if requests["/tile/8/0/000.p/5"] != 0 {
+		t.Errorf("partial tile requested from sumdb")
+	}
+}
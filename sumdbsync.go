@@ -0,0 +1,221 @@
+package modpox
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/sumdb"
+	"golang.org/x/mod/sumdb/note"
+	"golang.org/x/mod/sumdb/tlog"
+)
+
+// SyncSumDB looks up mods in the checksum database and stores the verified
+// records, the tiles needed to prove them and the latest signed tree head in
+// dir, to be served with SumDB.OfflineDir. Syncing into an existing dir
+// proves the new state is consistent with the stored one.
+func SyncSumDB(db *SumDB, dir string, mods []module.Version) error {
+	if db.Key == "" {
+		return fmt.Errorf("no verifier key for sumdb %s", db.Name)
+	}
+	ops := &syncOps{db: db, dir: dir, client: &http.Client{Timeout: time.Minute}}
+	client := sumdb.NewClient(ops)
+	for _, m := range mods {
+		if _, err := client.Lookup(m.Path, m.Version); err != nil {
+			return fmt.Errorf("%w: could not sync %s", err, m)
+		}
+		log.Printf("synced %s from %s", m, db.Name)
+	}
+	return ops.err
+}
+
+// syncOps implements sumdb.ClientOps, storing verified state in a dir
+type syncOps struct {
+	db     *SumDB
+	dir    string
+	client *http.Client
+
+	mu  sync.Mutex
+	err error
+}
+
+// path returns the file of a cache or config file name, which start with
+// the database name
+func (o *syncOps) path(file string) string {
+	return filepath.Join(o.dir, filepath.FromSlash(strings.TrimPrefix(file, o.db.Name+"/")))
+}
+
+func (o *syncOps) ReadRemote(path string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, o.db.url()+path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not create http req", err)
+	}
+	req.Header.Set("User-Agent", useragent)
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: sumdb error", err)
+	}
+	defer resp.Body.Close()
+	var b bytes.Buffer
+	io.Copy(&b, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s%s: unexpected status %d: %s", o.db.Name, path, resp.StatusCode, bytes.TrimSpace(b.Bytes()))
+	}
+	return b.Bytes(), nil
+}
+
+func (o *syncOps) ReadConfig(file string) ([]byte, error) {
+	if file == "key" {
+		return []byte(o.db.Key), nil
+	}
+	b, err := os.ReadFile(o.path(file))
+	if errors.Is(err, os.ErrNotExist) {
+		return []byte{}, nil
+	}
+	return b, err
+}
+
+func (o *syncOps) WriteConfig(file string, old, new []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	current, err := o.ReadConfig(file)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(current, old) {
+		return sumdb.ErrWriteConflict
+	}
+	return writeFile(o.path(file), new)
+}
+
+func (o *syncOps) ReadCache(file string) ([]byte, error) {
+	return os.ReadFile(o.path(file))
+}
+
+func (o *syncOps) WriteCache(file string, data []byte) {
+	if err := writeFile(o.path(file), data); err != nil {
+		o.mu.Lock()
+		o.err = fmt.Errorf("%w: could not write %s", err, file)
+		o.mu.Unlock()
+	}
+}
+
+func (o *syncOps) Log(msg string) {
+	log.Print(msg)
+}
+
+func (o *syncOps) SecurityError(msg string) {
+	log.Printf("audit: sumdb %s security error: %s", o.db.Name, msg)
+}
+
+// writeFile replaces name atomically
+func writeFile(name string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+// offlineGet serves a checksum database path from the synced state in
+// db.OfflineDir. Signed tree heads are verified with the database key.
+func offlineGet(db *SumDB, path string) ([]byte, int, error) {
+	notSynced := func(what string) ([]byte, int, error) {
+		msg := fmt.Sprintf("%s is not covered by the synced state of %s, sync it with SyncSumDB\n", what, db.Name)
+		log.Printf("offline sumdb: %s", strings.TrimSpace(msg))
+		return []byte(msg), http.StatusNotFound, nil
+	}
+	switch {
+	case path == "latest":
+		b, err := os.ReadFile(filepath.Join(db.OfflineDir, "latest"))
+		if errors.Is(err, os.ErrNotExist) {
+			return notSynced("the signed tree head")
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w: could not read signed tree head", err)
+		}
+		if err := verifyTree(db, b); err != nil {
+			return nil, 0, err
+		}
+		return b, http.StatusOK, nil
+	case strings.HasPrefix(path, "lookup/"):
+		mod := strings.TrimPrefix(path, "lookup/")
+		i := strings.Index(mod, "@")
+		if i < 0 {
+			return []byte("invalid module@version syntax\n"), http.StatusBadRequest, nil
+		}
+		modPath, err1 := module.UnescapePath(mod[:i])
+		version, err2 := module.UnescapeVersion(mod[i+1:])
+		if err1 != nil || err2 != nil {
+			return []byte("invalid module@version syntax\n"), http.StatusBadRequest, nil
+		}
+		b, err := os.ReadFile(filepath.Join(db.OfflineDir, "lookup", filepath.FromSlash(mod)))
+		if errors.Is(err, os.ErrNotExist) {
+			return notSynced(modPath + "@" + version)
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w: could not read record", err)
+		}
+		_, _, treeMsg, err := tlog.ParseRecord(b)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w: invalid stored record %s", err, mod)
+		}
+		if err := verifyTree(db, treeMsg); err != nil {
+			return nil, 0, err
+		}
+		return b, http.StatusOK, nil
+	case strings.HasPrefix(path, "tile/"):
+		tile, err := tlog.ParseTilePath(path)
+		if err != nil {
+			return []byte("invalid tile syntax\n"), http.StatusBadRequest, nil
+		}
+		b, err := os.ReadFile(filepath.Join(db.OfflineDir, filepath.FromSlash(path)))
+		if err == nil {
+			return b, http.StatusOK, nil
+		}
+		// partial hash tiles are a prefix of the full tile
+		full := tile
+		full.W = 1 << uint(tile.H)
+		if tile.L >= 0 && tile != full {
+			b, err := os.ReadFile(filepath.Join(db.OfflineDir, filepath.FromSlash(full.Path())))
+			if err == nil && len(b) == full.W*tlog.HashSize {
+				return b[:tile.W*tlog.HashSize], http.StatusOK, nil
+			}
+		}
+		return notSynced(path)
+	}
+	return []byte{}, http.StatusNotFound, nil
+}
+
+// verifyTree checks the signature of a signed tree head
+func verifyTree(db *SumDB, msg []byte) error {
+	verifier, err := note.NewVerifier(db.Key)
+	if err != nil {
+		return fmt.Errorf("%w: invalid verifier key for sumdb %s", err, db.Name)
+	}
+	if _, err := note.Open(msg, note.VerifierList(verifier)); err != nil {
+		log.Printf("audit: sumdb %s stored signed tree head failed verification: %v", db.Name, err)
+		return fmt.Errorf("%w: stored signed tree head of %s failed verification", err, db.Name)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package modpox
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/mod/module"
+)
+
+func TestSyncSumDB(t *testing.T) {
+	mod := []byte("module example.com/a\n")
+	zips := map[string][]byte{
+		"example.com/a@v1.0.0": testZip(t, "example.com/a@v1.0.0/", map[string]string{"go.mod": string(mod)}),
+		"example.com/a@v1.1.0": testZip(t, "example.com/a@v1.1.0/", map[string]string{"go.mod": string(mod), "a.go": "package a\n"}),
+	}
+	online := testSumDB(t, "sum.example.com", map[string][]byte{"example.com/a@v1.0.0": mod, "example.com/a@v1.1.0": mod}, zips)
+	dir := t.TempDir()
+	if err := SyncSumDB(online, dir, []module.Version{{Path: "example.com/a", Version: "v1.0.0"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	offline := &SumDB{Name: online.Name, Key: online.Key, OfflineDir: dir}
+	files := mapUpstream{
+		"/example.com/a/@v/v1.0.0.mod": mod,
+		"/example.com/a/@v/v1.0.0.zip": zips["example.com/a@v1.0.0"],
+		"/example.com/a/@v/v1.1.0.zip": zips["example.com/a@v1.1.0"],
+	}
+	sdb := newSumDBUpstream([]*SumDB{offline}, files)
+	v := newVerifyingUpstream(offline, nil, sdb)
+	for _, key := range []string{"/example.com/a/@v/v1.0.0.mod", "/example.com/a/@v/v1.0.0.zip"} {
+		if b, status, _ := v.Get(key); status != http.StatusOK {
+			t.Errorf("%s: offline verification failed: %d %s", key, status, b)
+		}
+	}
+	b, status, _ := sdb.Get("/sumdb/sum.example.com/lookup/example.com/a@v1.1.0")
+	if status != http.StatusNotFound || !strings.Contains(string(b), "example.com/a@v1.1.0 is not covered by the synced state") {
+		t.Errorf("unsynced module not reported: %d %q", status, b)
+	}
+	if _, status, _ := sdb.Get("/sumdb/sum.example.com/lookup/../../etc@v1.0.0"); status != http.StatusBadRequest {
+		t.Errorf("invalid lookup path not rejected: %d", status)
+	}
+
+	// a tampered signed tree head is not served
+	latest := filepath.Join(dir, "latest")
+	b, err := os.ReadFile(latest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(latest, []byte(strings.Replace(string(b), "go.sum database tree\n", "go.sum database tree\n1", 1)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := sdb.Get("/sumdb/sum.example.com/latest"); err == nil || !strings.Contains(err.Error(), "failed verification") {
+		t.Errorf("tampered signed tree head not detected: %v", err)
+	}
+}
@@ -1,7 +1,121 @@
 package upstream
 
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+
+	"golang.org/x/mod/module"
+)
+
 // Upstream is a go modules data source
 // returns raw data, http status code, error
 type Upstream interface {
 	Get(string) ([]byte, int, error)
 }
+
+// Retraction is a retract directive from a go.mod file
+type Retraction struct {
+	Low       string
+	High      string
+	Rationale string `json:",omitempty"`
+}
+
+// ModuleStatus describes the retractions and deprecation of a module as
+// declared in the go.mod file of its latest version
+type ModuleStatus struct {
+	Module      string
+	Latest      string
+	Deprecated  string `json:",omitempty"`
+	Retractions []Retraction
+}
+
+// StatusUpstream is an upstream that can report the status of the modules
+// it serves
+type StatusUpstream interface {
+	Upstream
+
+	// Status returns nil if the module is not served by this upstream
+	Status(modulePath string) (*ModuleStatus, error)
+}
+
+// RepoRoot describes the repository an import path is served from, as
+// advertised by go-import and go-source meta tags
+type RepoRoot struct {
+	Root    string
+	VCS     string
+	RepoURL string
+	Home    string
+	Dir     string
+	File    string
+}
+
+// ImportUpstream is an upstream that can resolve import paths for
+// ?go-get=1 discovery
+type ImportUpstream interface {
+	Upstream
+
+	// RepoRoot returns nil if the import path is not served by this upstream
+	RepoRoot(importPath string) (*RepoRoot, error)
+}
+
+// Credentials are end user credentials forwarded to an upstream
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// Scope returns an opaque identifier for the credentials that can be used to
+// partition cached data between users
+func (c *Credentials) Scope() string {
+	h := sha256.Sum256([]byte(c.Username + ":" + c.Password))
+	return hex.EncodeToString(h[:16])
+}
+
+// AuthUpstream is an upstream that can make requests on behalf of an end user
+type AuthUpstream interface {
+	Upstream
+
+	GetAs(key string, creds *Credentials) ([]byte, int, error)
+}
+
+// GetAs makes a request to u on behalf of the end user if creds is set and
+// u forwards credentials, and as the proxy otherwise. Upstreams wrapping
+// another upstream use it to pass credentials down the chain.
+func GetAs(u Upstream, key string, creds *Credentials) ([]byte, int, error) {
+	if au, ok := u.(AuthUpstream); ok && creds != nil {
+		return au.GetAs(key, creds)
+	}
+	return u.Get(key)
+}
+
+// ModuleChange is a change to modules reported by a webhook
+type ModuleChange struct {
+	// Modules are the module paths that may be affected by the change
+	Modules []string
+	// Versions are newly published module versions
+	Versions []module.Version
+}
+
+// WebhookUpstream is an upstream that can receive change notifications
+type WebhookUpstream interface {
+	Upstream
+
+	// ParseWebhook returns nil if the webhook is not for this upstream
+	ParseWebhook(header http.Header, body []byte) (*ModuleChange, error)
+}
+
+// Metric is a single measurement exported by an upstream
+type Metric struct {
+	Name   string
+	Help   string
+	Labels map[string]string
+	Value  float64
+}
+
+// MetricsUpstream is an upstream that exports metrics
+type MetricsUpstream interface {
+	Upstream
+
+	Metrics() []Metric
+}
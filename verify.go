@@ -0,0 +1,279 @@
+package modpox
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wozz/modpox/upstream"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/sumdb"
+	"golang.org/x/mod/sumdb/dirhash"
+)
+
+// verifyingUpstream checks .mod and .zip files against a checksum database
+// before they are cached or served
+type verifyingUpstream struct {
+	db       *SumDB
+	client   *sumDBClient
+	upstream upstream.Upstream
+
+	mu       sync.Mutex
+	verified int
+	failures int
+}
+
+// newVerifyingUpstream verifies downloads from u against db. Checksum
+// database requests are made through u so tiles and lookups are cached.
+// Modules matching the GONOSUMDB style noSumDB patterns are not verified.
+func newVerifyingUpstream(db *SumDB, noSumDB []string, u upstream.Upstream) *verifyingUpstream {
+	return &verifyingUpstream{
+		db:       db,
+		client:   newSumDBClient(db, noSumDB, u),
+		upstream: u,
+	}
+}
+
+func (v *verifyingUpstream) Get(key string) ([]byte, int, error) {
+	return v.get(key, nil)
+}
+
+// GetAs implements upstream.AuthUpstream
+func (v *verifyingUpstream) GetAs(key string, creds *upstream.Credentials) ([]byte, int, error) {
+	return v.get(key, creds)
+}
+
+func (v *verifyingUpstream) get(key string, creds *upstream.Credentials) ([]byte, int, error) {
+	m, ext, ok := parseDownloadKey(key)
+	if !ok || ext == ".info" {
+		return upstream.GetAs(v.upstream, key, creds)
+	}
+	modPath, version := m.Path, m.Version
+	b, status, err := upstream.GetAs(v.upstream, key, creds)
+	if err != nil || status != http.StatusOK {
+		return b, status, err
+	}
+	if ext == ".mod" {
+		version += "/go.mod"
+	}
+	hash, err := hashDownload(ext, b)
+	if err != nil {
+		v.fail(modPath, version, "", err.Error())
+		return []byte(fmt.Sprintf("verifying %s@%s: %v\n", modPath, version, err)), http.StatusForbidden, nil
+	}
+	lines, err := v.client.Lookup(modPath, version)
+	if errors.Is(err, sumdb.ErrGONOSUMDB) {
+		return b, status, nil
+	}
+	if errors.Is(err, sumdb.ErrSecurity) {
+		v.fail(modPath, version, hash, err.Error())
+		return []byte(fmt.Sprintf("verifying %s@%s: %v\n", modPath, version, err)), http.StatusForbidden, nil
+	}
+	if err != nil {
+		log.Printf("sumdb lookup error: %s@%s %v", modPath, version, err)
+		return []byte(fmt.Sprintf("verifying %s@%s: could not look up checksum: %v\n", modPath, version, err)), http.StatusBadGateway, nil
+	}
+	want := fmt.Sprintf("%s %s %s", modPath, version, hash)
+	for _, line := range lines {
+		if line == want {
+			v.mu.Lock()
+			v.verified++
+			v.mu.Unlock()
+			return b, status, nil
+		}
+	}
+	sumDBHash := ""
+	if len(lines) > 0 {
+		sumDBHash = lines[0][strings.LastIndex(lines[0], " ")+1:]
+	}
+	v.fail(modPath, version, hash, "checksum mismatch")
+	return []byte(fmt.Sprintf("verifying %s@%s: checksum mismatch\n\tdownloaded: %s\n\t%s: %s\n\n"+
+		"SECURITY ERROR\nThis download does NOT match the one reported by the checksum server.\n"+
+		"The download was refused by the proxy.\n", modPath, version, hash, v.db.Name, sumDBHash)), http.StatusForbidden, nil
+}
+
+// fail records a refused download in the audit log
+func (v *verifyingUpstream) fail(modPath, version, hash, reason string) {
+	v.mu.Lock()
+	v.failures++
+	v.mu.Unlock()
+	log.Printf("audit: refused %s@%s sumdb=%s downloaded=%s: %s", modPath, version, v.db.Name, hash, reason)
+}
+
+// Metrics implements upstream.MetricsUpstream
+func (v *verifyingUpstream) Metrics() []upstream.Metric {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	labels := map[string]string{"sumdb": v.db.Name}
+	return []upstream.Metric{
+		{Name: "modpox_sumdb_verified_total", Help: "Downloads verified against the checksum database.", Labels: labels, Value: float64(v.verified)},
+		{Name: "modpox_sumdb_verify_failures_total", Help: "Downloads refused because they failed checksum verification.", Labels: labels, Value: float64(v.failures)},
+	}
+}
+
+// parseDownloadKey parses a /<module>/@v/<version><ext> key of a .info,
+// .mod or .zip file
+func parseDownloadKey(key string) (module.Version, string, bool) {
+	i := strings.LastIndex(key, "/@v/")
+	if i < 0 {
+		return module.Version{}, "", false
+	}
+	file := key[i+len("/@v/"):]
+	ext := path.Ext(file)
+	if ext != ".info" && ext != ".mod" && ext != ".zip" {
+		return module.Version{}, "", false
+	}
+	modPath, err1 := module.UnescapePath(strings.TrimPrefix(key[:i], "/"))
+	version, err2 := module.UnescapeVersion(strings.TrimSuffix(file, ext))
+	if err1 != nil || err2 != nil {
+		return module.Version{}, "", false
+	}
+	return module.Version{Path: modPath, Version: version}, ext, true
+}
+
+// isDownloadKey reports whether key is a .mod or .zip download
+func isDownloadKey(key string) bool {
+	_, ext, ok := parseDownloadKey(key)
+	return ok && ext != ".info"
+}
+
+// hashDownload returns the go.sum hash of a .mod or .zip file
+func hashDownload(ext string, b []byte) (string, error) {
+	if ext == ".mod" {
+		return hashMod(b)
+	}
+	return hashZip(b)
+}
+
+// hashMod returns the go.sum hash of a go.mod file
+func hashMod(b []byte) (string, error) {
+	return dirhash.Hash1([]string{"go.mod"}, func(string) (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(b)), nil
+	})
+}
+
+// hashZip returns the go.sum hash of a module zip, like dirhash.HashZip
+func hashZip(b []byte) (string, error) {
+	z, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid module zip", err)
+	}
+	var files []string
+	zfiles := make(map[string]*zip.File)
+	for _, file := range z.File {
+		files = append(files, file.Name)
+		zfiles[file.Name] = file
+	}
+	return dirhash.Hash1(files, func(name string) (io.ReadCloser, error) {
+		return zfiles[name].Open()
+	})
+}
+
+// sumDBClient looks up records in a checksum database. The tiles and
+// records the sumdb.Client keeps in memory are dropped by replacing it
+// periodically, the latest verified tree is kept in the ops.
+type sumDBClient struct {
+	ops     *sumDBClientOps
+	noSumDB string
+
+	mu      sync.Mutex
+	client  *sumdb.Client
+	created time.Time
+}
+
+// newSumDBClient creates a client for db reading through u. Modules matching
+// the GONOSUMDB style noSumDB patterns are not looked up.
+func newSumDBClient(db *SumDB, noSumDB []string, u upstream.Upstream) *sumDBClient {
+	return &sumDBClient{
+		ops:     &sumDBClientOps{db: db, upstream: u, cache: newCache()},
+		noSumDB: strings.Join(noSumDB, ","),
+	}
+}
+
+// Lookup returns the go.sum lines for the module version, see
+// sumdb.Client.Lookup
+func (c *sumDBClient) Lookup(path, vers string) ([]string, error) {
+	c.mu.Lock()
+	if c.client == nil || time.Since(c.created) > sumDBImmutableTTL {
+		c.client = sumdb.NewClient(c.ops)
+		c.client.SetGONOSUMDB(c.noSumDB)
+		c.created = time.Now()
+	}
+	client := c.client
+	c.mu.Unlock()
+	return client.Lookup(path, vers)
+}
+
+// sumDBClientOps implements sumdb.ClientOps, reading from the checksum
+// database through an upstream and keeping verified state in memory.
+// Verified tiles and records are cached as long as the upstream caches
+// tiles and lookups.
+type sumDBClientOps struct {
+	db       *SumDB
+	upstream upstream.Upstream
+	cache    *cache
+
+	mu     sync.Mutex
+	latest []byte
+}
+
+func (o *sumDBClientOps) ReadRemote(path string) ([]byte, error) {
+	b, status, err := o.upstream.Get("/sumdb/" + o.db.Name + path)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("%s%s: unexpected status %d: %s", o.db.Name, path, status, bytes.TrimSpace(b))
+	}
+	return b, nil
+}
+
+func (o *sumDBClientOps) ReadConfig(file string) ([]byte, error) {
+	if file == "key" {
+		return []byte(o.db.Key), nil
+	}
+	if strings.HasSuffix(file, "/latest") {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		return o.latest, nil
+	}
+	return nil, fmt.Errorf("unknown config %s", file)
+}
+
+func (o *sumDBClientOps) WriteConfig(file string, old, new []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !bytes.Equal(old, o.latest) {
+		return sumdb.ErrWriteConflict
+	}
+	o.latest = new
+	return nil
+}
+
+func (o *sumDBClientOps) ReadCache(file string) ([]byte, error) {
+	b, status := o.cache.get(file)
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("%s not cached", file)
+	}
+	return b, nil
+}
+
+func (o *sumDBClientOps) WriteCache(file string, data []byte) {
+	o.cache.setWithTTL(file, data, http.StatusOK, sumDBImmutableTTL)
+}
+
+func (o *sumDBClientOps) Log(msg string) {
+	log.Print(msg)
+}
+
+func (o *sumDBClientOps) SecurityError(msg string) {
+	log.Printf("audit: sumdb %s security error: %s", o.db.Name, msg)
+}
@@ -0,0 +1,128 @@
+package modpox
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/mod/sumdb"
+	"golang.org/x/mod/sumdb/note"
+)
+
+// mapUpstream serves fixed responses and 404 for everything else
+type mapUpstream map[string][]byte
+
+func (m mapUpstream) Get(key string) ([]byte, int, error) {
+	if b, ok := m[key]; ok {
+		return b, http.StatusOK, nil
+	}
+	return []byte("not found"), http.StatusNotFound, nil
+}
+
+func testZip(t *testing.T, prefix string, files map[string]string) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	zw := zip.NewWriter(&b)
+	for name, content := range files {
+		w, err := zw.Create(prefix + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// testSumDB starts a checksum database with the go.sum lines of the given
+// module files, keyed by path@version
+func testSumDB(t *testing.T, name string, mods map[string][]byte, zips map[string][]byte) *SumDB {
+	t.Helper()
+	skey, vkey, err := note.GenerateKey(rand.Reader, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := sumdb.NewTestServer(skey, func(path, vers string) ([]byte, error) {
+		key := path + "@" + vers
+		if _, ok := zips[key]; !ok {
+			return nil, fmt.Errorf("%s not found", key)
+		}
+		zipHash, err := hashZip(zips[key])
+		if err != nil {
+			return nil, err
+		}
+		modHash, err := hashMod(mods[key])
+		if err != nil {
+			return nil, err
+		}
+		return []byte(fmt.Sprintf("%s %s %s\n%s %s/go.mod %s\n", path, vers, zipHash, path, vers, modHash)), nil
+	})
+	srv := httptest.NewServer(sumdb.NewServer(ts))
+	t.Cleanup(srv.Close)
+	return &SumDB{Name: name, Key: vkey, URL: srv.URL}
+}
+
+func TestVerifyingUpstream(t *testing.T) {
+	mod := []byte("module example.com/a\n")
+	genuine := testZip(t, "example.com/a@v1.0.0/", map[string]string{"go.mod": string(mod), "a.go": "package a\n"})
+	tampered := testZip(t, "example.com/a@v1.0.0/", map[string]string{"go.mod": string(mod), "a.go": "package a\n\nfunc init() { evil() }\n"})
+	db := testSumDB(t, "sum.example.com",
+		map[string][]byte{"example.com/a@v1.0.0": mod, "example.com/private@v1.0.0": mod},
+		map[string][]byte{"example.com/a@v1.0.0": genuine, "example.com/private@v1.0.0": genuine},
+	)
+	files := mapUpstream{
+		"/example.com/a/@v/v1.0.0.mod":       mod,
+		"/example.com/a/@v/v1.0.0.zip":       genuine,
+		"/example.com/a/@v/v1.0.0.info":      []byte(`{"Version":"v1.0.0"}`),
+		"/example.com/private/@v/v1.0.0.zip": tampered,
+		"/example.com/unknown/@v/v1.0.0.mod": mod,
+	}
+	v := newVerifyingUpstream(db, []string{"example.com/private"}, newSumDBUpstream([]*SumDB{db}, files))
+
+	for _, tc := range []struct {
+		key    string
+		status int
+		body   string
+	}{
+		{key: "/example.com/a/@v/v1.0.0.mod", status: http.StatusOK},
+		{key: "/example.com/a/@v/v1.0.0.zip", status: http.StatusOK},
+		{key: "/example.com/a/@v/v1.0.0.info", status: http.StatusOK},
+		{key: "/example.com/a/@v/v1.1.0.zip", status: http.StatusNotFound},
+		{key: "/example.com/private/@v/v1.0.0.zip", status: http.StatusOK},
+		{key: "/example.com/unknown/@v/v1.0.0.mod", status: http.StatusBadGateway, body: "could not look up checksum"},
+	} {
+		b, status, err := v.Get(tc.key)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tc.key, err)
+		}
+		if status != tc.status || !strings.Contains(string(b), tc.body) {
+			t.Errorf("%s: got %d %q, want %d %q", tc.key, status, b, tc.status, tc.body)
+		}
+	}
+	if v.failures != 0 || v.verified != 2 {
+		t.Errorf("unexpected counts: %d verified, %d failures", v.verified, v.failures)
+	}
+
+	files["/example.com/a/@v/v1.0.0.zip"] = tampered
+	b, status, err := v.Get("/example.com/a/@v/v1.0.0.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusForbidden || !strings.Contains(string(b), "checksum mismatch") || !strings.Contains(string(b), "SECURITY ERROR") {
+		t.Errorf("tampered zip not refused: %d %q", status, b)
+	}
+	files["/example.com/a/@v/v1.0.0.zip"] = []byte("not a zip")
+	if _, status, _ := v.Get("/example.com/a/@v/v1.0.0.zip"); status != http.StatusForbidden {
+		t.Errorf("invalid zip not refused: %d", status)
+	}
+	if v.failures != 2 {
+		t.Errorf("failures not recorded: %d", v.failures)
+	}
+}
@@ -0,0 +1,223 @@
+package vuln
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wozz/modpox/upstream"
+	"golang.org/x/mod/module"
+)
+
+// reloadInterval is how often the database mirror is checked for updates
+const reloadInterval = time.Minute
+
+// Exception allows downloads of vulnerable versions of modules
+type Exception struct {
+	// Module is a GOPRIVATE style glob of the module paths excepted
+	Module string
+	// IDs limits the exception to these vulnerabilities, by OSV ID or
+	// alias, by default all vulnerabilities are excepted
+	IDs []string
+	// Reason is logged when a download is allowed by the exception
+	Reason string
+}
+
+// Config is used to configure the vulnerability upstream
+type Config struct {
+	Upstream upstream.Upstream
+	// Dir is a local mirror of a vulnerability database like vuln.go.dev,
+	// with an OSV entry per vulnerability in Dir/ID/<id>.json
+	Dir string
+	// Block refuses downloads of versions with vulnerabilities of at least
+	// this severity, by default nothing is blocked
+	Block Severity
+	// Warn logs downloads of versions with vulnerabilities of at least this
+	// severity that are not blocked, by default all vulnerable downloads
+	// are logged
+	Warn Severity
+	// Unrated is the severity assumed for vulnerabilities without one,
+	// which includes most vuln.go.dev entries. Defaults to High.
+	Unrated Severity
+	// Exceptions allow vulnerable downloads that would be blocked
+	Exceptions []*Exception
+}
+
+type vulnUpstream struct {
+	dir        string
+	block      Severity
+	warn       Severity
+	unrated    Severity
+	exceptions []*Exception
+	upstream   upstream.Upstream
+
+	mu       sync.Mutex
+	db       db
+	modTime  time.Time
+	checked  time.Time
+	blocked  int
+	warnings int
+}
+
+// NewVulnUpstream creates a new upstream refusing or logging .zip downloads
+// of vulnerable module versions. Version lists, .info and .mod files are
+// always served, since the go command needs them to select versions.
+func NewVulnUpstream(config *Config) upstream.Upstream {
+	v := &vulnUpstream{
+		dir:        config.Dir,
+		block:      config.Block,
+		warn:       config.Warn,
+		unrated:    config.Unrated,
+		exceptions: config.Exceptions,
+		upstream:   config.Upstream,
+	}
+	if v.unrated == 0 {
+		v.unrated = High
+	}
+	if v.warn == 0 {
+		v.warn = Low
+	}
+	v.reload()
+	return v
+}
+
+// reload reads the database again if the mirror changed
+func (v *vulnUpstream) reload() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if time.Since(v.checked) < reloadInterval {
+		return
+	}
+	v.checked = time.Now()
+	var modTime time.Time
+	for _, name := range []string{"ID", filepath.Join("index", "db.json")} {
+		if info, err := os.Stat(filepath.Join(v.dir, name)); err == nil && info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	if v.db != nil && modTime.Equal(v.modTime) {
+		return
+	}
+	d, err := loadDB(v.dir)
+	if err != nil {
+		log.Printf("vuln: could not load vulnerability database: %v", err)
+		return
+	}
+	v.db = d
+	v.modTime = modTime
+	log.Printf("vuln: loaded vulnerability database from %s with %d modules", v.dir, len(d))
+}
+
+func (v *vulnUpstream) Get(key string) ([]byte, int, error) {
+	return v.get(key, nil)
+}
+
+// GetAs implements upstream.AuthUpstream
+func (v *vulnUpstream) GetAs(key string, creds *upstream.Credentials) ([]byte, int, error) {
+	return v.get(key, creds)
+}
+
+func (v *vulnUpstream) get(key string, creds *upstream.Credentials) ([]byte, int, error) {
+	i := strings.LastIndex(key, "/@v/")
+	if i < 0 || !strings.HasSuffix(key, ".zip") {
+		return upstream.GetAs(v.upstream, key, creds)
+	}
+	modPath, err1 := module.UnescapePath(strings.TrimPrefix(key[:i], "/"))
+	version, err2 := module.UnescapeVersion(strings.TrimSuffix(key[i+len("/@v/"):], ".zip"))
+	if err1 != nil || err2 != nil {
+		return upstream.GetAs(v.upstream, key, creds)
+	}
+	v.reload()
+	v.mu.Lock()
+	d := v.db
+	v.mu.Unlock()
+	if d == nil {
+		// without a database nothing can be checked, which must not go
+		// unnoticed if downloads are supposed to be blocked
+		if v.block != 0 {
+			return []byte("vulnerability database unavailable\n"), http.StatusServiceUnavailable, nil
+		}
+		return upstream.GetAs(v.upstream, key, creds)
+	}
+
+	m := module.Version{Path: modPath, Version: version}
+	var blocking []string
+	for _, e := range d[modPath] {
+		affected, fixed := e.affects(modPath, version)
+		if !affected {
+			continue
+		}
+		sev := e.severity()
+		if sev == 0 {
+			sev = v.unrated
+		}
+		desc := fmt.Sprintf("%s (%s", e.ID, sev)
+		if fixed != "" {
+			desc += ", fixed in " + fixed
+		}
+		desc += ")"
+		if v.block != 0 && sev >= v.block {
+			if ex := v.exception(modPath, e); ex != nil {
+				log.Printf("vuln: WARNING %s has known vulnerability %s, allowed by exception: %s", m, desc, ex.Reason)
+				v.count(&v.warnings)
+				continue
+			}
+			blocking = append(blocking, desc)
+			continue
+		}
+		if sev >= v.warn {
+			log.Printf("vuln: WARNING %s has known vulnerability %s: %s", m, desc, e.Summary)
+			v.count(&v.warnings)
+		}
+	}
+	if len(blocking) > 0 {
+		log.Printf("vuln: blocked %s: %s", m, strings.Join(blocking, ", "))
+		v.count(&v.blocked)
+		return []byte(fmt.Sprintf("%s has known vulnerabilities: %s\n", m, strings.Join(blocking, ", "))), http.StatusForbidden, nil
+	}
+	return upstream.GetAs(v.upstream, key, creds)
+}
+
+func (v *vulnUpstream) count(n *int) {
+	v.mu.Lock()
+	*n++
+	v.mu.Unlock()
+}
+
+// exception returns the exception allowing a vulnerability, if any
+func (v *vulnUpstream) exception(modPath string, e *entry) *Exception {
+	for _, ex := range v.exceptions {
+		if !module.MatchPrefixPatterns(ex.Module, modPath) {
+			continue
+		}
+		if len(ex.IDs) == 0 {
+			return ex
+		}
+		for _, id := range ex.IDs {
+			if id == e.ID {
+				return ex
+			}
+			for _, alias := range e.Aliases {
+				if id == alias {
+					return ex
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Metrics implements upstream.MetricsUpstream
+func (v *vulnUpstream) Metrics() []upstream.Metric {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return []upstream.Metric{
+		{Name: "modpox_vuln_blocked_total", Help: "Downloads blocked for known vulnerabilities.", Value: float64(v.blocked)},
+		{Name: "modpox_vuln_warnings_total", Help: "Downloads of versions with known vulnerabilities that were not blocked.", Value: float64(v.warnings)},
+	}
+}
@@ -0,0 +1,247 @@
+// Package vuln implements an upstream that blocks or warns on downloads of
+// module versions with known vulnerabilities, from a local mirror of a Go
+// vulnerability database in the OSV format, like vuln.go.dev
+package vuln
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/semver"
+)
+
+// Severity is the qualitative severity of a vulnerability
+type Severity int
+
+const (
+	Low Severity = iota + 1
+	Moderate
+	High
+	Critical
+)
+
+var severityNames = map[string]Severity{
+	"LOW":      Low,
+	"MODERATE": Moderate,
+	"MEDIUM":   Moderate,
+	"HIGH":     High,
+	"CRITICAL": Critical,
+}
+
+// ParseSeverity parses LOW, MODERATE (or MEDIUM), HIGH or CRITICAL
+func ParseSeverity(s string) (Severity, error) {
+	if sev, ok := severityNames[strings.ToUpper(strings.TrimSpace(s))]; ok {
+		return sev, nil
+	}
+	return 0, fmt.Errorf("unknown severity %q", s)
+}
+
+func (s Severity) String() string {
+	switch s {
+	case Low:
+		return "LOW"
+	case Moderate:
+		return "MODERATE"
+	case High:
+		return "HIGH"
+	case Critical:
+		return "CRITICAL"
+	}
+	return "UNRATED"
+}
+
+// entry is the part of an OSV entry used to match module versions
+type entry struct {
+	ID        string   `json:"id"`
+	Aliases   []string `json:"aliases"`
+	Withdrawn string   `json:"withdrawn"`
+	Summary   string   `json:"summary"`
+	Severity  []struct {
+		Type  string `json:"type"`
+		Score string `json:"score"`
+	} `json:"severity"`
+	Affected []struct {
+		Package struct {
+			Ecosystem string `json:"ecosystem"`
+			Name      string `json:"name"`
+		} `json:"package"`
+		Ranges []struct {
+			Type   string `json:"type"`
+			Events []struct {
+				Introduced string `json:"introduced"`
+				Fixed      string `json:"fixed"`
+			} `json:"events"`
+		} `json:"ranges"`
+	} `json:"affected"`
+	DatabaseSpecific struct {
+		Severity string `json:"severity"`
+	} `json:"database_specific"`
+}
+
+// severity returns the severity given by the database or computed from a
+// CVSS v3 vector, 0 if the entry is unrated like most vuln.go.dev entries
+func (e *entry) severity() Severity {
+	if sev, err := ParseSeverity(e.DatabaseSpecific.Severity); err == nil {
+		return sev
+	}
+	var max Severity
+	for _, s := range e.Severity {
+		if s.Type != "CVSS_V3" {
+			continue
+		}
+		if sev := cvss3Severity(s.Score); sev > max {
+			max = sev
+		}
+	}
+	return max
+}
+
+// affects reports whether version of the module is affected, and the
+// version fixing it if any
+func (e *entry) affects(modPath, version string) (bool, string) {
+	for _, a := range e.Affected {
+		if a.Package.Ecosystem != "Go" || a.Package.Name != modPath {
+			continue
+		}
+		for _, r := range a.Ranges {
+			if r.Type != "SEMVER" {
+				continue
+			}
+			// events are sorted, each introduced version starts a range
+			// ending at the next fixed version
+			affected := false
+			for _, ev := range r.Events {
+				switch {
+				case ev.Introduced != "":
+					affected = ev.Introduced == "0" || semver.Compare(version, "v"+ev.Introduced) >= 0
+				case ev.Fixed != "" && affected:
+					if semver.Compare(version, "v"+ev.Fixed) < 0 {
+						return true, "v" + ev.Fixed
+					}
+					affected = false
+				}
+			}
+			if affected {
+				return true, ""
+			}
+		}
+	}
+	return false, ""
+}
+
+// db is the set of entries by module path
+type db map[string][]*entry
+
+// loadDB reads the OSV entries in the ID directory of a vulnerability
+// database mirror
+func loadDB(dir string) (db, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "ID", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		if _, err := os.Stat(filepath.Join(dir, "ID")); err != nil {
+			return nil, fmt.Errorf("%w: no vulnerability database in %s", err, dir)
+		}
+	}
+	sort.Strings(files)
+	d := make(db)
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("%w: could not read vulnerability entry", err)
+		}
+		e := &entry{}
+		if err := json.Unmarshal(b, e); err != nil {
+			return nil, fmt.Errorf("%w: invalid vulnerability entry %s", err, filepath.Base(file))
+		}
+		if e.Withdrawn != "" {
+			continue
+		}
+		seen := make(map[string]bool)
+		for _, a := range e.Affected {
+			if a.Package.Ecosystem == "Go" && !seen[a.Package.Name] {
+				seen[a.Package.Name] = true
+				d[a.Package.Name] = append(d[a.Package.Name], e)
+			}
+		}
+	}
+	return d, nil
+}
+
+// cvss3Severity computes the qualitative severity of a CVSS v3 base score
+// vector like CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H
+func cvss3Severity(vector string) Severity {
+	parts := strings.Split(vector, "/")
+	if len(parts) == 0 || !strings.HasPrefix(parts[0], "CVSS:3") {
+		return 0
+	}
+	m := make(map[string]string)
+	for _, p := range parts[1:] {
+		if kv := strings.SplitN(p, ":", 2); len(kv) == 2 {
+			m[kv[0]] = kv[1]
+		}
+	}
+	weights := map[string]map[string]float64{
+		"AV": {"N": 0.85, "A": 0.62, "L": 0.55, "P": 0.2},
+		"AC": {"L": 0.77, "H": 0.44},
+		"UI": {"N": 0.85, "R": 0.62},
+		"C":  {"H": 0.56, "L": 0.22, "N": 0},
+		"I":  {"H": 0.56, "L": 0.22, "N": 0},
+		"A":  {"H": 0.56, "L": 0.22, "N": 0},
+	}
+	changed := m["S"] == "C"
+	if m["S"] != "U" && !changed {
+		return 0
+	}
+	weights["PR"] = map[string]float64{"N": 0.85, "L": 0.62, "H": 0.27}
+	if changed {
+		weights["PR"] = map[string]float64{"N": 0.85, "L": 0.68, "H": 0.5}
+	}
+	w := make(map[string]float64)
+	for k, values := range weights {
+		v, ok := values[m[k]]
+		if !ok {
+			return 0
+		}
+		w[k] = v
+	}
+	iss := 1 - (1-w["C"])*(1-w["I"])*(1-w["A"])
+	impact := 6.42 * iss
+	if changed {
+		impact = 7.52*(iss-0.029) - 3.25*math.Pow(iss-0.02, 15)
+	}
+	if impact <= 0 {
+		return 0
+	}
+	score := impact + 8.22*w["AV"]*w["AC"]*w["PR"]*w["UI"]
+	if changed {
+		score *= 1.08
+	}
+	score = roundUp(math.Min(score, 10))
+	switch {
+	case score >= 9:
+		return Critical
+	case score >= 7:
+		return High
+	case score >= 4:
+		return Moderate
+	case score > 0:
+		return Low
+	}
+	return 0
+}
+
+// roundUp rounds up to one decimal as defined by the CVSS v3.1 spec
+func roundUp(x float64) float64 {
+	i := int(math.Round(x * 100000))
+	if i%10000 == 0 {
+		return float64(i) / 100000
+	}
+	return float64(i/10000+1) / 10
+}
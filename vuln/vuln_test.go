@@ -0,0 +1,120 @@
+package vuln
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type fakeUpstream struct{}
+
+func (fakeUpstream) Get(key string) ([]byte, int, error) {
+	return []byte("upstream"), http.StatusOK, nil
+}
+
+func TestCVSS3Severity(t *testing.T) {
+	for vector, want := range map[string]Severity{
+		"CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H": Critical, // 9.8
+		"CVSS:3.0/AV:L/AC:L/PR:L/UI:N/S:U/C:H/I:H/A:H": High,     // 7.8
+		"CVSS:3.1/AV:N/AC:L/PR:L/UI:N/S:C/C:L/I:L/A:N": Moderate, // 6.4
+		"CVSS:3.1/AV:N/AC:H/PR:N/UI:R/S:U/C:L/I:N/A:N": Low,      // 3.1
+		"CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:N/I:N/A:N": 0,
+		"CVSS:3.1/AV:X/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H": 0,
+		"CVSS:4.0/AV:N/AC:L/AT:N/PR:N/UI:N/VC:H/VI:H":  0,
+	} {
+		if got := cvss3Severity(vector); got != want {
+			t.Errorf("%s: got %s, want %s", vector, got, want)
+		}
+	}
+}
+
+func TestVulnUpstream(t *testing.T) {
+	v := NewVulnUpstream(&Config{
+		Upstream: fakeUpstream{},
+		Dir:      filepath.Join("testdata", "vulndb"),
+		Block:    High,
+	})
+	for key, want := range map[string]struct {
+		status int
+		body   string
+	}{
+		"/example.com/a/@v/v1.1.0.zip": {http.StatusForbidden, "example.com/a@v1.1.0 has known vulnerabilities: GO-2023-0001 (HIGH, fixed in v1.2.0)\n"},
+		"/example.com/a/@v/v1.1.0.mod": {http.StatusOK, "upstream"},
+		"/example.com/a/@v/v1.2.0.zip": {http.StatusOK, "upstream"},
+		// only a LOW vulnerability
+		"/example.com/a/@v/v1.3.0.zip": {http.StatusOK, "upstream"},
+		"/example.com/b/@v/v0.9.0.zip": {http.StatusOK, "upstream"},
+		"/example.com/b/@v/v1.0.4.zip": {http.StatusForbidden, "example.com/b@v1.0.4 has known vulnerabilities: GO-2023-0003 (CRITICAL, fixed in v1.0.5)\n"},
+		"/example.com/b/@v/v1.0.5.zip": {http.StatusOK, "upstream"},
+		"/example.com/b/@v/v1.1.1.zip": {http.StatusForbidden, "example.com/b@v1.1.1 has known vulnerabilities: GO-2023-0003 (CRITICAL, fixed in v1.1.2)\n"},
+		"/example.com/b/@v/v1.1.2.zip": {http.StatusOK, "upstream"},
+		// withdrawn
+		"/example.com/c/@v/v1.0.0.zip": {http.StatusOK, "upstream"},
+	} {
+		b, status, err := v.Get(key)
+		if err != nil || status != want.status || string(b) != want.body {
+			t.Errorf("%s: got %d %q %v, want %d %q", key, status, b, err, want.status, want.body)
+		}
+	}
+	if m := v.(*vulnUpstream).Metrics(); m[0].Value != 3 || m[1].Value != 1 {
+		t.Errorf("unexpected metrics %v", m)
+	}
+
+	v = NewVulnUpstream(&Config{
+		Upstream:   fakeUpstream{},
+		Dir:        filepath.Join("testdata", "vulndb"),
+		Block:      Moderate,
+		Unrated:    Low,
+		Exceptions: []*Exception{{Module: "example.com/b", IDs: []string{"CVE-2023-3333"}, Reason: "not reachable"}},
+	})
+	for _, key := range []string{"/example.com/a/@v/v1.1.0.zip", "/example.com/b/@v/v1.0.4.zip"} {
+		if b, status, _ := v.Get(key); status != http.StatusOK {
+			t.Errorf("%s: not allowed: %d %q", key, status, b)
+		}
+	}
+
+	// a warn threshold above the block threshold doesn't let vulnerabilities
+	// that should be blocked through
+	v = NewVulnUpstream(&Config{
+		Upstream: fakeUpstream{},
+		Dir:      filepath.Join("testdata", "vulndb"),
+		Block:    High,
+		Warn:     Critical,
+	})
+	if b, status, _ := v.Get("/example.com/a/@v/v1.1.0.zip"); status != http.StatusForbidden {
+		t.Errorf("HIGH vulnerability not blocked: %d %q", status, b)
+	}
+}
+
+func TestVulnUpstreamReload(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "ID"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	u := NewVulnUpstream(&Config{Upstream: fakeUpstream{}, Dir: dir, Block: High})
+	if _, status, _ := u.Get("/example.com/a/@v/v1.0.0.zip"); status != http.StatusOK {
+		t.Fatalf("not allowed before the database update: %d", status)
+	}
+	b, err := os.ReadFile(filepath.Join("testdata", "vulndb", "ID", "GO-2023-0001.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "ID", "GO-2023-0001.json"), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "ID"), future, future); err != nil {
+		t.Fatal(err)
+	}
+	u.(*vulnUpstream).checked = time.Time{}
+	if _, status, _ := u.Get("/example.com/a/@v/v1.0.0.zip"); status != http.StatusForbidden {
+		t.Errorf("not blocked after the database update: %d", status)
+	}
+
+	u = NewVulnUpstream(&Config{Upstream: fakeUpstream{}, Dir: filepath.Join(dir, "missing"), Block: High})
+	if _, status, _ := u.Get("/example.com/a/@v/v1.0.0.zip"); status != http.StatusServiceUnavailable {
+		t.Errorf("served without a database: %d", status)
+	}
+}
@@ -0,0 +1,100 @@
+package modpox
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/wozz/modpox/gitlab"
+	"golang.org/x/mod/module"
+)
+
+// maxWebhookSize limits the size of webhook payloads
+const maxWebhookSize = 25 << 20
+
+// newWebhookHandler receives push and tag push webhooks from forges and
+// invalidates the cached version list and latest version of the affected
+// modules. New versions are optionally prefetched.
+func newWebhookHandler(srv *Server) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var b bytes.Buffer
+		if _, err := io.Copy(&b, io.LimitReader(r.Body, maxWebhookSize)); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		for _, wu := range srv.webhooks {
+			change, err := wu.ParseWebhook(r.Header, b.Bytes())
+			if errors.Is(err, gitlab.ErrInvalidWebhookToken) {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				log.Printf("webhook error: %v", err)
+				fmt.Fprintln(w, err)
+				return
+			}
+			if change == nil {
+				continue
+			}
+			for _, modPath := range change.Modules {
+				srv.invalidate(modPath)
+			}
+			if srv.prefetch {
+				for _, v := range change.Versions {
+					go srv.prefetchVersion(v)
+				}
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// invalidate removes the version list, latest version and resolved version
+// queries of a module from the cache. The backend only stores immutable
+// responses, so it has nothing to invalidate.
+func (s *Server) invalidate(modPath string) {
+	escaped, err := module.EscapePath(modPath)
+	if err != nil {
+		log.Printf("invalid module path: %s %v", modPath, err)
+		return
+	}
+	for _, key := range []string{
+		fmt.Sprintf("/%s/@v/list", escaped),
+		fmt.Sprintf("/%s/@latest", escaped),
+	} {
+		log.Printf("invalidate: %s", key)
+		s.cache.invalidate(key)
+	}
+	s.cache.invalidateQueries(escaped)
+}
+
+// prefetchVersion requests the .info, .mod and .zip of a new version so they
+// are cached before the first client asks for them
+func (s *Server) prefetchVersion(v module.Version) {
+	escPath, err := module.EscapePath(v.Path)
+	if err != nil {
+		log.Printf("invalid module path: %s %v", v.Path, err)
+		return
+	}
+	escVersion, err := module.EscapeVersion(v.Version)
+	if err != nil {
+		log.Printf("invalid module version: %s %v", v.Version, err)
+		return
+	}
+	for _, ext := range []string{".info", ".mod", ".zip"} {
+		key := fmt.Sprintf("/%s/@v/%s%s", escPath, escVersion, ext)
+		if _, status, err := s.backend.Get(key); err != nil || status != http.StatusOK {
+			log.Printf("prefetch failed: %s %d %v", key, status, err)
+		}
+	}
+}